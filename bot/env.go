@@ -0,0 +1,18 @@
+package bot
+
+import (
+	"fmt"
+	"os"
+)
+
+// LegacyTokensFromEnv reads the BOT_1_TOKEN..BOT_7_TOKEN variables that
+// predate BOT_TOKENS, skipping unset ones.
+func LegacyTokensFromEnv() []string {
+	var tokens []string
+	for i := 1; i <= 7; i++ {
+		if t := os.Getenv(fmt.Sprintf("BOT_%d_TOKEN", i)); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
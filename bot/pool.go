@@ -14,8 +14,6 @@ type BotPool struct {
 }
 
 func NewBotPool(tokens []string) (*BotPool, error) {
-	var bots []*tgbotapi.BotAPI
-
 	// Custom HTTP Client with long timeout for uploads
 	client := &http.Client{
 		Timeout: 10 * time.Minute, // Allow slow uploads
@@ -25,7 +23,13 @@ func NewBotPool(tokens []string) (*BotPool, error) {
 			IdleConnTimeout:     90 * time.Second,
 		},
 	}
+	return NewBotPoolWithClient(tokens, client)
+}
 
+// NewBotPoolWithClient is NewBotPool with the HTTP client the bots use for
+// Bot API calls, e.g. to route them to a stand-in server in tests.
+func NewBotPoolWithClient(tokens []string, client *http.Client) (*BotPool, error) {
+	var bots []*tgbotapi.BotAPI
 	for _, t := range tokens {
 		if t == "" {
 			continue
@@ -50,3 +54,15 @@ func (p *BotPool) GetNextBot() *tgbotapi.BotAPI {
 func (p *BotPool) GetAllBots() []*tgbotapi.BotAPI {
 	return p.bots
 }
+
+// GetNextBotExcluding returns the next bot in rotation whose username is not
+// in exclude. If every bot is excluded it falls back to GetNextBot.
+func (p *BotPool) GetNextBotExcluding(exclude map[string]bool) *tgbotapi.BotAPI {
+	for range p.bots {
+		b := p.GetNextBot()
+		if !exclude[b.Self.UserName] {
+			return b
+		}
+	}
+	return p.GetNextBot()
+}
@@ -0,0 +1,383 @@
+// Package client is a Go client for the telegram-storage HTTP API. It
+// implements the chunked upload protocol (with resume and whole-file
+// deduplication), parallel ranged downloads, seekable reads, paginated
+// listing and share links. Requests that fail transiently are retried with
+// exponential backoff; every call stops when its context is cancelled.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"telegram-storage/models"
+)
+
+const (
+	DefaultChunkSize   = 10 * 1024 * 1024 // matches the web frontend
+	DefaultConcurrency = 4
+	DefaultMaxAttempts = 5
+	DefaultListLimit   = 100
+)
+
+// Server limits on uploaded parts, the same as the server's.
+const (
+	MaxChunkSize     = 50 * 1024 * 1024
+	MaxChunksPerFile = 1000
+)
+
+// Client talks to one server. The zero values of its fields select the
+// defaults; set them before the first call.
+type Client struct {
+	BaseURL     string
+	HTTPClient  *http.Client
+	ChunkSize   int64 // bytes per downloaded range and uploaded part; parts grow to fit MaxChunksPerFile
+	Concurrency int   // parts transferred at once
+	MaxAttempts int   // tries per request before giving up
+	RetryDelay  time.Duration
+}
+
+// New returns a client for the server at baseURL, e.g. "http://localhost:80".
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		HTTPClient:  &http.Client{},
+		ChunkSize:   DefaultChunkSize,
+		Concurrency: DefaultConcurrency,
+		MaxAttempts: DefaultMaxAttempts,
+		RetryDelay:  time.Second,
+	}
+}
+
+// Error is an error answered by the server.
+type Error struct {
+	StatusCode int           `json:"-"`
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	RequestID  string        `json:"request_id"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%s (%s, request %s)", e.Message, e.Code, e.RequestID)
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// IsNotFound reports whether err is a not_found answer from the server.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// retryable reports whether a request that failed with err may succeed when
+// sent again.
+func retryable(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// permanentError wraps a failure that sending the request again cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// request describes one API call. body, when set, is called for every
+// attempt so the request can be resent.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   func() (io.Reader, string, error)
+}
+
+// retry calls fn until it succeeds, fails with an error that is not worth
+// retrying, or MaxAttempts is reached. fn is passed the attempt number,
+// starting at 1.
+func (c *Client) retry(ctx context.Context, fn func(attempt int) error) error {
+	var lastErr error
+	for attempt := 0; attempt < c.maxAttempts(); attempt++ {
+		if attempt > 0 {
+			delay := time.Duration(math.Pow(2, float64(attempt-1))) * c.retryDelay()
+			var apiErr *Error
+			if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > delay {
+				delay = apiErr.RetryAfter
+			}
+			select {
+			case <-time.After(min(delay, time.Minute)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err := fn(attempt + 1)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retryable(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return lastErr
+}
+
+// send performs req, retrying failures that may be transient, and returns
+// the response of the first successful attempt. The caller closes its body.
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	var resp *http.Response
+	err := c.retry(ctx, func(int) error {
+		var err error
+		resp, err = c.sendOnce(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (c *Client) sendOnce(ctx context.Context, req request) (*http.Response, error) {
+	u := c.BaseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	var contentType string
+	if req.body != nil {
+		var err error
+		if body, contentType, err = req.body(); err != nil {
+			return nil, err
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.httpClient().Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// responseError decodes the {"error": {...}} body of a failed response.
+func responseError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	var envelope struct {
+		Error json.RawMessage `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, &envelope) != nil || json.Unmarshal(envelope.Error, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Code = "http_" + strconv.Itoa(resp.StatusCode)
+		apiErr.Message = resp.Status
+	}
+	return apiErr
+}
+
+// call performs req and decodes the JSON response into out, if not nil.
+func (c *Client) call(ctx context.Context, req request, out interface{}) error {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response to %s %s: %w", req.method, req.path, err)
+	}
+	return nil
+}
+
+// jsonBody encodes v as a request body.
+func jsonBody(v interface{}) func() (io.Reader, string, error) {
+	return func() (io.Reader, string, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+		return bytes.NewReader(data), "application/json", nil
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) chunkSize() int64 {
+	if c.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return c.ChunkSize
+}
+
+// partSize returns the size of the parts a file of size bytes is uploaded
+// in: ChunkSize, grown as needed to stay within MaxChunksPerFile parts and
+// never above MaxChunkSize. It only depends on ChunkSize and size, so a
+// resumed upload splits the file the same way.
+func (c *Client) partSize(size int64) int64 {
+	n := max(c.chunkSize(), (size+MaxChunksPerFile-1)/MaxChunksPerFile)
+	return min(n, MaxChunkSize)
+}
+
+func (c *Client) concurrency() int {
+	if c.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return c.Concurrency
+}
+
+func (c *Client) maxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+func (c *Client) retryDelay() time.Duration {
+	if c.RetryDelay <= 0 {
+		return time.Second
+	}
+	return c.RetryDelay
+}
+
+// ListFiles returns all completed files, newest first.
+func (c *Client) ListFiles(ctx context.Context) ([]models.FileMetadata, error) {
+	var files []models.FileMetadata
+	err := c.call(ctx, request{method: http.MethodGet, path: "/files"}, &files)
+	return files, err
+}
+
+// ListOptions select a page of files.
+type ListOptions struct {
+	Limit  int    // files per page; DefaultListLimit when zero
+	Cursor string // from the previous page; empty for the first
+}
+
+// List returns one page of completed files, newest first, and the cursor of
+// the next page, which is empty after the last one.
+func (c *Client) List(ctx context.Context, opts ListOptions) (files []models.FileMetadata, next string, err error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+
+	resp, err := c.send(ctx, request{method: http.MethodGet, path: "/files", query: query})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, "", fmt.Errorf("invalid response to GET /files: %w", err)
+	}
+	return files, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// GetFile returns a file record.
+func (c *Client) GetFile(ctx context.Context, fileID string) (*models.FileMetadata, error) {
+	var metadata models.FileMetadata
+	if err := c.call(ctx, request{method: http.MethodGet, path: "/files/" + url.PathEscape(fileID)}, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// DeleteFile deletes a file. The server removes it from listings right away
+// and releases its chunks in the background; the returned ID names that job.
+func (c *Client) DeleteFile(ctx context.Context, fileID string) (jobID string, err error) {
+	var resp struct {
+		JobID string `json:"job_id"`
+	}
+	err = c.call(ctx, request{method: http.MethodDelete, path: "/files/" + url.PathEscape(fileID)}, &resp)
+	return resp.JobID, err
+}
+
+// Share is a link that downloads a file without further credentials.
+type Share struct {
+	Token     string     `json:"token"`
+	FileID    string     `json:"file_id"`
+	URL       string     `json:"url"` // absolute, on the client's server
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Share creates a link to a completed file. A ttl of zero makes a link that
+// works until Unshare or the file is deleted.
+func (c *Client) Share(ctx context.Context, fileID string, ttl time.Duration) (*Share, error) {
+	var share Share
+	req := request{
+		method: http.MethodPost,
+		path:   "/files/" + url.PathEscape(fileID) + "/shares",
+		body:   jsonBody(map[string]int64{"ttl_seconds": int64(ttl / time.Second)}),
+	}
+	if err := c.call(ctx, req, &share); err != nil {
+		return nil, err
+	}
+	share.URL = c.BaseURL + share.URL
+	return &share, nil
+}
+
+// Unshare revokes a link created by Share.
+func (c *Client) Unshare(ctx context.Context, token string) error {
+	return c.call(ctx, request{method: http.MethodDelete, path: "/shares/" + url.PathEscape(token)}, nil)
+}
+
+// UploadStatus reports which parts of an upload the server already has.
+type UploadStatus struct {
+	UploadID string `json:"upload_id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"` // why processing a completed upload failed
+	Received []struct {
+		Sequence int   `json:"sequence"`
+		Size     int64 `json:"size"`
+	} `json:"received"`
+}
+
+func (c *Client) GetUploadStatus(ctx context.Context, uploadID string) (*UploadStatus, error) {
+	var status UploadStatus
+	if err := c.call(ctx, request{method: http.MethodGet, path: "/upload/" + url.PathEscape(uploadID)}, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
@@ -0,0 +1,671 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"telegram-storage/bot"
+	"telegram-storage/client"
+	"telegram-storage/configs"
+	"telegram-storage/controllers"
+	"telegram-storage/models"
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The suite runs the client against the real router and service, backed by
+// the MongoDB at TEST_MONGO_URL (a throwaway database is created and
+// dropped) and a stand-in for the Telegram Bot API. Without TEST_MONGO_URL
+// only the tests that need no server run, including those in stub_test.go.
+
+const testGroupID = -1001
+
+var (
+	setupOnce sync.Once
+	setupErr  error
+	apiServer *httptest.Server
+	telegram  *fakeTelegram
+	testDB    *mongo.Database
+	stopJobs  context.CancelFunc
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testDB != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if stopJobs != nil {
+			stopJobs()
+			services.AppFileService.WaitJobs(ctx)
+		}
+		testDB.Drop(ctx)
+		testDB.Client().Disconnect(ctx)
+		cancel()
+	}
+	if apiServer != nil {
+		apiServer.Close()
+	}
+	os.Exit(code)
+}
+
+// newClient returns a client for the test server, starting it on first use.
+func newClient(t *testing.T) *client.Client {
+	t.Helper()
+	mongoURL := os.Getenv("TEST_MONGO_URL")
+	if mongoURL == "" {
+		t.Skip("TEST_MONGO_URL is not set")
+	}
+	setupOnce.Do(func() { setupErr = startServer(mongoURL) })
+	if setupErr != nil {
+		t.Fatalf("failed to start server: %v", setupErr)
+	}
+
+	c := client.New(apiServer.URL)
+	c.ChunkSize = 64 << 10
+	c.RetryDelay = time.Millisecond
+	return c
+}
+
+func startServer(mongoURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	gin.SetMode(gin.TestMode)
+
+	mongoClient, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
+	if err != nil {
+		return err
+	}
+	if err := mongoClient.Ping(ctx, nil); err != nil {
+		return err
+	}
+	testDB = mongoClient.Database(fmt.Sprintf("tgstore_client_test_%d", time.Now().UnixNano()))
+	if err := configs.SetupIndexes(testDB); err != nil {
+		return err
+	}
+
+	telegram = newFakeTelegram()
+	telegramServer := httptest.NewServer(telegram)
+	target, _ := url.Parse(telegramServer.URL)
+	transport := &redirectTransport{target: target}
+	services.SetDownloadTransport(transport)
+	botPool, err := bot.NewBotPoolWithClient([]string{"1:test"}, &http.Client{Transport: transport})
+	if err != nil {
+		return err
+	}
+
+	cfg := services.DefaultConfig()
+	cfg.SpoolDir, err = os.MkdirTemp("", "tgstore-client-test-")
+	if err != nil {
+		return err
+	}
+	cfg.Pack.Threshold = 0 // small test files take the chunked path
+	cfg.Jobs.PollInterval = 100 * time.Millisecond
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	services.AppFileService = services.NewFileService(botPool, testDB, cfg)
+	controllers.Telegram = configs.TelegramConfig{GroupID: testGroupID}
+
+	var jobsCtx context.Context
+	jobsCtx, stopJobs = context.WithCancel(context.Background())
+	services.AppFileService.StartJobs(jobsCtx)
+
+	apiServer = httptest.NewServer(controllers.NewRouter(nil))
+	return nil
+}
+
+// redirectTransport sends every request to target, so that the fixed
+// api.telegram.org URLs of the bot library reach the fake.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host, req.Host = t.target.Scheme, t.target.Host, ""
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeTelegram implements the Bot API methods the service uses, keeping
+// sent documents in memory.
+type fakeTelegram struct {
+	mu        sync.Mutex
+	documents map[string][]byte
+	nextID    int
+	sent      atomic.Int64 // sendDocument calls
+}
+
+func newFakeTelegram() *fakeTelegram {
+	return &fakeTelegram{documents: make(map[string][]byte)}
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	// /file/bot<token>/<file path>
+	if parts[0] == "file" && len(parts) == 3 {
+		f.mu.Lock()
+		data, ok := f.documents[parts[2]]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+
+	// /bot<token>/<method>
+	method := parts[len(parts)-1]
+	switch method {
+	case "getMe":
+		reply(w, map[string]interface{}{"id": 1, "is_bot": true, "first_name": "Test", "username": "test_bot"})
+	case "sendDocument":
+		if err := r.ParseMultipartForm(64 << 20); err != nil {
+			replyError(w, "Bad Request: "+err.Error())
+			return
+		}
+		file, _, err := r.FormFile("document")
+		if err != nil {
+			replyError(w, "Bad Request: no document")
+			return
+		}
+		data, _ := io.ReadAll(file)
+		f.sent.Add(1)
+
+		f.mu.Lock()
+		f.nextID++
+		id := f.nextID
+		fileID := fmt.Sprintf("doc%d", id)
+		f.documents[fileID] = data
+		f.mu.Unlock()
+		reply(w, message(id, map[string]interface{}{"file_id": fileID, "file_unique_id": fileID, "file_size": len(data)}))
+	case "getFile":
+		fileID := r.FormValue("file_id")
+		f.mu.Lock()
+		_, ok := f.documents[fileID]
+		f.mu.Unlock()
+		if !ok {
+			replyError(w, "Bad Request: invalid file_id")
+			return
+		}
+		reply(w, map[string]interface{}{"file_id": fileID, "file_unique_id": fileID, "file_path": fileID})
+	case "sendMessage", "forwardMessage":
+		f.mu.Lock()
+		f.nextID++
+		id := f.nextID
+		f.mu.Unlock()
+		reply(w, message(id, nil))
+	default:
+		// deleteMessage, pinChatMessage and the like
+		reply(w, true)
+	}
+}
+
+func message(id int, document map[string]interface{}) map[string]interface{} {
+	msg := map[string]interface{}{
+		"message_id": id,
+		"date":       time.Now().Unix(),
+		"chat":       map[string]interface{}{"id": testGroupID, "type": "supergroup"},
+	}
+	if document != nil {
+		msg["document"] = document
+	}
+	return msg
+}
+
+func reply(w http.ResponseWriter, result interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+func replyError(w http.ResponseWriter, description string) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 400, "description": description})
+}
+
+func randomData(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// buffer is an in-memory io.WriterAt.
+type buffer struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *buffer) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if end := int(off) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[off:], p), nil
+}
+
+// eventually polls cond until it holds or timeout passes.
+func eventually(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChunkLimitsMatchServer(t *testing.T) {
+	if client.MaxChunkSize != services.MaxChunkSize {
+		t.Errorf("client.MaxChunkSize = %d, server uses %d", client.MaxChunkSize, services.MaxChunkSize)
+	}
+	if client.MaxChunksPerFile != services.MaxChunksPerFile {
+		t.Errorf("client.MaxChunksPerFile = %d, server uses %d", client.MaxChunksPerFile, services.MaxChunksPerFile)
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	data := randomData(t, 300<<10)
+
+	metadata, err := c.Upload(ctx, "upload-download.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if metadata.Status != "completed" || metadata.Size != int64(len(data)) || metadata.Hash != sha256Hex(data) {
+		t.Fatalf("Upload returned status %q, size %d, hash %s", metadata.Status, metadata.Size, metadata.Hash)
+	}
+	if want := (len(data) + int(c.ChunkSize) - 1) / int(c.ChunkSize); len(metadata.Chunks) != want {
+		t.Errorf("file has %d chunks, want %d", len(metadata.Chunks), want)
+	}
+
+	var got buffer
+	if _, err := c.Download(ctx, metadata.ID.Hex(), &got); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(got.data, data) {
+		t.Fatal("downloaded content differs from the upload")
+	}
+}
+
+func TestUploadFromStream(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	data := randomData(t, 100<<10)
+
+	// A plain reader is spooled before it is sent
+	metadata, err := c.Upload(ctx, "stream.bin", io.MultiReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if metadata.Size != int64(len(data)) || metadata.Hash != sha256Hex(data) {
+		t.Fatalf("Upload stored size %d, hash %s", metadata.Size, metadata.Hash)
+	}
+
+	// A seekable reader is sent from its current position
+	r := bytes.NewReader(data)
+	r.Seek(1000, io.SeekStart)
+	metadata, err = c.Upload(ctx, "tail.bin", r)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if metadata.Hash != sha256Hex(data[1000:]) {
+		t.Fatalf("Upload from offset stored hash %s", metadata.Hash)
+	}
+}
+
+func TestUploadGrowsChunksToFileLimit(t *testing.T) {
+	c := newClient(t)
+	c.ChunkSize = 1
+	c.Concurrency = 16
+	data := randomData(t, 3*client.MaxChunksPerFile+10)
+
+	metadata, err := c.Upload(context.Background(), "many-parts.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if len(metadata.Chunks) > client.MaxChunksPerFile {
+		t.Errorf("file has %d chunks, more than the server allows", len(metadata.Chunks))
+	}
+}
+
+func TestUploadDeduplicates(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	data := randomData(t, 150<<10)
+
+	first, err := c.Upload(ctx, "original.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	// The server deduplicates whole files once it has hashed them itself
+	verified := eventually(t, 10*time.Second, func() bool {
+		m, err := c.GetFile(ctx, first.ID.Hex())
+		return err == nil && m.HashVerified
+	})
+	if !verified {
+		t.Fatal("server did not verify the hash of the upload")
+	}
+
+	sent := telegram.sent.Load()
+	second, err := c.Upload(ctx, "copy.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload of a copy: %v", err)
+	}
+	if n := telegram.sent.Load() - sent; n != 0 {
+		t.Errorf("uploading a copy sent %d documents to Telegram", n)
+	}
+	if second.ID == first.ID || second.Name != "copy.bin" || second.Hash != first.Hash {
+		t.Errorf("copy stored as %s %q with hash %s", second.ID.Hex(), second.Name, second.Hash)
+	}
+}
+
+func TestUploadDeduplicatesOnlyStandard(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	data := randomData(t, 150<<10)
+
+	first, err := c.Upload(ctx, "standard.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	verified := eventually(t, 10*time.Second, func() bool {
+		m, err := c.GetFile(ctx, first.ID.Hex())
+		return err == nil && m.HashVerified
+	})
+	if !verified {
+		t.Fatal("server did not verify the hash of the upload")
+	}
+
+	// A clone would have no parity, so the copy has to be uploaded
+	second, err := c.Put(ctx, bytes.NewReader(data), int64(len(data)), client.PutOptions{
+		Name:        "erasure.bin",
+		StorageMode: models.StorageModeErasure,
+	})
+	if err != nil {
+		t.Fatalf("Put in erasure mode: %v", err)
+	}
+	if second.ID == first.ID || second.StorageMode != models.StorageModeErasure || len(second.ParityChunks) == 0 {
+		t.Errorf("copy stored in mode %q with %d parity chunks, want erasure with parity", second.StorageMode, len(second.ParityChunks))
+	}
+
+	var got buffer
+	if _, err := c.Download(ctx, second.ID.Hex(), &got); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(got.data, data) {
+		t.Fatal("downloaded content differs from the upload")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	data := randomData(t, 200<<10)
+	metadata, err := c.Upload(ctx, "open.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	f, err := c.Open(ctx, metadata.ID.Hex())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if f.Size() != int64(len(data)) {
+		t.Fatalf("Size() = %d, want %d", f.Size(), len(data))
+	}
+
+	all, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Fatalf("ReadAll read %d bytes, err %v; content matches: %v", len(all), err, bytes.Equal(all, data))
+	}
+
+	for _, off := range []int64{100 << 10, 7, int64(len(data)) - 10} {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			t.Fatalf("Seek(%d): %v", off, err)
+		}
+		got := make([]byte, 10)
+		if _, err := io.ReadFull(f, got); err != nil {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+		if !bytes.Equal(got, data[off:off+10]) {
+			t.Errorf("read at %d returned the wrong bytes", off)
+		}
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end = %d, %v; want 0, EOF", n, err)
+	}
+
+	got := make([]byte, 64)
+	if n, err := f.ReadAt(got, 12345); n != len(got) || err != nil || !bytes.Equal(got, data[12345:12345+64]) {
+		t.Errorf("ReadAt = %d, %v", n, err)
+	}
+	n, err := f.ReadAt(got, int64(len(data))-20)
+	if n != 20 || err != io.EOF || !bytes.Equal(got[:n], data[len(data)-20:]) {
+		t.Errorf("ReadAt across the end = %d, %v; want 20, EOF", n, err)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+
+	want := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		metadata, err := c.Upload(ctx, fmt.Sprintf("page-%d.bin", i), bytes.NewReader(randomData(t, 1024)))
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		want[metadata.ID.Hex()] = true
+	}
+
+	seen := make(map[string]bool)
+	var last time.Time
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("listing does not end")
+		}
+		files, next, err := c.List(ctx, client.ListOptions{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(files) > 2 {
+			t.Fatalf("page has %d files, limit was 2", len(files))
+		}
+		for _, f := range files {
+			if seen[f.ID.Hex()] {
+				t.Fatalf("file %s listed twice", f.ID.Hex())
+			}
+			if !last.IsZero() && f.CreatedAt.After(last) {
+				t.Fatalf("file %s is out of order", f.ID.Hex())
+			}
+			seen[f.ID.Hex()], last = true, f.CreatedAt
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("file %s was not listed", id)
+		}
+	}
+
+	var apiErr *client.Error
+	if _, _, err := c.List(ctx, client.ListOptions{Cursor: "not-a-cursor"}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("List with a bad cursor: %v, want a 400 error", err)
+	}
+}
+
+func TestShare(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	data := randomData(t, 70<<10)
+	metadata, err := c.Upload(ctx, "shared.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	share, err := c.Share(ctx, metadata.ID.Hex(), time.Hour)
+	if err != nil {
+		t.Fatalf("Share: %v", err)
+	}
+	if share.ExpiresAt == nil || share.ExpiresAt.Before(time.Now()) {
+		t.Errorf("share expires at %v", share.ExpiresAt)
+	}
+
+	resp, err := http.Get(share.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+		t.Fatalf("GET %s = %s with %d bytes", share.URL, resp.Status, len(got))
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, share.URL, nil)
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(got, data[10:20]) {
+		t.Errorf("ranged GET of a share = %s with %d bytes", resp.Status, len(got))
+	}
+
+	if err := c.Unshare(ctx, share.Token); err != nil {
+		t.Fatalf("Unshare: %v", err)
+	}
+	resp, err = http.Get(share.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a revoked share = %s, want 404", resp.Status)
+	}
+	if err := c.Unshare(ctx, share.Token); !client.IsNotFound(err) {
+		t.Errorf("second Unshare: %v, want not found", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	metadata, err := c.Upload(ctx, "deleted.bin", bytes.NewReader(randomData(t, 10<<10)))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	jobID, err := c.DeleteFile(ctx, metadata.ID.Hex())
+	if err != nil || jobID == "" {
+		t.Fatalf("DeleteFile = %q, %v", jobID, err)
+	}
+	if _, err := c.Open(ctx, metadata.ID.Hex()); err == nil {
+		t.Error("Open of a deleted file succeeded")
+	}
+	gone := eventually(t, 10*time.Second, func() bool {
+		_, err := c.GetFile(ctx, metadata.ID.Hex())
+		return client.IsNotFound(err)
+	})
+	if !gone {
+		t.Error("deleted file is still there")
+	}
+	if _, err := c.GetFile(ctx, "0123456789abcdef01234567"); !client.IsNotFound(err) {
+		t.Errorf("GetFile of an unknown file: %v, want not found", err)
+	}
+}
+
+func TestRetriesTransientErrors(t *testing.T) {
+	c := newClient(t)
+
+	// Every other part upload fails as if the server were overloaded
+	var calls atomic.Int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/upload" && calls.Add(1)%2 == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		proxy(w, r)
+	}))
+	defer flaky.Close()
+	c.BaseURL = flaky.URL
+
+	data := randomData(t, 200<<10)
+	metadata, err := c.Upload(context.Background(), "flaky.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload through failing server: %v", err)
+	}
+	if metadata.Hash != sha256Hex(data) {
+		t.Errorf("stored hash %s", metadata.Hash)
+	}
+	if calls.Load() < 2*int64(len(metadata.Chunks)) {
+		t.Errorf("%d part requests for %d chunks; failures were not retried", calls.Load(), len(metadata.Chunks))
+	}
+}
+
+// proxy forwards r to the test server.
+func proxy(w http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequestWithContext(r.Context(), r.Method, apiServer.URL+r.URL.RequestURI(), r.Body)
+	req.Header = r.Header.Clone()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func TestContextCancellation(t *testing.T) {
+	c := newClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.Upload(ctx, "cancelled.bin", bytes.NewReader(randomData(t, 1024))); !errors.Is(err, context.Canceled) {
+		t.Errorf("Upload with a cancelled context: %v", err)
+	}
+	if _, _, err := c.List(ctx, client.ListOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("List with a cancelled context: %v", err)
+	}
+}
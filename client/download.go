@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"telegram-storage/models"
+)
+
+// GetOptions describe a download. The file is fetched in ChunkSize ranges,
+// numbered from 0, Concurrency at a time.
+type GetOptions struct {
+	// Skip reports ranges that are already written, e.g. by an interrupted
+	// download being resumed.
+	Skip func(part int) bool
+
+	// PartDone is called once a range has been written in full.
+	PartDone func(part int)
+
+	// Progress is called with the number of bytes written. A range that
+	// fails midway and is fetched again reports its bytes again after a
+	// negative correction.
+	Progress func(n int64)
+}
+
+// Parts returns how many ranges Get splits a file of size bytes into.
+func (c *Client) Parts(size int64) int {
+	return int((size + c.chunkSize() - 1) / c.chunkSize())
+}
+
+// Download writes a completed file into w and returns its record.
+func (c *Client) Download(ctx context.Context, fileID string, w io.WriterAt) (*models.FileMetadata, error) {
+	return c.Get(ctx, fileID, w, GetOptions{})
+}
+
+// Get downloads a completed file into w and returns its record. The written
+// content is not checked here; compare its Hash against the record's.
+func (c *Client) Get(ctx context.Context, fileID string, w io.WriterAt, opts GetOptions) (*models.FileMetadata, error) {
+	metadata, err := c.GetFile(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Status != "completed" {
+		return nil, fmt.Errorf("file %s is %s", fileID, metadata.Status)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for i := 0; i < c.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				offset := int64(part) * c.chunkSize()
+				length := min(c.chunkSize(), metadata.Size-offset)
+				if err := c.downloadRange(ctx, fileID, offset, length, w, opts.Progress); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("range %d-%d: %w", offset, offset+length-1, err))
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				if opts.PartDone != nil {
+					opts.PartDone(part)
+				}
+			}
+		}()
+	}
+
+	for part := 0; part < c.Parts(metadata.Size); part++ {
+		if opts.Skip != nil && opts.Skip(part) {
+			if opts.Progress != nil {
+				offset := int64(part) * c.chunkSize()
+				opts.Progress(min(c.chunkSize(), metadata.Size-offset))
+			}
+			continue
+		}
+		select {
+		case parts <- part:
+		case <-ctx.Done():
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// downloadRange writes length bytes of a file starting at offset to w at the
+// same offset.
+func (c *Client) downloadRange(ctx context.Context, fileID string, offset, length int64, w io.WriterAt, progress func(int64)) error {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	req := request{method: http.MethodGet, path: "/download/" + url.PathEscape(fileID), header: header}
+
+	return c.retry(ctx, func(int) error {
+		resp, err := c.sendOnce(ctx, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			return &permanentError{fmt.Errorf("server ignored the range request (%s)", resp.Status)}
+		}
+
+		dst := &progressWriter{w: io.NewOffsetWriter(w, offset), progress: progress}
+		_, err = io.CopyN(dst, resp.Body, length)
+		if err != nil {
+			if progress != nil {
+				progress(-dst.n)
+			}
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		return err
+	})
+}
+
+// progressWriter reports every write to progress.
+type progressWriter struct {
+	w        io.Writer
+	n        int64
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if err != nil {
+		return n, &permanentError{err}
+	}
+	p.n += int64(n)
+	if p.progress != nil {
+		p.progress(int64(n))
+	}
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"telegram-storage/models"
+)
+
+// File reads a stored file through range requests. Read streams from the
+// current offset and reopens the stream after a Seek or a broken connection;
+// ReadAt sends one request per call and may be used concurrently. File
+// implements io.ReadSeekCloser and io.ReaderAt.
+type File struct {
+	c        *Client
+	ctx      context.Context
+	metadata *models.FileMetadata
+	offset   int64
+
+	body       io.ReadCloser // open stream of the file from bodyOffset
+	bodyOffset int64
+}
+
+// Open returns a File reading a completed file. Its requests use ctx, so
+// cancelling it fails reads in progress and later ones.
+func (c *Client) Open(ctx context.Context, fileID string) (*File, error) {
+	metadata, err := c.GetFile(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Status != "completed" {
+		return nil, fmt.Errorf("file %s is %s", fileID, metadata.Status)
+	}
+	return &File{c: c, ctx: ctx, metadata: metadata}, nil
+}
+
+// Metadata returns the file's record as of Open.
+func (f *File) Metadata() *models.FileMetadata {
+	return f.metadata
+}
+
+// Size returns the file's length in bytes.
+func (f *File) Size() int64 {
+	return f.metadata.Size
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if f.offset >= f.Size() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.body != nil && f.bodyOffset != f.offset {
+		f.closeBody()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if f.body == nil {
+			body, err := f.openStream(f.offset)
+			if err != nil {
+				return 0, err
+			}
+			f.body, f.bodyOffset = body, f.offset
+		}
+
+		n, err := f.body.Read(p)
+		f.offset += int64(n)
+		f.bodyOffset = f.offset
+		if err != nil {
+			f.closeBody()
+		}
+		if n > 0 || err == nil {
+			return n, nil
+		}
+		if f.offset >= f.Size() {
+			return 0, io.EOF
+		}
+		// The stream broke before the end; pick up where it stopped
+		if attempt >= f.c.maxAttempts() || f.ctx.Err() != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+}
+
+// openStream requests the file from offset to its end.
+func (f *File) openStream(offset int64) (io.ReadCloser, error) {
+	resp, err := f.c.send(f.ctx, f.rangeRequest(fmt.Sprintf("bytes=%d-", offset)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server ignored the range request (%s)", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (f *File) rangeRequest(byteRange string) request {
+	return request{
+		method: http.MethodGet,
+		path:   "/download/" + url.PathEscape(f.metadata.ID.Hex()),
+		header: http.Header{"Range": {byteRange}},
+	}
+}
+
+// ReadAt reads len(p) bytes starting at off, or up to the end of the file
+// with io.EOF.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.Size() {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), f.Size()-off)
+	if want == 0 {
+		return 0, nil
+	}
+
+	var n int
+	req := f.rangeRequest(fmt.Sprintf("bytes=%d-%d", off, off+want-1))
+	err := f.c.retry(f.ctx, func(int) error {
+		resp, err := f.c.sendOnce(f.ctx, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			return &permanentError{fmt.Errorf("server ignored the range request (%s)", resp.Status)}
+		}
+		n, err = io.ReadFull(resp.Body, p[:want])
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	if want < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	// The open stream is kept until the next Read, which only reopens it if
+	// the offset actually moved
+	f.offset = offset
+	return offset, nil
+}
+
+// Close releases the open stream, if any.
+func (f *File) Close() error {
+	f.closeBody()
+	return nil
+}
+
+func (f *File) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+}
@@ -0,0 +1,259 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"telegram-storage/client"
+	"telegram-storage/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// These tests cover the client's own logic (retries, resuming streams,
+// paging) against a stand-in for the read side of the API, so they run
+// without TEST_MONGO_URL.
+
+// stubServer serves file records and content from memory. Failures are
+// injected by setting the counters.
+type stubServer struct {
+	files []models.FileMetadata // newest first
+	data  map[string][]byte
+
+	fail     atomic.Int64 // requests left to answer 503
+	truncate atomic.Int64 // downloads left to cut off halfway
+	requests atomic.Int64
+}
+
+func newStub(t *testing.T, files int, size int) (*stubServer, *client.Client) {
+	t.Helper()
+	s := &stubServer{data: make(map[string][]byte)}
+	created := time.Now()
+	for i := 0; i < files; i++ {
+		id := primitive.NewObjectID()
+		s.files = append(s.files, models.FileMetadata{
+			ID:        id,
+			Name:      fmt.Sprintf("stub-%d.bin", i),
+			Size:      int64(size),
+			Status:    "completed",
+			CreatedAt: created.Add(-time.Duration(i) * time.Minute),
+		})
+		s.data[id.Hex()] = randomData(t, size)
+	}
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	c := client.New(server.URL)
+	c.MaxAttempts = 3
+	c.RetryDelay = time.Millisecond
+	return s, c
+}
+
+func (s *stubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	if s.fail.Add(-1) >= 0 {
+		w.Header().Set("Retry-After", "0")
+		stubError(w, http.StatusServiceUnavailable, "upstream_unavailable", "try again")
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/files":
+		s.list(w, r)
+	case strings.HasPrefix(r.URL.Path, "/files/"):
+		for _, f := range s.files {
+			if f.ID.Hex() == strings.TrimPrefix(r.URL.Path, "/files/") {
+				json.NewEncoder(w).Encode(f)
+				return
+			}
+		}
+		stubError(w, http.StatusNotFound, "not_found", "file not found")
+	case strings.HasPrefix(r.URL.Path, "/download/"):
+		data, ok := s.data[strings.TrimPrefix(r.URL.Path, "/download/")]
+		if !ok {
+			stubError(w, http.StatusNotFound, "not_found", "file not found")
+			return
+		}
+		if s.truncate.Add(-1) >= 0 {
+			w = &cutWriter{ResponseWriter: w, left: len(data) / 2}
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// list pages through the files; the cursor is the index of the next one.
+func (s *stubServer) list(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	start := 0
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 || n > len(s.files) {
+			stubError(w, http.StatusBadRequest, "invalid_argument", "invalid cursor")
+			return
+		}
+		start = n
+	}
+	end := min(start+limit, len(s.files))
+	if end < len(s.files) {
+		w.Header().Set("X-Next-Cursor", strconv.Itoa(end))
+	}
+	json.NewEncoder(w).Encode(s.files[start:end])
+}
+
+func stubError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+}
+
+// cutWriter drops the connection once left bytes of the body are written.
+type cutWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		p = p[:w.left]
+	}
+	n, _ := w.ResponseWriter.Write(p)
+	w.left -= n
+	if w.left == 0 {
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	return n, nil
+}
+
+func TestStubRetries(t *testing.T) {
+	s, c := newStub(t, 1, 10)
+	ctx := context.Background()
+	id := s.files[0].ID.Hex()
+
+	s.fail.Store(2)
+	if _, err := c.GetFile(ctx, id); err != nil {
+		t.Fatalf("GetFile after two failures: %v", err)
+	}
+	if n := s.requests.Swap(0); n != 3 {
+		t.Errorf("%d requests, want 3", n)
+	}
+
+	s.fail.Store(10)
+	var apiErr *client.Error
+	if _, err := c.GetFile(ctx, id); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GetFile with the server down: %v, want a 503 error", err)
+	}
+	if n := s.requests.Swap(0); n != 3 {
+		t.Errorf("%d requests with MaxAttempts 3", n)
+	}
+	s.fail.Store(0)
+
+	if _, err := c.GetFile(ctx, primitive.NewObjectID().Hex()); !client.IsNotFound(err) {
+		t.Errorf("GetFile of a missing file: %v", err)
+	}
+	if n := s.requests.Swap(0); n != 1 {
+		t.Errorf("not found answer was retried: %d requests", n)
+	}
+}
+
+func TestStubOpenSeek(t *testing.T) {
+	s, c := newStub(t, 1, 100<<10)
+	ctx := context.Background()
+	id := s.files[0].ID.Hex()
+	data := s.data[id]
+
+	f, err := c.Open(ctx, id)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	// The first stream breaks halfway; Read picks up from where it stopped
+	s.truncate.Store(1)
+	s.requests.Store(0)
+	all, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Fatalf("ReadAll read %d bytes, err %v; content matches: %v", len(all), err, bytes.Equal(all, data))
+	}
+	if n := s.requests.Load(); n != 2 {
+		t.Errorf("%d download requests, want 2", n)
+	}
+
+	for _, off := range []int64{50 << 10, 3, int64(len(data)) - 10} {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			t.Fatalf("Seek(%d): %v", off, err)
+		}
+		got := make([]byte, 10)
+		if _, err := io.ReadFull(f, got); err != nil {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+		if !bytes.Equal(got, data[off:off+10]) {
+			t.Errorf("read at %d returned the wrong bytes", off)
+		}
+	}
+	if pos, err := f.Seek(-5, io.SeekEnd); err != nil || pos != int64(len(data))-5 {
+		t.Errorf("Seek from the end = %d, %v", pos, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+
+	s.fail.Store(1)
+	got := make([]byte, 64)
+	if n, err := f.ReadAt(got, 4321); n != len(got) || err != nil || !bytes.Equal(got, data[4321:4321+64]) {
+		t.Errorf("ReadAt after a failure = %d, %v", n, err)
+	}
+	n, err := f.ReadAt(got, int64(len(data))-20)
+	if n != 20 || err != io.EOF || !bytes.Equal(got[:n], data[len(data)-20:]) {
+		t.Errorf("ReadAt across the end = %d, %v; want 20, EOF", n, err)
+	}
+}
+
+func TestStubListPagination(t *testing.T) {
+	s, c := newStub(t, 7, 1)
+	ctx := context.Background()
+
+	var listed []string
+	pages := 0
+	cursor := ""
+	for {
+		files, next, err := c.List(ctx, client.ListOptions{Limit: 3, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		pages++
+		for _, f := range files {
+			listed = append(listed, f.ID.Hex())
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if pages != 3 || len(listed) != len(s.files) {
+		t.Fatalf("%d files in %d pages, want %d in 3", len(listed), pages, len(s.files))
+	}
+	for i, f := range s.files {
+		if listed[i] != f.ID.Hex() {
+			t.Errorf("file %d is %s, want %s", i, listed[i], f.ID.Hex())
+		}
+	}
+
+	var apiErr *client.Error
+	if _, _, err := c.List(ctx, client.ListOptions{Cursor: "not-a-cursor"}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("List with a bad cursor: %v, want a 400 error", err)
+	}
+}
@@ -0,0 +1,381 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"telegram-storage/models"
+)
+
+// PutOptions describe an upload. Only Name is required.
+type PutOptions struct {
+	Name     string
+	MimeType string // guessed from Name when empty
+	Hash     string // hex SHA-256 of the content; computed when empty
+
+	// Passed through to /init; empty values use the server defaults.
+	StorageMode  string
+	DataShards   int
+	ParityShards int
+	Chunking     string
+	Compression  string
+
+	// UploadID resumes a pending upload instead of starting a new one. Parts
+	// the server already has are skipped; the client's ChunkSize must match
+	// the one the upload was started with.
+	UploadID string
+
+	// OnStart is called with the upload ID before any part is sent, e.g. to
+	// remember it for resuming.
+	OnStart func(uploadID string)
+
+	// Progress is called with the number of bytes of each part the server
+	// has accepted, including parts skipped on resume.
+	Progress func(n int64)
+}
+
+// Hash returns the hex SHA-256 of everything read from r.
+func Hash(r io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Upload stores everything read from r as name. Readers that can also seek
+// and read at offsets, such as *os.File and *bytes.Reader, are uploaded from
+// their current position; others are first copied to a temporary file so
+// their size is known and parts can be resent.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) (*models.FileMetadata, error) {
+	section, cleanup, err := sectionOf(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return c.Put(ctx, section, section.Size(), PutOptions{Name: name})
+}
+
+// sectionOf returns the rest of r as a SectionReader, spooling it to a
+// temporary file that cleanup removes if r cannot be read at offsets.
+func sectionOf(r io.Reader) (section *io.SectionReader, cleanup func(), err error) {
+	if rs, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+		end, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		return io.NewSectionReader(rs, start, end-start), func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "tgstore-upload-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to buffer upload: %w", err)
+	}
+	return io.NewSectionReader(f, 0, size), cleanup, nil
+}
+
+// Put uploads size bytes read from r. If the server already stores identical
+// content, the upload is satisfied without sending the data.
+func (c *Client) Put(ctx context.Context, r io.ReaderAt, size int64, opts PutOptions) (*models.FileMetadata, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("upload needs a name")
+	}
+	if opts.MimeType == "" {
+		opts.MimeType = mime.TypeByExtension(path.Ext(opts.Name))
+	}
+	if opts.Hash == "" {
+		hash, err := Hash(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash file: %w", err)
+		}
+		opts.Hash = hash
+	}
+
+	var metadata *models.FileMetadata
+	var err error
+	if opts.UploadID != "" {
+		metadata, err = c.GetFile(ctx, opts.UploadID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resume upload: %w", err)
+		}
+		if metadata.Size != size || (metadata.Hash != "" && metadata.Hash != opts.Hash) {
+			return nil, fmt.Errorf("upload %s is for different content", opts.UploadID)
+		}
+	} else {
+		metadata, err = c.initUpload(ctx, r, size, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if metadata.Status == "completed" {
+		if opts.Progress != nil {
+			opts.Progress(size)
+		}
+		return metadata, nil
+	}
+
+	uploadID := metadata.ID.Hex()
+	if opts.OnStart != nil {
+		opts.OnStart(uploadID)
+	}
+
+	partSize := c.partSize(size)
+	if metadata.StorageMode == models.StorageModePacked {
+		// Packed files are sent as a single part
+		partSize = size
+	}
+	if err := c.uploadParts(ctx, uploadID, r, size, partSize, opts.Progress); err != nil {
+		return nil, err
+	}
+	if err := c.completeUpload(ctx, uploadID); err != nil {
+		return nil, err
+	}
+	return c.GetFile(ctx, uploadID)
+}
+
+type dedupChallenge struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Nonce  string `json:"nonce"`
+}
+
+// initUpload creates the upload, answering the server's proof-of-possession
+// challenge if it already holds the content.
+func (c *Client) initUpload(ctx context.Context, r io.ReaderAt, size int64, opts PutOptions) (*models.FileMetadata, error) {
+	req := map[string]interface{}{
+		"name":          opts.Name,
+		"size":          size,
+		"mime_type":     opts.MimeType,
+		"hash":          opts.Hash,
+		"storage_mode":  opts.StorageMode,
+		"data_shards":   opts.DataShards,
+		"parity_shards": opts.ParityShards,
+		"chunking":      opts.Chunking,
+		"compression":   opts.Compression,
+	}
+
+	for {
+		var raw json.RawMessage
+		if err := c.call(ctx, request{method: http.MethodPost, path: "/init", body: jsonBody(req)}, &raw); err != nil {
+			return nil, fmt.Errorf("failed to start upload: %w", err)
+		}
+
+		var answer struct {
+			Status    string          `json:"status"`
+			Challenge *dedupChallenge `json:"challenge"`
+		}
+		if err := json.Unmarshal(raw, &answer); err != nil {
+			return nil, fmt.Errorf("invalid response to /init: %w", err)
+		}
+		if answer.Status != "challenge" {
+			var metadata models.FileMetadata
+			if err := json.Unmarshal(raw, &metadata); err != nil {
+				return nil, fmt.Errorf("invalid response to /init: %w", err)
+			}
+			return &metadata, nil
+		}
+		if _, answered := req["challenge_id"]; answered || answer.Challenge == nil {
+			return nil, fmt.Errorf("server repeated its deduplication challenge")
+		}
+
+		proof, err := answerChallenge(r, answer.Challenge)
+		if err != nil {
+			return nil, err
+		}
+		req["challenge_id"] = answer.Challenge.ID
+		req["proof"] = proof
+	}
+}
+
+// answerChallenge returns SHA-256(nonce || content[offset:offset+length]).
+func answerChallenge(r io.ReaderAt, challenge *dedupChallenge) (string, error) {
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("invalid challenge nonce: %w", err)
+	}
+	hasher := sha256.New()
+	hasher.Write(nonce)
+	if _, err := io.Copy(hasher, io.NewSectionReader(r, challenge.Offset, challenge.Length)); err != nil {
+		return "", fmt.Errorf("failed to read challenge range: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// uploadParts sends every part the server does not have yet, Concurrency at
+// a time.
+func (c *Client) uploadParts(ctx context.Context, uploadID string, r io.ReaderAt, size, partSize int64, progress func(int64)) error {
+	status, err := c.GetUploadStatus(ctx, uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to get upload status: %w", err)
+	}
+
+	parts := int((size + partSize - 1) / partSize)
+	received := make(map[int]bool)
+	for _, p := range status.Received {
+		if p.Sequence >= parts || p.Size != min(partSize, size-int64(p.Sequence)*partSize) {
+			return fmt.Errorf("upload %s was started with a different chunk size", uploadID)
+		}
+		received[p.Sequence] = true
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sequences := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for i := 0; i < c.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range sequences {
+				offset := int64(seq) * partSize
+				n := min(partSize, size-offset)
+				if err := c.uploadPart(ctx, uploadID, seq, io.NewSectionReader(r, offset, n)); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("part %d: %w", seq, err))
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				if progress != nil {
+					progress(n)
+				}
+			}
+		}()
+	}
+
+	for seq := 0; seq < parts; seq++ {
+		if received[seq] {
+			if progress != nil {
+				progress(min(partSize, size-int64(seq)*partSize))
+			}
+			continue
+		}
+		select {
+		case sequences <- seq:
+		case <-ctx.Done():
+		}
+	}
+	close(sequences)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return ctx.Err()
+}
+
+func (c *Client) uploadPart(ctx context.Context, uploadID string, sequence int, data *io.SectionReader) error {
+	body := func() (io.Reader, string, error) {
+		pr, pw := io.Pipe()
+		form := multipart.NewWriter(pw)
+		go func() {
+			form.WriteField("upload_id", uploadID)
+			form.WriteField("sequence", strconv.Itoa(sequence))
+			part, err := form.CreateFormFile("file", fmt.Sprintf("chunk_%d", sequence))
+			if err == nil {
+				_, err = io.Copy(part, io.NewSectionReader(data, 0, data.Size()))
+			}
+			if err == nil {
+				err = form.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, form.FormDataContentType(), nil
+	}
+	return c.call(ctx, request{method: http.MethodPost, path: "/upload", body: body}, nil)
+}
+
+// completeUpload finishes an upload. Completing does real work on the
+// server, so before trying again it checks whether a failed attempt went
+// through after all. Content-defined uploads are accepted and finished in
+// the background; it then waits for them to complete.
+func (c *Client) completeUpload(ctx context.Context, uploadID string) error {
+	req := request{method: http.MethodPost, path: "/complete", body: jsonBody(map[string]string{"upload_id": uploadID})}
+	accepted := false
+	err := c.retry(ctx, func(attempt int) error {
+		if attempt > 1 {
+			if status, err := c.GetUploadStatus(ctx, uploadID); err == nil && status.Status == "completed" {
+				accepted = false
+				return nil
+			}
+		}
+		resp, err := c.sendOnce(ctx, req)
+		if err != nil {
+			return err
+		}
+		accepted = resp.StatusCode == http.StatusAccepted
+		return resp.Body.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete upload: %w", err)
+	}
+	if accepted {
+		return c.waitProcessed(ctx, uploadID)
+	}
+	return nil
+}
+
+// processingPollInterval is how often waitProcessed asks for the status of
+// an upload the server is still processing.
+const processingPollInterval = 2 * time.Second
+
+// waitProcessed waits until the server has finished processing a completed
+// upload.
+func (c *Client) waitProcessed(ctx context.Context, uploadID string) error {
+	for {
+		status, err := c.GetUploadStatus(ctx, uploadID)
+		if err != nil {
+			return fmt.Errorf("failed to check upload %s: %w", uploadID, err)
+		}
+		switch {
+		case status.Status == "completed":
+			return nil
+		case status.Error != "":
+			return fmt.Errorf("server failed to process upload %s: %s", uploadID, status.Error)
+		case status.Status != "processing" && status.Status != "pending":
+			// A failed upload goes back to pending just before its error is recorded
+			return fmt.Errorf("upload %s is %s", uploadID, status.Status)
+		}
+		select {
+		case <-time.After(processingPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
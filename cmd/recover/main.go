@@ -0,0 +1,70 @@
+// Command recover rebuilds the files collection from the manifests and chunk
+// captions stored in the Telegram group.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+	"telegram-storage/bot"
+	"telegram-storage/configs"
+	"telegram-storage/logging"
+	"telegram-storage/services"
+)
+
+func main() {
+	flags := configs.RegisterFlags(flag.CommandLine)
+	scratchChat := flag.Int64("scratch-chat", 0, "chat that messages are forwarded into during the caption scan")
+	scanFrom := flag.Int("scan-from", 1, "first message ID to scan")
+	scanTo := flag.Int("scan-to", 0, "last message ID to scan (0 disables the caption scan)")
+	scanRate := flag.Float64("scan-rate", 1, "messages forwarded per second during the scan")
+	overwrite := flag.Bool("overwrite", false, "replace file records that already exist")
+	dryRun := flag.Bool("dry-run", false, "report what would be restored without writing")
+	flag.Parse()
+
+	logging.Setup(logging.DefaultConfig())
+	cfg, err := flags.Load()
+	if err != nil {
+		logging.Fatal("Failed to load configuration", "error", err)
+	}
+	logging.Setup(cfg.Log)
+
+	ctx := context.Background()
+	client := configs.ConnectDB(ctx, cfg.Mongo)
+	defer client.Disconnect(ctx)
+	db := client.Database(cfg.Mongo.Database)
+
+	botPool, err := bot.NewBotPool(cfg.Telegram.BotTokens)
+	if err != nil {
+		logging.Fatal("Failed to initialize bot pool", "error", err)
+	}
+	if len(botPool.GetAllBots()) == 0 {
+		logging.Fatal("No bots configured")
+	}
+
+	if !*dryRun {
+		if err := configs.SetupIndexes(db); err != nil {
+			slog.Warn("Failed to set up indexes, continuing anyway", "error", err)
+		}
+	}
+
+	service := services.NewFileService(botPool, db, cfg.Storage)
+	result, err := service.RecoverFromTelegram(ctx, services.RecoveryOptions{
+		GroupID:       cfg.Telegram.GroupID,
+		ScratchChatID: *scratchChat,
+		ScanFrom:      *scanFrom,
+		ScanTo:        *scanTo,
+		ScanRate:      *scanRate,
+		Overwrite:     *overwrite,
+		DryRun:        *dryRun,
+	})
+	if result != nil {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		os.Stdout.Write(append(out, '\n'))
+	}
+	if err != nil {
+		logging.Fatal("Recovery failed", "error", err)
+	}
+}
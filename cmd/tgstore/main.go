@@ -0,0 +1,359 @@
+// Command tgstore uploads, downloads and lists files on a telegram-storage
+// server, mirrors local directories to it and mounts it as a filesystem.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"telegram-storage/client"
+	"telegram-storage/models"
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands = []command{
+	{"put", "[-name name] <path>", "upload a file, resuming an interrupted upload of it", putCommand},
+	{"get", "[-o path] <file-id>", "download a file, resuming an interrupted download, and check its hash", getCommand},
+	{"ls", "[prefix]", "list files", lsCommand},
+	{"rm", "<file-id>...", "delete files", rmCommand},
+	{"sync", "[-prefix p] [-delete] [-dry-run] <dir>", "upload new and changed files of a directory", syncCommand},
+	{"mount", "[-cache-dir d] [-cache-size MiB] [-readahead n] <dir>", "show the files as a directory tree at dir until interrupted (Linux)", mountCommand},
+}
+
+// jsonOutput selects one JSON document per result on stdout.
+var jsonOutput bool
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: tgstore [flags] <command> [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	server := os.Getenv("TGSTORE_SERVER")
+	if server == "" {
+		server = "http://localhost:80"
+	}
+	flag.StringVar(&server, "server", server, "server URL (TGSTORE_SERVER)")
+	concurrency := flag.Int("concurrency", client.DefaultConcurrency, "parts transferred at once")
+	chunkMiB := flag.Int64("chunk-size", client.DefaultChunkSize>>20, "MiB per uploaded part and downloaded range")
+	quiet := flag.Bool("quiet", false, "do not show progress")
+	flag.BoolVar(&jsonOutput, "json", false, "print results as JSON, one document per line")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "tgstore: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	showProgress = !*quiet && !jsonOutput && stderrIsTerminal()
+
+	c := client.New(server)
+	c.Concurrency = *concurrency
+	c.ChunkSize = *chunkMiB << 20
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := cmd.run(ctx, c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "tgstore: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses a command's flags and checks it got between lo and hi
+// positional arguments; hi < 0 means no upper limit.
+func parseArgs(flags *flag.FlagSet, args []string, lo, hi int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() < lo || (hi >= 0 && flags.NArg() > hi) {
+		return nil, fmt.Errorf("%s: wrong number of arguments", flags.Name())
+	}
+	return flags.Args(), nil
+}
+
+// fileSummary is a file as printed by -json.
+type fileSummary struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	MimeType  string    `json:"mime_type,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Path      string    `json:"path,omitempty"`   // local path, for put and get
+	Action    string    `json:"action,omitempty"` // for sync
+	JobID     string    `json:"job_id,omitempty"` // for rm and sync deletes
+}
+
+func summarize(m *models.FileMetadata) fileSummary {
+	return fileSummary{ID: m.ID.Hex(), Name: m.Name, Size: m.Size, MimeType: m.MimeType, Hash: m.Hash, CreatedAt: m.CreatedAt}
+}
+
+func printJSON(v interface{}) {
+	json.NewEncoder(os.Stdout).Encode(v)
+}
+
+func putCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	name := flags.String("name", "", "name to store the file under (default the file's base name)")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		*name = filepath.Base(args[0])
+	}
+
+	metadata, err := putFile(ctx, c, args[0], *name, "")
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		summary := summarize(metadata)
+		summary.Path = args[0]
+		printJSON(summary)
+		return nil
+	}
+	fmt.Printf("%s  %s\n", metadata.ID.Hex(), metadata.Name)
+	return nil
+}
+
+func getCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	output := flags.String("o", "", "where to write the file (default its name in the current directory)")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	dest := *output
+	if dest == "" {
+		metadata, err := c.GetFile(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		dest = path.Base(metadata.Name)
+	}
+	metadata, err := getFile(ctx, c, args[0], dest)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		summary := summarize(metadata)
+		summary.Path = dest
+		printJSON(summary)
+		return nil
+	}
+	fmt.Printf("%s  %s\n", metadata.ID.Hex(), dest)
+	return nil
+}
+
+func lsCommand(ctx context.Context, c *client.Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("ls", flag.ExitOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	files, err := c.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !jsonOutput {
+		fmt.Fprintln(w, "ID\tSIZE\tCREATED\tNAME")
+	}
+	for i := range files {
+		f := &files[i]
+		if len(args) > 0 && !strings.HasPrefix(f.Name, args[0]) {
+			continue
+		}
+		if jsonOutput {
+			printJSON(summarize(f))
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.ID.Hex(), formatBytes(f.Size), f.CreatedAt.Local().Format(time.DateTime), f.Name)
+	}
+	return w.Flush()
+}
+
+func rmCommand(ctx context.Context, c *client.Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("rm", flag.ExitOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, fileID := range args {
+		jobID, err := c.DeleteFile(ctx, fileID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", fileID, err))
+			continue
+		}
+		if jsonOutput {
+			printJSON(fileSummary{ID: fileID, Action: "delete", JobID: jobID})
+		} else {
+			fmt.Printf("%s  deleting\n", fileID)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncCommand uploads every regular file under dir that the server does not
+// hold under the same name with the same content, storing it as its
+// slash-separated path relative to dir, below -prefix. Replaced versions are
+// deleted once the new one is stored; with -delete so are remote files below
+// the prefix that no longer exist locally.
+func syncCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "store files below this name prefix, e.g. backups/laptop")
+	deleteMissing := flags.Bool("delete", false, "delete remote files below the prefix that do not exist locally")
+	dryRun := flags.Bool("dry-run", false, "print what would be done without doing it")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	dir := args[0]
+	namePrefix := strings.Trim(*prefix, "/")
+	if namePrefix != "" {
+		namePrefix += "/"
+	}
+
+	files, err := c.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+	remote := make(map[string][]*models.FileMetadata)
+	for i := range files {
+		if strings.HasPrefix(files[i].Name, namePrefix) {
+			remote[files[i].Name] = append(remote[files[i].Name], &files[i])
+		}
+	}
+
+	report := func(action, name string, m *models.FileMetadata, jobID string) {
+		if jsonOutput {
+			summary := fileSummary{Name: name, Action: action, JobID: jobID}
+			if m != nil {
+				summary = summarize(m)
+				summary.Action, summary.JobID = action, jobID
+			}
+			printJSON(summary)
+			return
+		}
+		fmt.Printf("%-7s %s\n", action, name)
+	}
+	remove := func(m *models.FileMetadata) error {
+		if *dryRun {
+			report("delete", m.Name, m, "")
+			return nil
+		}
+		jobID, err := c.DeleteFile(ctx, m.ID.Hex())
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+		report("delete", m.Name, m, jobID)
+		return nil
+	}
+
+	var errs []error
+	local := make(map[string]bool)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := namePrefix + filepath.ToSlash(rel)
+		local[name] = true
+
+		hash, err := hashFile(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			return nil
+		}
+		for _, m := range remote[name] {
+			if m.Hash == hash {
+				report("skip", name, m, "")
+				return nil
+			}
+		}
+
+		if *dryRun {
+			report("upload", name, nil, "")
+		} else {
+			metadata, err := putFile(ctx, c, p, name, hash)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", p, err))
+				return nil
+			}
+			report("upload", name, metadata, "")
+		}
+		for _, m := range remote[name] {
+			if err := remove(m); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *deleteMissing && len(errs) == 0 {
+		for name, versions := range remote {
+			if local[name] {
+				continue
+			}
+			for _, m := range versions {
+				if err := remove(m); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return client.Hash(f)
+}
@@ -0,0 +1,460 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"telegram-storage/client"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// mountCommand mounts the server's files at a directory until interrupted.
+func mountCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	cacheDir := flags.String("cache-dir", "", "where fetched blocks and files being written are kept (default in the user cache directory)")
+	cacheMiB := flags.Int64("cache-size", 1024, "MiB of fetched blocks to keep")
+	blockMiB := flags.Int64("block-size", 4, "MiB fetched per range request")
+	readAhead := flags.Int("readahead", 8, "blocks fetched ahead of sequential reads")
+	refresh := flags.Duration("refresh", 30*time.Second, "how long the file list is used before it is fetched again")
+	allowOther := flags.Bool("allow-other", false, "let other users access the mount")
+	debug := flags.Bool("debug", false, "log every FUSE request")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *blockMiB <= 0 || *cacheMiB <= 0 || *readAhead < 0 {
+		return fmt.Errorf("mount: -block-size and -cache-size must be positive and -readahead not negative")
+	}
+
+	if *cacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		*cacheDir = filepath.Join(dir, "tgstore", "mount")
+	}
+	cache, err := newReadCache(filepath.Join(*cacheDir, "blocks"), *blockMiB<<20, *cacheMiB<<20, *readAhead)
+	if err != nil {
+		return err
+	}
+	spoolDir := filepath.Join(*cacheDir, "spool")
+	if err := os.RemoveAll(spoolDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+		return err
+	}
+
+	m := &mount{
+		ctx:       ctx,
+		c:         c,
+		tree:      newMountTree(c, *refresh),
+		cache:     cache,
+		spoolDir:  spoolDir,
+		readAhead: *readAhead,
+	}
+	if err := m.tree.load(ctx); err != nil {
+		return err
+	}
+
+	timeout := time.Second
+	server, err := fs.Mount(args[0], &dirNode{m: m}, &fs.Options{
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: &timeout,
+		UID:             uint32(os.Getuid()),
+		GID:             uint32(os.Getgid()),
+		MountOptions: fuse.MountOptions{
+			FsName:      c.BaseURL,
+			Name:        "tgstore",
+			AllowOther:  *allowOther,
+			Debug:       *debug,
+			DirectMount: true,
+			MaxWrite:    1 << 20,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %w", args[0], err)
+	}
+	fmt.Fprintf(os.Stderr, "tgstore: mounted %s at %s; interrupt to unmount\n", c.BaseURL, args[0])
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Unmount(); err != nil {
+			fmt.Fprintf(os.Stderr, "tgstore: failed to unmount, unmount %s by hand: %v\n", args[0], err)
+		}
+	}()
+	server.Wait()
+	return nil
+}
+
+// inodeNumber derives a stable inode number from a path and its type.
+func inodeNumber(p string, isDir bool) uint64 {
+	h := fnv.New64a()
+	if isDir {
+		h.Write([]byte("d/"))
+	} else {
+		h.Write([]byte("f/"))
+	}
+	h.Write([]byte(p))
+	// 1 is the root's
+	return max(h.Sum64(), 2)
+}
+
+// errno maps a failed operation to the error returned to the kernel, logging
+// what the caller cannot see.
+func errno(op, p string, err error) syscall.Errno {
+	switch {
+	case client.IsNotFound(err):
+		return syscall.ENOENT
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	}
+	fmt.Fprintf(os.Stderr, "tgstore: %s %s: %v\n", op, p, err)
+	return syscall.EIO
+}
+
+// dirNode is a directory of the mount. Directories hold no state: their
+// content is whatever the tree has below their path.
+type dirNode struct {
+	fs.Inode
+	m    *mount
+	path string
+}
+
+var (
+	_ fs.NodeGetattrer = (*dirNode)(nil)
+	_ fs.NodeLookuper  = (*dirNode)(nil)
+	_ fs.NodeReaddirer = (*dirNode)(nil)
+	_ fs.NodeMkdirer   = (*dirNode)(nil)
+	_ fs.NodeRmdirer   = (*dirNode)(nil)
+	_ fs.NodeCreater   = (*dirNode)(nil)
+	_ fs.NodeUnlinker  = (*dirNode)(nil)
+	_ fs.NodeRenamer   = (*dirNode)(nil)
+)
+
+func (d *dirNode) child(name string) string {
+	return path.Join(d.path, name)
+}
+
+func (d *dirNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0o755
+	out.Nlink = 2
+	return 0
+}
+
+func (d *dirNode) newDir(ctx context.Context, p string, out *fuse.EntryOut) *fs.Inode {
+	out.Mode = fuse.S_IFDIR | 0o755
+	out.Nlink = 2
+	return d.NewInode(ctx, &dirNode{m: d.m, path: p}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: inodeNumber(p, true)})
+}
+
+func (d *dirNode) newFile(ctx context.Context, p string, f *mountFile, out *fuse.EntryOut) *fs.Inode {
+	node := &fileNode{m: d.m, path: p}
+	node.fill(f, &out.Attr)
+	return d.NewInode(ctx, node, fs.StableAttr{Mode: fuse.S_IFREG, Ino: inodeNumber(p, false)})
+}
+
+func (d *dirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if err := d.m.tree.load(ctx); err != nil {
+		return nil, errno("list", d.path, err)
+	}
+	p := d.child(name)
+	f, isDir := d.m.tree.lookup(p)
+	switch {
+	case isDir:
+		return d.newDir(ctx, p, out), 0
+	case f != nil:
+		return d.newFile(ctx, p, f, out), 0
+	}
+	return nil, syscall.ENOENT
+}
+
+func (d *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if err := d.m.tree.load(ctx); err != nil {
+		return nil, errno("list", d.path, err)
+	}
+	var entries []fuse.DirEntry
+	for _, e := range d.m.tree.list(d.path) {
+		entry := fuse.DirEntry{Name: e.name, Mode: fuse.S_IFREG, Ino: inodeNumber(d.child(e.name), e.isDir)}
+		if e.isDir {
+			entry.Mode = fuse.S_IFDIR
+		}
+		entries = append(entries, entry)
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Mkdir makes a directory that exists in this mount only, until files are
+// stored below it.
+func (d *dirNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p := d.child(name)
+	if f, isDir := d.m.tree.lookup(p); f != nil || isDir {
+		return nil, syscall.EEXIST
+	}
+	d.m.tree.mkdir(p)
+	return d.newDir(ctx, p, out), 0
+}
+
+func (d *dirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	p := d.child(name)
+	f, isDir := d.m.tree.lookup(p)
+	switch {
+	case f != nil:
+		return syscall.ENOTDIR
+	case !isDir:
+		return syscall.ENOENT
+	case !d.m.tree.rmdir(p):
+		return syscall.ENOTEMPTY
+	}
+	return 0
+}
+
+func (d *dirNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	p := d.child(name)
+	f, isDir := d.m.tree.lookup(p)
+	if isDir {
+		return nil, nil, 0, syscall.EISDIR
+	}
+	if f == nil {
+		f = d.m.tree.add(p)
+	}
+	st, err := d.m.stage(ctx, p, f, true)
+	if err != nil {
+		return nil, nil, 0, errno("create", p, err)
+	}
+	h := &fileHandle{m: d.m, path: p, f: f, st: st, writable: true}
+	return d.newFile(ctx, p, f, out), h, 0, 0
+}
+
+// Unlink deletes every stored version of a file.
+func (d *dirNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	p := d.child(name)
+	f, _ := d.m.tree.lookup(p)
+	if f == nil {
+		return syscall.ENOENT
+	}
+	if err := d.m.remove(ctx, p, f); err != nil {
+		return errno("delete", p, err)
+	}
+	return 0
+}
+
+// Rename is not supported by the server. EXDEV makes mv fall back to copying
+// and deleting.
+func (d *dirNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return syscall.EXDEV
+}
+
+// fileNode is a file of the mount, found by its path in the tree on every
+// call since uploads and refreshes replace the tree's entries.
+type fileNode struct {
+	fs.Inode
+	m    *mount
+	path string
+}
+
+var (
+	_ fs.NodeGetattrer  = (*fileNode)(nil)
+	_ fs.NodeSetattrer  = (*fileNode)(nil)
+	_ fs.NodeOpener     = (*fileNode)(nil)
+	_ fs.NodeSetxattrer = (*fileNode)(nil)
+)
+
+func (n *fileNode) fill(f *mountFile, out *fuse.Attr) {
+	n.m.tree.mu.Lock()
+	var size int64
+	if f.meta != nil {
+		size = f.meta.Size
+	}
+	st, created := f.staging, f.created
+	n.m.tree.mu.Unlock()
+	if st != nil {
+		size = st.Size()
+	}
+
+	out.Mode = fuse.S_IFREG | 0o644
+	out.Nlink = 1
+	out.Size = uint64(size)
+	out.Blocks = (uint64(size) + 511) / 512
+	out.SetTimes(nil, &created, &created)
+}
+
+func (n *fileNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f, _ := n.m.tree.lookup(n.path)
+	if f == nil {
+		return syscall.ENOENT
+	}
+	n.fill(f, &out.Attr)
+	return 0
+}
+
+// Setattr handles truncation, which writes a new version of the file. Other
+// attributes are fixed and changes to them are ignored.
+func (n *fileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f, _ := n.m.tree.lookup(n.path)
+	if f == nil {
+		return syscall.ENOENT
+	}
+	if size, ok := in.GetSize(); ok {
+		if h, ok := fh.(*fileHandle); ok && h.writable {
+			if err := h.st.Truncate(int64(size)); err != nil {
+				return errno("truncate", n.path, err)
+			}
+		} else {
+			st, err := n.m.stage(ctx, n.path, f, size == 0)
+			if err != nil {
+				return errno("truncate", n.path, err)
+			}
+			err = st.Truncate(int64(size))
+			if err == nil {
+				err = n.m.commit(n.path, f, st)
+			}
+			n.m.release(n.path, f, st)
+			if err != nil {
+				return errno("truncate", n.path, err)
+			}
+		}
+	}
+	n.fill(f, &out.Attr)
+	return 0
+}
+
+// Setxattr reports extended attributes as unsupported, which cp and mv
+// expect when they cannot preserve them.
+func (n *fileNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+// Open reads a stored file through the read cache, or a file being written
+// from its staging copy. Opening for writing stages the file.
+func (n *fileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	f, _ := n.m.tree.lookup(n.path)
+	if f == nil {
+		return nil, 0, syscall.ENOENT
+	}
+	h := &fileHandle{m: n.m, path: n.path, f: f}
+
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		st, err := n.m.stage(ctx, n.path, f, flags&syscall.O_TRUNC != 0)
+		if err != nil {
+			return nil, 0, errno("open", n.path, err)
+		}
+		h.st, h.writable = st, true
+		return h, 0, 0
+	}
+
+	n.m.tree.mu.Lock()
+	st, meta := f.staging, f.meta
+	if st != nil {
+		st.opens++
+	}
+	n.m.tree.mu.Unlock()
+	switch {
+	case st != nil:
+		h.st = st
+	case meta != nil:
+		file, err := n.m.c.Open(n.m.ctx, meta.ID.Hex())
+		if err != nil {
+			return nil, 0, errno("open", n.path, err)
+		}
+		h.file = file
+	}
+	return h, 0, 0
+}
+
+// fileHandle is an open file. It reads from and writes to the staging copy
+// when there is one, and otherwise reads the stored file through the cache,
+// fetching ahead while reads are sequential. A handle with neither is an
+// empty file.
+type fileHandle struct {
+	m        *mount
+	path     string
+	f        *mountFile
+	st       *staging
+	file     *client.File
+	writable bool
+
+	mu   sync.Mutex
+	next int64 // where the next sequential read starts
+}
+
+var (
+	_ fs.FileReader   = (*fileHandle)(nil)
+	_ fs.FileWriter   = (*fileHandle)(nil)
+	_ fs.FileFlusher  = (*fileHandle)(nil)
+	_ fs.FileFsyncer  = (*fileHandle)(nil)
+	_ fs.FileReleaser = (*fileHandle)(nil)
+)
+
+func (h *fileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	var n int
+	var err error
+	switch {
+	case h.st != nil:
+		n, err = h.st.ReadAt(dest, off)
+	case h.file != nil:
+		h.mu.Lock()
+		sequential := off == h.next
+		h.mu.Unlock()
+		n, err = h.m.cache.ReadAt(ctx, h.file, dest, off)
+		h.mu.Lock()
+		h.next = off + int64(n)
+		h.mu.Unlock()
+		if sequential && h.m.readAhead > 0 {
+			h.m.cache.Prefetch(h.file, off, h.m.readAhead)
+		}
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, errno("read", h.path, err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *fileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if !h.writable {
+		return 0, syscall.EBADF
+	}
+	n, err := h.st.WriteAt(data, off)
+	if err != nil {
+		return uint32(n), errno("write", h.path, err)
+	}
+	return uint32(n), 0
+}
+
+// Flush runs on every close of the file. Changes are uploaded then, so that
+// the program closing it learns whether they were stored.
+func (h *fileHandle) Flush(ctx context.Context) syscall.Errno {
+	if !h.writable {
+		return 0
+	}
+	if err := h.m.commit(h.path, h.f, h.st); err != nil {
+		return errno("upload", h.path, err)
+	}
+	return 0
+}
+
+func (h *fileHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return h.Flush(ctx)
+}
+
+func (h *fileHandle) Release(ctx context.Context) syscall.Errno {
+	if h.st != nil {
+		h.m.release(h.path, h.f, h.st)
+	}
+	return 0
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"telegram-storage/client"
+)
+
+func mountCommand(ctx context.Context, c *client.Client, args []string) error {
+	return fmt.Errorf("mount is only supported on Linux")
+}
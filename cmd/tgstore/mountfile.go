@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"telegram-storage/client"
+)
+
+// mount is the state of a mounted server shared by every node.
+type mount struct {
+	ctx       context.Context // for uploads and fetches, which outlive a request
+	c         *client.Client
+	tree      *mountTree
+	cache     *readCache
+	spoolDir  string
+	readAhead int // blocks fetched ahead of sequential reads
+}
+
+// staging is the local copy of a file open for writing, shared by all its
+// handles. A writer closing the file uploads it as a new version, replacing
+// the versions stored before.
+type staging struct {
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	dirty bool // changed since the last upload
+	opens int  // handles using it; guarded by the tree's mutex
+}
+
+func (st *staging) ReadAt(p []byte, off int64) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if off >= st.size {
+		return 0, io.EOF
+	}
+	n, err := st.file.ReadAt(p[:min(int64(len(p)), st.size-off)], off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (st *staging) WriteAt(p []byte, off int64) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n, err := st.file.WriteAt(p, off)
+	st.size = max(st.size, off+int64(n))
+	st.dirty = true
+	return n, err
+}
+
+func (st *staging) Truncate(size int64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.file.Truncate(size); err != nil {
+		return err
+	}
+	st.size = size
+	st.dirty = true
+	return nil
+}
+
+func (st *staging) Size() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.size
+}
+
+// stage returns the staging copy of the file at p for a new writer. Unless
+// truncate is set, a new copy starts with the stored content.
+func (m *mount) stage(ctx context.Context, p string, f *mountFile, truncate bool) (*staging, error) {
+	m.tree.mu.Lock()
+	if st := f.staging; st != nil {
+		st.opens++
+		m.tree.mu.Unlock()
+		if truncate {
+			if err := st.Truncate(0); err != nil {
+				m.release(p, f, st)
+				return nil, err
+			}
+		}
+		return st, nil
+	}
+	meta := f.meta
+	m.tree.mu.Unlock()
+
+	file, err := os.CreateTemp(m.spoolDir, "stage-*")
+	if err != nil {
+		return nil, err
+	}
+	st := &staging{file: file, opens: 1, dirty: truncate && meta != nil}
+	if meta != nil && !truncate {
+		if _, err := m.c.Download(ctx, meta.ID.Hex(), file); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, fmt.Errorf("failed to fetch %s for writing: %w", p, err)
+		}
+		st.size = meta.Size
+	}
+
+	m.tree.mu.Lock()
+	defer m.tree.mu.Unlock()
+	if existing := f.staging; existing != nil || f.removed {
+		if existing == nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, fmt.Errorf("%s was deleted", p)
+		}
+		// Another writer opened the file meanwhile; share its copy
+		existing.opens++
+		file.Close()
+		os.Remove(file.Name())
+		return existing, nil
+	}
+	f.staging = st
+	return st, nil
+}
+
+// commit uploads the staging copy of the file at p if it changed, then
+// deletes the versions it replaces. Empty files are not stored; they stay in
+// the mount only.
+func (m *mount) commit(p string, f *mountFile, st *staging) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m.tree.mu.Lock()
+	removed := f.removed
+	m.tree.mu.Unlock()
+	if !st.dirty || removed {
+		return nil
+	}
+
+	m.tree.mu.Lock()
+	var replaced []string
+	if f.meta != nil {
+		replaced = append(replaced, f.meta.ID.Hex())
+	}
+	replaced = append(replaced, f.older...)
+	m.tree.mu.Unlock()
+
+	var uploadedID string
+	if st.size > 0 {
+		uploaded, err := m.c.Put(m.ctx, st.file, st.size, client.PutOptions{Name: p})
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", p, err)
+		}
+		uploadedID = uploaded.ID.Hex()
+		m.tree.mu.Lock()
+		f.meta, f.older, f.created = uploaded, nil, uploaded.CreatedAt
+		m.tree.mu.Unlock()
+	} else {
+		m.tree.mu.Lock()
+		f.meta, f.older = nil, nil
+		m.tree.mu.Unlock()
+	}
+	st.dirty = false
+
+	for _, id := range replaced {
+		if id == uploadedID {
+			continue
+		}
+		if _, err := m.c.DeleteFile(m.ctx, id); err != nil && !client.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "tgstore: failed to delete the replaced version %s of %s: %v\n", id, p, err)
+		}
+	}
+	return nil
+}
+
+// release drops a handle's use of a staging copy and removes the copy once
+// nothing uses it.
+func (m *mount) release(p string, f *mountFile, st *staging) {
+	m.tree.mu.Lock()
+	st.opens--
+	last := st.opens == 0
+	if last && f.staging == st {
+		f.staging = nil
+	}
+	removed, stored := f.removed, f.meta != nil
+	m.tree.mu.Unlock()
+	if !last {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.dirty && !removed {
+		fmt.Fprintf(os.Stderr, "tgstore: changes to %s were not uploaded\n", p)
+		if !stored {
+			m.tree.remove(p, f)
+		}
+	}
+	st.file.Close()
+	os.Remove(st.file.Name())
+}
+
+// remove deletes the file at p and every stored version of it.
+func (m *mount) remove(ctx context.Context, p string, f *mountFile) error {
+	m.tree.mu.Lock()
+	var ids []string
+	if f.meta != nil {
+		ids = append(ids, f.meta.ID.Hex())
+	}
+	ids = append(ids, f.older...)
+	m.tree.mu.Unlock()
+
+	for _, id := range ids {
+		if _, err := m.c.DeleteFile(ctx, id); err != nil && !client.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", p, err)
+		}
+	}
+	m.tree.mu.Lock()
+	f.removed = true
+	m.tree.mu.Unlock()
+	m.tree.remove(p, f)
+	return nil
+}
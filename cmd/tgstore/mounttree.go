@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"telegram-storage/client"
+	"telegram-storage/models"
+)
+
+// mountTree is the directory view of the server's files that a mount shows.
+// File names are split at slashes into directories; when several files
+// share a name the newest is shown and the others are its older versions.
+// Files created in the mount that the server does not have yet, and
+// directories made with mkdir, live only in the tree until they get content.
+type mountTree struct {
+	c       *client.Client
+	refresh time.Duration
+
+	mu        sync.Mutex
+	files     map[string]*mountFile // by path, without a leading slash
+	dirs      map[string]bool       // every directory, "" being the root
+	localDirs map[string]bool       // made with mkdir
+	loaded    time.Time
+	loading   chan struct{} // closed when the listing in progress ends
+}
+
+// mountFile is a file in the tree.
+type mountFile struct {
+	meta    *models.FileMetadata // nil while it only exists in the mount
+	older   []string             // IDs of older files with the same name
+	staging *staging             // set while the file is open for writing
+	created time.Time
+	removed bool // unlinked; pending writes are dropped
+}
+
+func newMountTree(c *client.Client, refresh time.Duration) *mountTree {
+	return &mountTree{
+		c:         c,
+		refresh:   refresh,
+		files:     make(map[string]*mountFile),
+		dirs:      map[string]bool{"": true},
+		localDirs: make(map[string]bool),
+	}
+}
+
+// cleanName returns the path a stored file name is shown at, or "" if it
+// has no usable path.
+func cleanName(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part != "" && part != "." && part != ".." {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// load lists the server's files again if the listing is older than the
+// refresh interval. Concurrent callers share one listing.
+func (t *mountTree) load(ctx context.Context) error {
+	t.mu.Lock()
+	if time.Since(t.loaded) < t.refresh {
+		t.mu.Unlock()
+		return nil
+	}
+	if loading := t.loading; loading != nil {
+		t.mu.Unlock()
+		select {
+		case <-loading:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	loading := make(chan struct{})
+	t.loading = loading
+	t.mu.Unlock()
+
+	files, err := t.c.ListFiles(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loading = nil
+	close(loading)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	t.rebuild(files)
+	t.loaded = time.Now()
+	return nil
+}
+
+// rebuild replaces the tree with the listed files, newest first, keeping
+// what exists only in the mount. t.mu is held.
+func (t *mountTree) rebuild(files []models.FileMetadata) {
+	tree := make(map[string]*mountFile)
+	for i := range files {
+		p := cleanName(files[i].Name)
+		if p == "" {
+			continue
+		}
+		if f, ok := tree[p]; ok {
+			f.older = append(f.older, files[i].ID.Hex())
+			continue
+		}
+		tree[p] = &mountFile{meta: &files[i], created: files[i].CreatedAt}
+	}
+	for p, f := range t.files {
+		if f.meta == nil || f.staging != nil {
+			if listed, ok := tree[p]; ok && f.meta != nil {
+				f.meta, f.older = listed.meta, listed.older
+			}
+			tree[p] = f
+		}
+	}
+
+	dirs := map[string]bool{"": true}
+	for p := range t.localDirs {
+		addDirs(dirs, p+"/x")
+	}
+	for p := range tree {
+		addDirs(dirs, p)
+	}
+	// A name that is also a directory is shown as the directory
+	for p := range tree {
+		if dirs[p] {
+			fmt.Fprintf(os.Stderr, "tgstore: %s is hidden by a directory of the same name\n", p)
+			delete(tree, p)
+		}
+	}
+	t.files, t.dirs = tree, dirs
+}
+
+// addDirs adds every parent directory of p.
+func addDirs(dirs map[string]bool, p string) {
+	for dir := path.Dir(p); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+		dirs[dir] = true
+	}
+}
+
+// lookup returns the file at p, or whether p is a directory.
+func (t *mountTree) lookup(p string) (f *mountFile, isDir bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.files[p], t.dirs[p]
+}
+
+// add creates a file that exists only in the mount, replacing nothing.
+func (t *mountTree) add(p string) *mountFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := &mountFile{created: time.Now()}
+	t.files[p] = f
+	addDirs(t.dirs, p)
+	return f
+}
+
+// remove takes the file at p out of the tree.
+func (t *mountTree) remove(p string, f *mountFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.files[p] == f {
+		delete(t.files, p)
+	}
+}
+
+// mkdir adds an empty directory.
+func (t *mountTree) mkdir(p string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.localDirs[p] = true
+	addDirs(t.dirs, p+"/x")
+}
+
+// rmdir removes an empty directory and reports whether it was empty.
+func (t *mountTree) rmdir(p string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prefix := p + "/"
+	for q := range t.dirs {
+		if strings.HasPrefix(q, prefix) {
+			return false
+		}
+	}
+	for q := range t.files {
+		if strings.HasPrefix(q, prefix) {
+			return false
+		}
+	}
+	delete(t.localDirs, p)
+	delete(t.dirs, p)
+	return true
+}
+
+// dirEntry is a name in a directory listing.
+type dirEntry struct {
+	name  string
+	isDir bool
+}
+
+// list returns the entries of the directory dir, sorted by name.
+func (t *mountTree) list(dir string) []dirEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	var entries []dirEntry
+	for p := range t.dirs {
+		if rest, ok := strings.CutPrefix(p, prefix); ok && rest != "" && !strings.Contains(rest, "/") {
+			entries = append(entries, dirEntry{name: rest, isDir: true})
+		}
+	}
+	for p := range t.files {
+		if rest, ok := strings.CutPrefix(p, prefix); ok && rest != "" && !strings.Contains(rest, "/") {
+			entries = append(entries, dirEntry{name: rest})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressBar draws a transfer's progress on stderr. A nil *progressBar is
+// valid and draws nothing.
+type progressBar struct {
+	label string
+	total int64
+	done  atomic.Int64
+	start time.Time
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// showProgress is false when stderr is not a terminal or -quiet or -json
+// was given.
+var showProgress bool
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgressBar(label string, total int64) *progressBar {
+	if !showProgress {
+		return nil
+	}
+	p := &progressBar{label: label, total: total, start: time.Now(), stop: make(chan struct{})}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.draw()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Add records n more bytes transferred; n may be negative.
+func (p *progressBar) Add(n int64) {
+	if p != nil {
+		p.done.Add(n)
+	}
+}
+
+// Reset starts counting from zero again.
+func (p *progressBar) Reset() {
+	if p != nil {
+		p.done.Store(0)
+	}
+}
+
+// Finish draws the final state and moves to the next line.
+func (p *progressBar) Finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progressBar) draw() {
+	const width = 30
+	done := min(p.done.Load(), p.total)
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(done) / float64(p.total)
+	}
+	filled := int(fraction * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+
+	rate := float64(done) / max(time.Since(p.start).Seconds(), 0.001)
+	label := p.label
+	if len(label) > 30 {
+		label = "…" + label[len(label)-29:]
+	}
+	fmt.Fprintf(os.Stderr, "\r%-30s [%s] %5.1f%% %9s/%-9s %9s/s", label, bar, fraction*100,
+		formatBytes(done), formatBytes(p.total), formatBytes(int64(rate)))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"telegram-storage/client"
+)
+
+// readCache keeps fixed-size blocks of stored files on local disk, evicting
+// the least recently used once it holds more than maxBytes. Stored files
+// never change (new content gets a new file ID), so a cached block stays
+// valid until it is evicted. Blocks are fetched with one range request each;
+// a block being fetched is shared by every reader that needs it.
+type readCache struct {
+	dir       string
+	blockSize int64
+	maxBytes  int64
+	prefetch  chan struct{} // limits read-ahead fetches in flight
+
+	mu       sync.Mutex
+	lru      *list.List // of *cachedBlock, most recently used first
+	blocks   map[blockKey]*list.Element
+	bytes    int64
+	fetching map[blockKey]*blockFetch
+}
+
+type blockKey struct {
+	fileID string
+	index  int64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	size int64
+}
+
+type blockFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// newReadCache returns a cache in dir, removing anything left there by an
+// earlier mount.
+func newReadCache(dir string, blockSize, maxBytes int64, prefetchers int) (*readCache, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &readCache{
+		dir:       dir,
+		blockSize: blockSize,
+		maxBytes:  maxBytes,
+		prefetch:  make(chan struct{}, max(prefetchers, 1)),
+		lru:       list.New(),
+		blocks:    make(map[blockKey]*list.Element),
+		fetching:  make(map[blockKey]*blockFetch),
+	}, nil
+}
+
+func (rc *readCache) path(key blockKey) string {
+	return filepath.Join(rc.dir, key.fileID, strconv.FormatInt(key.index, 10))
+}
+
+// ReadAt fills p from the file at off, fetching missing blocks, and returns
+// io.EOF when it reaches the end of the file.
+func (rc *readCache) ReadAt(ctx context.Context, f *client.File, p []byte, off int64) (int, error) {
+	fileID := f.Metadata().ID.Hex()
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= f.Size() {
+			return n, io.EOF
+		}
+		key := blockKey{fileID, pos / rc.blockSize}
+		if err := rc.load(ctx, f, key); err != nil {
+			return n, err
+		}
+		m, err := rc.readBlock(key, p[n:], pos-key.index*rc.blockSize)
+		n += m
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// Evicted between loading and reading; load it again
+		case err != nil:
+			return n, err
+		case m == 0:
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
+
+// Prefetch starts fetching the count blocks after the one holding off, in
+// the background, as far as the read-ahead limit allows.
+func (rc *readCache) Prefetch(f *client.File, off int64, count int) {
+	fileID := f.Metadata().ID.Hex()
+	first := off/rc.blockSize + 1
+	last := min(first+int64(count), (f.Size()+rc.blockSize-1)/rc.blockSize)
+	for index := first; index < last; index++ {
+		key := blockKey{fileID, index}
+		rc.mu.Lock()
+		_, cached := rc.blocks[key]
+		_, inFlight := rc.fetching[key]
+		rc.mu.Unlock()
+		if cached || inFlight {
+			continue
+		}
+		select {
+		case rc.prefetch <- struct{}{}:
+		default:
+			return
+		}
+		go func() {
+			defer func() { <-rc.prefetch }()
+			rc.load(context.Background(), f, key)
+		}()
+	}
+}
+
+// load makes sure a block is on disk, fetching it or waiting for a fetch
+// already in progress.
+func (rc *readCache) load(ctx context.Context, f *client.File, key blockKey) error {
+	rc.mu.Lock()
+	if elem, ok := rc.blocks[key]; ok {
+		rc.lru.MoveToFront(elem)
+		rc.mu.Unlock()
+		return nil
+	}
+	fetch, inFlight := rc.fetching[key]
+	if !inFlight {
+		fetch = &blockFetch{done: make(chan struct{})}
+		rc.fetching[key] = fetch
+	}
+	rc.mu.Unlock()
+
+	if !inFlight {
+		size, err := rc.fetch(f, key)
+		rc.mu.Lock()
+		delete(rc.fetching, key)
+		if err == nil {
+			rc.add(key, size)
+		}
+		rc.mu.Unlock()
+		fetch.err = err
+		close(fetch.done)
+	}
+
+	select {
+	case <-fetch.done:
+		return fetch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetch downloads a block into its file.
+func (rc *readCache) fetch(f *client.File, key blockKey) (int64, error) {
+	offset := key.index * rc.blockSize
+	buf := make([]byte, min(rc.blockSize, f.Size()-offset))
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to read %s at %d: %w", key.fileID, offset, err)
+	}
+
+	path := rc.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fetch-*")
+	if err != nil {
+		return 0, err
+	}
+	_, err = tmp.Write(buf)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return int64(len(buf)), nil
+}
+
+// add records a fetched block and evicts old ones. rc.mu is held.
+func (rc *readCache) add(key blockKey, size int64) {
+	rc.blocks[key] = rc.lru.PushFront(&cachedBlock{key: key, size: size})
+	rc.bytes += size
+	for rc.bytes > rc.maxBytes && rc.lru.Len() > 1 {
+		oldest := rc.lru.Back()
+		block := oldest.Value.(*cachedBlock)
+		rc.lru.Remove(oldest)
+		delete(rc.blocks, block.key)
+		rc.bytes -= block.size
+		os.Remove(rc.path(block.key))
+	}
+}
+
+// readBlock copies a cached block, starting off bytes into it, to p.
+func (rc *readCache) readBlock(key blockKey, p []byte, off int64) (int, error) {
+	f, err := os.Open(rc.path(key))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, off)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"telegram-storage/client"
+	"telegram-storage/models"
+)
+
+// Interrupted transfers are resumed from small JSON state files. Uploads keep
+// theirs in the user cache directory, keyed by the file's path, size and
+// modification time; downloads keep theirs next to the partial file.
+
+type uploadState struct {
+	UploadID  string `json:"upload_id"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+type downloadState struct {
+	FileID    string `json:"file_id"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Done      []int  `json:"done"`
+}
+
+func readState(path string, v interface{}) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func writeState(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func uploadStatePath(path string, info os.FileInfo) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", abs, info.Size(), info.ModTime().UnixNano())))
+	return filepath.Join(dir, "tgstore", "uploads", hex.EncodeToString(key[:16])+".json"), nil
+}
+
+// putFile uploads the file at path as name, resuming an earlier interrupted
+// upload of the same file. hash may be empty.
+func putFile(ctx context.Context, c *client.Client, path, name, hash string) (*models.FileMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	statePath, err := uploadStatePath(path, info)
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	resuming := readState(statePath, &state)
+
+	uc := *c
+	bar := newProgressBar(name, info.Size())
+	opts := client.PutOptions{
+		Name:     name,
+		Hash:     hash,
+		Progress: bar.Add,
+		OnStart: func(uploadID string) {
+			writeState(statePath, uploadState{UploadID: uploadID, ChunkSize: uc.ChunkSize})
+		},
+	}
+	if resuming {
+		opts.UploadID = state.UploadID
+		uc.ChunkSize = state.ChunkSize
+	}
+
+	metadata, err := uc.Put(ctx, f, info.Size(), opts)
+	if err != nil && resuming && client.IsNotFound(err) {
+		// The server expired the pending upload; start over
+		bar.Reset()
+		opts.UploadID = ""
+		uc = *c
+		metadata, err = uc.Put(ctx, f, info.Size(), opts)
+	}
+	bar.Finish()
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(statePath)
+	return metadata, nil
+}
+
+// getFile downloads a file to path through path+".part", resuming an earlier
+// interrupted download, and checks the content against the recorded hash.
+func getFile(ctx context.Context, c *client.Client, fileID, path string) (*models.FileMetadata, error) {
+	metadata, err := c.GetFile(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	partPath := path + ".part"
+	statePath := path + ".part.json"
+	var state downloadState
+	if !readState(statePath, &state) || state.FileID != fileID || state.Size != metadata.Size {
+		state = downloadState{FileID: fileID, Size: metadata.Size, ChunkSize: c.ChunkSize}
+		os.Remove(partPath)
+	}
+	dc := *c
+	dc.ChunkSize = state.ChunkSize
+
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	done := make(map[int]bool)
+	for _, part := range state.Done {
+		done[part] = true
+	}
+	var mu sync.Mutex
+	bar := newProgressBar(metadata.Name, metadata.Size)
+	_, err = dc.Get(ctx, fileID, f, client.GetOptions{
+		Skip:     func(part int) bool { return done[part] },
+		Progress: bar.Add,
+		PartDone: func(part int) {
+			mu.Lock()
+			defer mu.Unlock()
+			state.Done = append(state.Done, part)
+			writeState(statePath, state)
+		},
+	})
+	bar.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(metadata.Size); err != nil {
+		return nil, err
+	}
+
+	if metadata.Hash != "" {
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		hash, err := client.Hash(f)
+		if err != nil {
+			return nil, err
+		}
+		if hash != metadata.Hash {
+			// Start over next time rather than resume into bad data
+			os.Remove(statePath)
+			return nil, fmt.Errorf("downloaded content does not match: expected SHA-256 %s, got %s", metadata.Hash, hash)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return nil, err
+	}
+	os.Remove(statePath)
+	return metadata, nil
+}
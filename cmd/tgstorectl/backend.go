@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"telegram-storage/bot"
+	"telegram-storage/configs"
+	"telegram-storage/models"
+	"telegram-storage/services"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// backend is what the commands operate on: the HTTP API of a running server
+// or the store itself.
+type backend interface {
+	ListFiles(ctx context.Context) ([]models.FileMetadata, error)
+	GetFile(ctx context.Context, fileID string) (*models.FileMetadata, error)
+	GetChunk(ctx context.Context, hash string) (*models.StoredChunk, error)
+	VerifyFile(ctx context.Context, fileID string, verifyHash bool) (*models.FileMetadata, error)
+	DeleteFile(ctx context.Context, fileID string) (*models.Job, error)
+	ListUploads(ctx context.Context, olderThan time.Duration) ([]models.FileMetadata, error)
+	PurgeUploads(ctx context.Context, olderThan time.Duration) ([]models.Job, error)
+	CheckBots(ctx context.Context) ([]services.BotStatus, error)
+	ReuploadChunk(ctx context.Context, fileID string, sequence int, data io.ReadSeeker, size int64) (*models.FileChunk, error)
+	Export(ctx context.Context, w io.Writer) error
+	Import(ctx context.Context, r io.Reader, opts services.ImportOptions) (*services.ImportResult, error)
+	SetupIndexes(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// directBackend works on MongoDB and the bots without a server. Deletes are
+// queued as jobs, which a running server picks up.
+type directBackend struct {
+	client  *mongo.Client
+	service *services.FileService
+	groupID int64
+}
+
+func newDirectBackend(ctx context.Context, flags *configs.Flags) (*directBackend, error) {
+	cfg, err := flags.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	botPool, err := bot.NewBotPool(cfg.Telegram.BotTokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize bot pool: %v", err)
+	}
+	client := configs.ConnectDB(ctx, cfg.Mongo)
+	db := client.Database(cfg.Mongo.Database)
+
+	return &directBackend{
+		client:  client,
+		service: services.NewFileService(botPool, db, cfg.Storage),
+		groupID: cfg.Telegram.GroupID,
+	}, nil
+}
+
+func (d *directBackend) ListFiles(ctx context.Context) ([]models.FileMetadata, error) {
+	return d.service.ListFiles(ctx)
+}
+
+func (d *directBackend) GetFile(ctx context.Context, fileID string) (*models.FileMetadata, error) {
+	return d.service.GetFileMetadata(ctx, fileID)
+}
+
+func (d *directBackend) GetChunk(ctx context.Context, hash string) (*models.StoredChunk, error) {
+	return d.service.GetStoredChunk(ctx, hash)
+}
+
+func (d *directBackend) VerifyFile(ctx context.Context, fileID string, verifyHash bool) (*models.FileMetadata, error) {
+	return d.service.VerifyFile(ctx, fileID, verifyHash)
+}
+
+func (d *directBackend) DeleteFile(ctx context.Context, fileID string) (*models.Job, error) {
+	return d.service.DeleteFile(ctx, fileID, d.groupID)
+}
+
+func (d *directBackend) ListUploads(ctx context.Context, olderThan time.Duration) ([]models.FileMetadata, error) {
+	return d.service.ListUploads(ctx, olderThan)
+}
+
+func (d *directBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) ([]models.Job, error) {
+	return d.service.PurgeUploads(ctx, olderThan, d.groupID)
+}
+
+func (d *directBackend) CheckBots(ctx context.Context) ([]services.BotStatus, error) {
+	return d.service.CheckBots(ctx), nil
+}
+
+func (d *directBackend) ReuploadChunk(ctx context.Context, fileID string, sequence int, data io.ReadSeeker, size int64) (*models.FileChunk, error) {
+	return d.service.ReuploadChunk(ctx, fileID, sequence, data, size, d.groupID)
+}
+
+func (d *directBackend) Export(ctx context.Context, w io.Writer) error {
+	_, err := d.service.ExportMetadata(ctx, w)
+	return err
+}
+
+func (d *directBackend) Import(ctx context.Context, r io.Reader, opts services.ImportOptions) (*services.ImportResult, error) {
+	return d.service.ImportMetadata(ctx, r, opts)
+}
+
+func (d *directBackend) SetupIndexes(ctx context.Context) error {
+	return configs.SetupIndexes(d.service.DB())
+}
+
+func (d *directBackend) Close(ctx context.Context) error {
+	return d.client.Disconnect(ctx)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"telegram-storage/models"
+	"telegram-storage/services"
+)
+
+// httpBackend talks to the API of a running server.
+type httpBackend struct {
+	base   string
+	client *http.Client
+}
+
+func newHTTPBackend(server string) *httpBackend {
+	return &httpBackend{base: strings.TrimRight(server, "/"), client: &http.Client{}}
+}
+
+// apiError is the error body the server answers with.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *apiError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%s (%s, request %s)", e.Message, e.Code, e.RequestID)
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// do sends a request and decodes a JSON response into out, if not nil.
+func (h *httpBackend) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string, out interface{}) error {
+	u := h.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var envelope struct {
+			Error *apiError `json:"error"`
+		}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error != nil {
+			if out != nil {
+				// Some errors carry a partial result, e.g. a failed import
+				json.Unmarshal(data, out)
+			}
+			return envelope.Error
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid response from %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+func (h *httpBackend) ListFiles(ctx context.Context) ([]models.FileMetadata, error) {
+	var files []models.FileMetadata
+	return files, h.do(ctx, http.MethodGet, "/files", nil, nil, "", &files)
+}
+
+func (h *httpBackend) GetFile(ctx context.Context, fileID string) (*models.FileMetadata, error) {
+	var metadata models.FileMetadata
+	if err := h.do(ctx, http.MethodGet, "/admin/files/"+url.PathEscape(fileID), nil, nil, "", &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func (h *httpBackend) GetChunk(ctx context.Context, hash string) (*models.StoredChunk, error) {
+	var chunk models.StoredChunk
+	if err := h.do(ctx, http.MethodGet, "/admin/chunks/"+url.PathEscape(hash), nil, nil, "", &chunk); err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+func (h *httpBackend) VerifyFile(ctx context.Context, fileID string, verifyHash bool) (*models.FileMetadata, error) {
+	query := url.Values{"verify_hash": {strconv.FormatBool(verifyHash)}}
+	var metadata models.FileMetadata
+	if err := h.do(ctx, http.MethodPost, "/admin/files/"+url.PathEscape(fileID)+"/verify", query, nil, "", &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func (h *httpBackend) DeleteFile(ctx context.Context, fileID string) (*models.Job, error) {
+	var resp struct {
+		JobID string `json:"job_id"`
+	}
+	if err := h.do(ctx, http.MethodDelete, "/files/"+url.PathEscape(fileID), nil, nil, "", &resp); err != nil {
+		return nil, err
+	}
+	return h.getJob(ctx, resp.JobID)
+}
+
+func (h *httpBackend) getJob(ctx context.Context, jobID string) (*models.Job, error) {
+	var job models.Job
+	if err := h.do(ctx, http.MethodGet, "/admin/jobs/"+url.PathEscape(jobID), nil, nil, "", &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (h *httpBackend) ListUploads(ctx context.Context, olderThan time.Duration) ([]models.FileMetadata, error) {
+	query := url.Values{"older_than": {olderThan.String()}}
+	var uploads []models.FileMetadata
+	return uploads, h.do(ctx, http.MethodGet, "/admin/uploads", query, nil, "", &uploads)
+}
+
+func (h *httpBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) ([]models.Job, error) {
+	query := url.Values{"older_than": {olderThan.String()}}
+	var resp struct {
+		Jobs []models.Job `json:"jobs"`
+	}
+	return resp.Jobs, h.do(ctx, http.MethodDelete, "/admin/uploads", query, nil, "", &resp)
+}
+
+func (h *httpBackend) CheckBots(ctx context.Context) ([]services.BotStatus, error) {
+	var statuses []services.BotStatus
+	return statuses, h.do(ctx, http.MethodGet, "/admin/bots", nil, nil, "", &statuses)
+}
+
+func (h *httpBackend) ReuploadChunk(ctx context.Context, fileID string, sequence int, data io.ReadSeeker, size int64) (*models.FileChunk, error) {
+	// Chunks are at most MaxChunkSize, so the form is built in memory
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", fmt.Sprintf("chunk_%s_%d", fileID, sequence))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, data); err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	var chunk models.FileChunk
+	path := fmt.Sprintf("/admin/files/%s/chunks/%d", url.PathEscape(fileID), sequence)
+	if err := h.do(ctx, http.MethodPut, path, nil, &body, form.FormDataContentType(), &chunk); err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+func (h *httpBackend) Export(ctx context.Context, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.base+"/admin/export", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /admin/export: %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (h *httpBackend) Import(ctx context.Context, r io.Reader, opts services.ImportOptions) (*services.ImportResult, error) {
+	query := url.Values{}
+	if opts.Mode != "" {
+		query.Set("mode", opts.Mode)
+	}
+	if opts.DryRun {
+		query.Set("dry_run", "true")
+	}
+	for from, to := range opts.BotRemap {
+		query.Add("remap_bot", from+":"+to)
+	}
+	for from, to := range opts.GroupRemap {
+		query.Add("remap_group", fmt.Sprintf("%d:%d", from, to))
+	}
+
+	var result struct {
+		services.ImportResult
+		Result *services.ImportResult `json:"result"` // set on failure
+	}
+	err := h.do(ctx, http.MethodPost, "/admin/import", query, r, "application/x-ndjson", &result)
+	if err != nil {
+		return result.Result, err
+	}
+	return &result.ImportResult, nil
+}
+
+func (h *httpBackend) SetupIndexes(ctx context.Context) error {
+	return h.do(ctx, http.MethodPost, "/admin/indexes", nil, nil, "", nil)
+}
+
+func (h *httpBackend) Close(ctx context.Context) error {
+	return nil
+}
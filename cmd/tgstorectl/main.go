@@ -0,0 +1,441 @@
+// Command tgstorectl inspects and maintains the store. It talks to the HTTP
+// API of a running server when -server (or TGSTORE_SERVER) is set, and
+// otherwise directly to MongoDB and the bots using the server configuration.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"telegram-storage/configs"
+	"telegram-storage/logging"
+	"telegram-storage/models"
+	"telegram-storage/services"
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(ctx context.Context, b backend, args []string) error
+}
+
+var commands = []command{
+	{"ls", "", "list completed files", listFiles},
+	{"inspect", "<file-id>", "print a file record", inspectFile},
+	{"chunks", "<file-id>", "list the chunks of a file", listChunks},
+	{"chunk", "<hash>", "print the stored chunk record for a content hash", inspectChunk},
+	{"verify", "[-hash] <file-id>", "check that Telegram still serves every chunk of a file", verifyFile},
+	{"rm", "<file-id>...", "delete files", deleteFiles},
+	{"uploads", "[-older-than 0s]", "list pending uploads", listUploads},
+	{"purge", "[-older-than 24h]", "delete pending uploads and the chunks they sent", purgeUploads},
+	{"bots", "", "check every bot of the pool", checkBots},
+	{"reupload", "<file-id> <sequence> <path>", "replace a chunk's Telegram document with a local copy", reuploadChunk},
+	{"export", "[-o path]", "write a metadata archive (default to stdout)", exportMetadata},
+	{"import", "[-mode upsert|skip] [-dry-run] [-remap-bot old:new] [-remap-group old:new] <path|->", "import a metadata archive", importMetadata},
+	{"indexes", "", "create the MongoDB indexes", setupIndexes},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: tgstorectl [flags] <command> [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flags := configs.RegisterFlags(flag.CommandLine)
+	server := flag.String("server", os.Getenv("TGSTORE_SERVER"), "API base URL, e.g. http://localhost:80; empty works on MongoDB and Telegram directly")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "tgstorectl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	logging.Setup(logging.Config{Level: slog.LevelWarn, Format: "text"})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var b backend
+	if *server != "" {
+		b = newHTTPBackend(*server)
+	} else {
+		direct, err := newDirectBackend(ctx, flags)
+		if err != nil {
+			fatal(err)
+		}
+		b = direct
+	}
+
+	err := cmd.run(ctx, b, flag.Args()[1:])
+	b.Close(context.Background())
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "tgstorectl: %v\n", err)
+	os.Exit(1)
+}
+
+// parseArgs parses a command's flags and checks it got n positional
+// arguments, or at least one when n is -1.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if (n >= 0 && fs.NArg() != n) || (n < 0 && fs.NArg() == 0) {
+		return nil, fmt.Errorf("%s: wrong number of arguments", fs.Name())
+	}
+	return fs.Args(), nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+func listFiles(ctx context.Context, b backend, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("ls", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	files, err := b.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+	w := table()
+	fmt.Fprintln(w, "ID\tSIZE\tMODE\tHEALTH\tCREATED\tNAME")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", f.ID.Hex(), f.Size, storageMode(f), orDash(f.Health),
+			f.CreatedAt.Local().Format(time.DateTime), f.Name)
+	}
+	return w.Flush()
+}
+
+func storageMode(f models.FileMetadata) string {
+	if f.StorageMode == "" {
+		return models.StorageModeStandard
+	}
+	return f.StorageMode
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func inspectFile(ctx context.Context, b backend, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("inspect", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	metadata, err := b.GetFile(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(metadata)
+}
+
+func listChunks(ctx context.Context, b backend, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("chunks", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	metadata, err := b.GetFile(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	bad := make(map[int]bool)
+	for _, seq := range metadata.BadChunks {
+		bad[seq] = true
+	}
+	w := table()
+	fmt.Fprintln(w, "SEQ\tSIZE\tSTORED\tBOT\tMESSAGE\tHASH\tSTATE")
+	for _, c := range metadata.Chunks {
+		state := "ok"
+		if bad[c.Sequence] {
+			state = "bad"
+		}
+		stored := c.Size
+		if c.Codec != "" {
+			stored = c.StoredSize
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%d\t%s\t%s\n", c.Sequence, c.Size, stored, c.BotToken, c.MessageID, orDash(c.Hash), state)
+	}
+	for _, p := range metadata.ParityChunks {
+		fmt.Fprintf(w, "parity %d/%d\t%d\t%d\t%s\t%d\t%s\t-\n", p.Stripe, p.Shard, p.Size, p.Size, p.BotToken, p.MessageID, orDash(p.Hash))
+	}
+	return w.Flush()
+}
+
+func inspectChunk(ctx context.Context, b backend, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("chunk", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	chunk, err := b.GetChunk(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(chunk)
+}
+
+func verifyFile(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	verifyHash := fs.Bool("hash", false, "download every chunk and compare its SHA-256")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	metadata, err := b.VerifyFile(ctx, args[0], *verifyHash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %s\n", metadata.Name, metadata.Health)
+	if len(metadata.BadChunks) > 0 {
+		fmt.Printf("bad chunks: %v\n", metadata.BadChunks)
+	}
+	if metadata.Health != models.HealthHealthy {
+		return fmt.Errorf("file is %s", metadata.Health)
+	}
+	return nil
+}
+
+func deleteFiles(ctx context.Context, b backend, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("rm", flag.ExitOnError), args, -1)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, fileID := range args {
+		job, err := b.DeleteFile(ctx, fileID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", fileID, err))
+			continue
+		}
+		fmt.Printf("%s: deleting (job %s)\n", fileID, job.ID.Hex())
+	}
+	return errors.Join(errs...)
+}
+
+func listUploads(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("uploads", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 0, "only uploads created at least this long ago")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	uploads, err := b.ListUploads(ctx, *olderThan)
+	if err != nil {
+		return err
+	}
+	w := table()
+	fmt.Fprintln(w, "ID\tSIZE\tCHUNKS\tPARTS\tCREATED\tUPDATED\tNAME")
+	for _, u := range uploads {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\n", u.ID.Hex(), u.Size, len(u.Chunks), len(u.Parts),
+			u.CreatedAt.Local().Format(time.DateTime), u.UpdatedAt.Local().Format(time.DateTime), u.Name)
+	}
+	return w.Flush()
+}
+
+func purgeUploads(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 24*time.Hour, "only uploads created at least this long ago")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	jobs, err := b.PurgeUploads(ctx, *olderThan)
+	for _, job := range jobs {
+		fmt.Printf("%s: deleting (job %s)\n", job.Payload["file_id"], job.ID.Hex())
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d uploads purged\n", len(jobs))
+	return nil
+}
+
+func checkBots(ctx context.Context, b backend, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("bots", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	statuses, err := b.CheckBots(ctx)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	w := table()
+	fmt.Fprintln(w, "BOT\tSTATUS\tLATENCY\tERROR")
+	for _, s := range statuses {
+		status := "ok"
+		if !s.OK {
+			status = "failing"
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Username, status, s.Latency.Round(time.Millisecond), s.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d bots failing", failed, len(statuses))
+	}
+	return nil
+}
+
+func reuploadChunk(ctx context.Context, b backend, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("reupload", flag.ExitOnError), args, 3)
+	if err != nil {
+		return err
+	}
+	sequence, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid sequence %q", args[1])
+	}
+	f, err := os.Open(args[2])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	chunk, err := b.ReuploadChunk(ctx, args[0], sequence, f, info.Size())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("chunk %d re-uploaded by %s as message %d\n", chunk.Sequence, chunk.BotToken, chunk.MessageID)
+	return nil
+}
+
+func exportMetadata(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "", "write to this file instead of stdout")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *output == "" {
+		return b.Export(ctx, os.Stdout)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := b.Export(ctx, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// remapFlag collects repeated old:new pairs.
+type remapFlag []string
+
+func (r *remapFlag) String() string { return strings.Join(*r, ",") }
+
+func (r *remapFlag) Set(v string) error {
+	if from, to, ok := strings.Cut(v, ":"); !ok || from == "" || to == "" {
+		return fmt.Errorf("want old:new")
+	}
+	*r = append(*r, v)
+	return nil
+}
+
+func importMetadata(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	mode := fs.String("mode", services.ImportModeUpsert, "upsert replaces existing documents, skip keeps them")
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without writing")
+	var remapBots, remapGroups remapFlag
+	fs.Var(&remapBots, "remap-bot", "rename a bot, as old:new (repeatable)")
+	fs.Var(&remapGroups, "remap-group", "move a Telegram group, as old:new (repeatable)")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	opts := services.ImportOptions{
+		Mode:       *mode,
+		DryRun:     *dryRun,
+		BotRemap:   make(map[string]string),
+		GroupRemap: make(map[int64]int64),
+	}
+	for _, pair := range remapBots {
+		from, to, _ := strings.Cut(pair, ":")
+		opts.BotRemap[from] = to
+	}
+	for _, pair := range remapGroups {
+		from, to, _ := strings.Cut(pair, ":")
+		fromID, err1 := strconv.ParseInt(from, 10, 64)
+		toID, err2 := strconv.ParseInt(to, 10, 64)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid -remap-group %s", pair)
+		}
+		opts.GroupRemap[fromID] = toID
+	}
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result, err := b.Import(ctx, r, opts)
+	if result != nil {
+		printJSON(result)
+	}
+	return err
+}
+
+func setupIndexes(ctx context.Context, b backend, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("indexes", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	if err := b.SetupIndexes(ctx); err != nil {
+		return err
+	}
+	fmt.Println("indexes created")
+	return nil
+}
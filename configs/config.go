@@ -0,0 +1,177 @@
+package configs
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"telegram-storage/bot"
+	"telegram-storage/logging"
+	"telegram-storage/services"
+
+	"github.com/goccy/go-yaml"
+	"github.com/joho/godotenv"
+)
+
+// DefaultPath is the config file read when no -config flag or CONFIG_FILE is
+// given and the file exists.
+const DefaultPath = "config.yaml"
+
+// Config is the complete configuration of the server and its commands.
+// Settings are layered: built-in defaults, then the YAML config file, then
+// environment variables (including a .env file, if present), then flags.
+// Each field is tagged with its config file key and environment variable.
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Mongo    MongoConfig    `yaml:"mongo"`
+	Telegram TelegramConfig `yaml:"telegram"`
+	Log      logging.Config `yaml:"log"`
+
+	Storage services.Config `yaml:",inline"`
+}
+
+// ServerConfig controls the HTTP server.
+type ServerConfig struct {
+	Addr            string        `yaml:"addr" env:"SERVER_ADDR"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"` // how long in-flight requests and jobs get to finish
+	CORSOrigins     []string      `yaml:"cors_origins" env:"CORS_ORIGINS"`
+}
+
+// MongoConfig locates the metadata database.
+type MongoConfig struct {
+	URI      string `yaml:"uri" env:"MONGO_URL"`
+	Database string `yaml:"database" env:"MONGO_DATABASE"`
+}
+
+// TelegramConfig lists the bots and the groups files are stored in.
+type TelegramConfig struct {
+	BotTokens      []string `yaml:"bot_tokens" env:"BOT_TOKENS"`
+	GroupID        int64    `yaml:"group_id" env:"TELEGRAM_GROUP_ID"`
+	ParityGroupIDs []int64  `yaml:"parity_group_ids" env:"TELEGRAM_PARITY_GROUP_IDS"` // receive erasure parity chunks; empty means the main group
+}
+
+// Default returns the built-in configuration. It is not valid on its own:
+// the Mongo URI, bot tokens and group have no defaults.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:            ":80",
+			ShutdownTimeout: 10 * time.Second,
+			CORSOrigins:     []string{"*"},
+		},
+		Mongo:   MongoConfig{Database: "telegram_storage"},
+		Log:     logging.DefaultConfig(),
+		Storage: services.DefaultConfig(),
+	}
+}
+
+// Validate reports every invalid setting, naming each by its config file key.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must be set")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Mongo.URI != "", "mongo.uri (MONGO_URL) must be set")
+	check(c.Mongo.Database != "", "mongo.database must be set")
+	check(len(c.Telegram.BotTokens) > 0, "telegram.bot_tokens (BOT_TOKENS) must list at least one bot")
+	for i, token := range c.Telegram.BotTokens {
+		check(token != "", "telegram.bot_tokens[%d] is empty", i)
+	}
+	check(c.Telegram.GroupID != 0, "telegram.group_id (TELEGRAM_GROUP_ID) must be set")
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format must be \"json\" or \"text\"")
+
+	if err := c.Storage.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Flags are the command-line flags every command accepts: -config and
+// overrides of the most common settings.
+type Flags struct {
+	path      string
+	overrides []func(*Config)
+}
+
+// RegisterFlags adds the config flags to flags. Call Load after parsing.
+func RegisterFlags(flags *flag.FlagSet) *Flags {
+	f := &Flags{}
+	flags.StringVar(&f.path, "config", os.Getenv("CONFIG_FILE"), "YAML config file (default "+DefaultPath+" if it exists)")
+	f.stringFlag(flags, "addr", "listen address (server.addr)", func(c *Config, v string) { c.Server.Addr = v })
+	f.stringFlag(flags, "mongo-url", "MongoDB connection string (mongo.uri)", func(c *Config, v string) { c.Mongo.URI = v })
+	f.stringFlag(flags, "db", "MongoDB database (mongo.database)", func(c *Config, v string) { c.Mongo.Database = v })
+	flags.Func("group", "Telegram group files are stored in (telegram.group_id)", func(v string) error {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("not a group ID")
+		}
+		f.overrides = append(f.overrides, func(c *Config) { c.Telegram.GroupID = id })
+		return nil
+	})
+	flags.Func("log-level", "log level: debug, info, warn or error (log.level)", func(v string) error {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return err
+		}
+		f.overrides = append(f.overrides, func(c *Config) { c.Log.Level = level })
+		return nil
+	})
+	return f
+}
+
+func (f *Flags) stringFlag(flags *flag.FlagSet, name, usage string, set func(*Config, string)) {
+	flags.Func(name, usage, func(v string) error {
+		f.overrides = append(f.overrides, func(c *Config) { set(c, v) })
+		return nil
+	})
+}
+
+// Load builds and validates the configuration.
+func (f *Flags) Load() (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env: %v", err)
+	}
+
+	cfg := Default()
+	path := f.path
+	if path == "" {
+		if _, err := os.Stat(DefaultPath); err == nil {
+			path = DefaultPath
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := yaml.UnmarshalWithOptions(data, cfg, yaml.Strict()); err != nil {
+			return nil, fmt.Errorf("invalid config file %s:\n%v", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, fmt.Errorf("invalid environment:\n%v", err)
+	}
+	if len(cfg.Telegram.BotTokens) == 0 {
+		cfg.Telegram.BotTokens = bot.LegacyTokensFromEnv()
+	}
+	for _, override := range f.overrides {
+		override(cfg)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%v", err)
+	}
+	return cfg, nil
+}
@@ -3,43 +3,64 @@ package configs
 
 import (
 	"context"
-	"log"
-	"os"
+	"log/slog"
+	"telegram-storage/logging"
+	"telegram-storage/metrics"
 
-	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 var DB *mongo.Client
 
-func ConnectDB(ctx context.Context) *mongo.Client {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	mongoURI := os.Getenv("MONGO_URL")
-	if mongoURI == "" {
-		log.Fatal("MONGO_URL is not set in environment variables")
-	}
-
-	clientOptions := options.Client().ApplyURI(mongoURI)
+func ConnectDB(ctx context.Context, cfg MongoConfig) *mongo.Client {
+	clientOptions := options.Client().ApplyURI(cfg.URI).
+		SetMonitor(chainMonitors(otelmongo.NewMonitor(), metrics.MongoMonitor()))
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to connect to MongoDB", "error", err)
 	}
 
 	err = client.Ping(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to reach MongoDB", "error", err)
 	}
 
-	log.Println("Connected to MongoDB")
+	slog.Info("Connected to MongoDB")
 	DB = client
 	return client
 }
 
+// chainMonitors calls each monitor in turn for every command event.
+func chainMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
+
 func GetCollection(client *mongo.Client, collectionName string) *mongo.Collection {
 	return client.Database("food").Collection(collectionName)
 }
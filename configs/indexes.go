@@ -2,7 +2,9 @@ package configs
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -33,25 +35,164 @@ func SetupIndexes(db *mongo.Database) error {
 			},
 			Options: options.Index().SetName("idx_status_created_at"),
 		},
-		{
-			Keys: bson.D{{Key: "created_at", Value: 1}},
-			Options: options.Index().
-				SetName("idx_ttl_pending").
-				SetExpireAfterSeconds(86400).
-				SetPartialFilterExpression(bson.D{{Key: "status", Value: "pending"}}),
-		},
 		{
 			Keys:    bson.D{{Key: "chunks.sequence", Value: 1}},
 			Options: options.Index().SetName("idx_chunks_sequence"),
 		},
+		{
+			Keys:    bson.D{{Key: "last_verified_at", Value: 1}},
+			Options: options.Index().SetName("idx_last_verified_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "health", Value: 1}},
+			Options: options.Index().SetName("idx_health").SetSparse(true),
+		},
 	}
 
+	indexes = append(indexes, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "hash", Value: 1},
+			{Key: "size", Value: 1},
+		},
+		Options: options.Index().
+			SetName("idx_hash_verified").
+			SetPartialFilterExpression(bson.D{
+				{Key: "hash_verified", Value: true},
+				{Key: "status", Value: "completed"},
+			}),
+	})
+
+	// Files stored in a pack, for sealing and compaction
+	indexes = append(indexes, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "pack.pack_id", Value: 1},
+			{Key: "pack.offset", Value: 1},
+		},
+		Options: options.Index().SetName("idx_pack").SetSparse(true),
+	})
+
+	// Videos waiting for HLS processing, oldest first
+	indexes = append(indexes, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "stream.status", Value: 1},
+			{Key: "stream.queued_at", Value: 1},
+		},
+		Options: options.Index().SetName("idx_stream_status").SetSparse(true),
+	})
+
 	// Create all indexes
 	_, err := collection.Indexes().CreateMany(ctx, indexes)
 	if err != nil {
 		return err
 	}
 
-	log.Println("✓ MongoDB indexes created successfully")
+	// Pending uploads used to expire through a TTL index, which left the
+	// chunks they had sent referenced forever; they are deleted by the
+	// expire_uploads job instead
+	if err := dropIndex(ctx, collection, "idx_ttl_pending"); err != nil {
+		return err
+	}
+
+	// Unanswered whole-file dedup challenges expire on their own
+	_, err = db.Collection("dedup_challenges").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetName("idx_ttl_challenge").SetExpireAfterSeconds(600),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("packs").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "status", Value: 1},
+			{Key: "created_at", Value: 1},
+		},
+		Options: options.Index().SetName("idx_pack_status"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("thumbnails").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "file_id", Value: 1}},
+		Options: options.Index().SetName("idx_thumbnail_file"),
+	})
+	if err != nil {
+		return err
+	}
+
+	shareIndexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "file_id", Value: 1}},
+			Options: options.Index().SetName("idx_share_file"),
+		},
+		{
+			// Shares without an expiry have no expires_at and are kept
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("idx_ttl_share").SetExpireAfterSeconds(0),
+		},
+	}
+	if _, err := db.Collection("shares").Indexes().CreateMany(ctx, shareIndexes); err != nil {
+		return err
+	}
+
+	jobIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "type", Value: 1},
+				{Key: "status", Value: 1},
+				{Key: "run_at", Value: 1},
+			},
+			Options: options.Index().SetName("idx_job_claim"),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("idx_job_created_at_desc"),
+		},
+		{
+			// Finished jobs are kept for a week
+			Keys: bson.D{{Key: "finished_at", Value: 1}},
+			Options: options.Index().
+				SetName("idx_ttl_job_succeeded").
+				SetExpireAfterSeconds(7 * 86400).
+				SetPartialFilterExpression(bson.D{{Key: "status", Value: "succeeded"}}),
+		},
+	}
+	if _, err := db.Collection("jobs").Indexes().CreateMany(ctx, jobIndexes); err != nil {
+		return err
+	}
+
+	// At most one queued or running job per key; Enqueue relies on it to
+	// make its upsert atomic. It replaces idx_job_unique_key, which did not
+	// enforce anything, and is created on its own since duplicates queued
+	// before it existed make it fail until they finish.
+	if err := dropIndex(ctx, db.Collection("jobs"), "idx_job_unique_key"); err != nil {
+		return err
+	}
+	_, err = db.Collection("jobs").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "unique_key", Value: 1}},
+		Options: options.Index().
+			SetName("idx_job_unique_key_active").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{
+				{Key: "unique_key", Value: bson.D{{Key: "$exists", Value: true}}},
+				{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"queued", "running"}}}},
+			}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create unique job key index: %w", err)
+	}
+
+	slog.Info("MongoDB indexes created")
 	return nil
 }
+
+// dropIndex removes an index that is no longer wanted, if it exists.
+func dropIndex(ctx context.Context, collection *mongo.Collection, name string) error {
+	_, err := collection.Indexes().DropOne(ctx, name)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27) { // NamespaceNotFound, IndexNotFound
+		return nil
+	}
+	return err
+}
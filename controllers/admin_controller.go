@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"telegram-storage/configs"
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetFileMetadata returns a file record with its chunks, whatever its status.
+func GetFileMetadata(c *gin.Context) {
+	metadata, err := services.AppFileService.GetFileMetadata(c.Request.Context(), c.Param("fileID"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, metadata)
+}
+
+// VerifyFile checks a file's chunks now. ?verify_hash=true downloads them and
+// compares their hashes.
+func VerifyFile(c *gin.Context) {
+	verifyHash, _ := strconv.ParseBool(c.Query("verify_hash"))
+	metadata, err := services.AppFileService.VerifyFile(c.Request.Context(), c.Param("fileID"), verifyHash)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, metadata)
+}
+
+// ReuploadChunk replaces the Telegram document of a chunk with the multipart
+// "file" field, which must hold the chunk's original bytes.
+func ReuploadChunk(c *gin.Context) {
+	sequence, err := strconv.Atoi(c.Param("sequence"))
+	if err != nil {
+		badRequest(c, "invalid sequence")
+		return
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		badRequest(c, "missing file")
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		respondError(c, fmt.Errorf("failed to open file: %w", err))
+		return
+	}
+	defer file.Close()
+
+	chunk, err := services.AppFileService.ReuploadChunk(c.Request.Context(), c.Param("fileID"), sequence, file, fileHeader.Size, Telegram.GroupID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, chunk)
+}
+
+func GetStoredChunk(c *gin.Context) {
+	chunk, err := services.AppFileService.GetStoredChunk(c.Request.Context(), c.Param("hash"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, chunk)
+}
+
+// olderThan parses the ?older_than= duration, defaulting to def.
+func olderThan(c *gin.Context, def time.Duration) (time.Duration, bool) {
+	v := c.Query("older_than")
+	if v == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		badRequest(c, "invalid older_than")
+		return 0, false
+	}
+	return d, true
+}
+
+// ListUploads lists pending uploads, oldest first, created at least
+// ?older_than= ago (default 0).
+func ListUploads(c *gin.Context) {
+	age, ok := olderThan(c, 0)
+	if !ok {
+		return
+	}
+	uploads, err := services.AppFileService.ListUploads(c.Request.Context(), age)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, uploads)
+}
+
+// PurgeUploads deletes pending uploads created at least ?older_than= ago
+// (default 24h).
+func PurgeUploads(c *gin.Context) {
+	age, ok := olderThan(c, 24*time.Hour)
+	if !ok {
+		return
+	}
+	jobs, err := services.AppFileService.PurgeUploads(c.Request.Context(), age, Telegram.GroupID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": "deleting", "jobs": jobs})
+}
+
+func GetBotStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, services.AppFileService.CheckBots(c.Request.Context()))
+}
+
+func SetupIndexes(c *gin.Context) {
+	if err := configs.SetupIndexes(services.AppFileService.DB()); err != nil {
+		respondError(c, fmt.Errorf("failed to set up indexes: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,18 @@
+package controllers
+
+import (
+	"net/http"
+
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, services.AppFileService.CacheStats())
+}
+
+func PurgeCache(c *gin.Context) {
+	removed := services.AppFileService.PurgeCache()
+	c.JSON(http.StatusOK, gin.H{"status": "purged", "removed": removed})
+}
@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"telegram-storage/logging"
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable error codes returned in the "code" field of error bodies.
+const (
+	CodeInvalidArgument     = "invalid_argument"
+	CodeNotFound            = "not_found"
+	CodeConflict            = "conflict"
+	CodeTooLarge            = "too_large"
+	CodeRangeNotSatisfiable = "range_not_satisfiable"
+	CodeQuotaExceeded       = "quota_exceeded"
+	CodeUpstreamUnavailable = "upstream_unavailable"
+	CodeInternal            = "internal"
+)
+
+// APIError is the body of every error response, under the "error" key.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorKinds maps service error kinds to responses. Messages of server-side
+// kinds are fixed so that Telegram and database details stay in the logs.
+var errorKinds = []struct {
+	kind    error
+	status  int
+	code    string
+	message string
+}{
+	{services.ErrInvalidArgument, http.StatusBadRequest, CodeInvalidArgument, ""},
+	{services.ErrNotFound, http.StatusNotFound, CodeNotFound, ""},
+	{services.ErrConflict, http.StatusConflict, CodeConflict, ""},
+	{services.ErrTooLarge, http.StatusRequestEntityTooLarge, CodeTooLarge, ""},
+	{services.ErrQuotaExceeded, http.StatusTooManyRequests, CodeQuotaExceeded, "storage backend is rate limited, retry later"},
+	{services.ErrUpstreamUnavailable, http.StatusServiceUnavailable, CodeUpstreamUnavailable, "storage backend unavailable, retry later"},
+}
+
+// errorResponse builds the status and body for a service error. Errors of no
+// known kind are internal and answered with a generic message.
+func errorResponse(c *gin.Context, err error) (int, APIError) {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.kind) {
+			message := k.message
+			if message == "" {
+				message = err.Error()
+			}
+			return k.status, newAPIError(c, k.code, message)
+		}
+	}
+	return http.StatusInternalServerError, newAPIError(c, CodeInternal, "internal error")
+}
+
+func newAPIError(c *gin.Context, code, message string) APIError {
+	return APIError{Code: code, Message: message, RequestID: logging.RequestID(c.Request.Context())}
+}
+
+// respondError answers a request that failed with a service error. The error
+// itself is attached to the context for the request log.
+func respondError(c *gin.Context, err error) {
+	c.Error(err)
+	status, body := errorResponse(c, err)
+	if status == http.StatusTooManyRequests {
+		if secs := services.RetryAfter(err); secs > 0 {
+			c.Header("Retry-After", strconv.Itoa(secs))
+		}
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": body})
+}
+
+// abortWithError answers a request the controller rejected itself.
+func abortWithError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": newAPIError(c, code, message)})
+}
+
+func badRequest(c *gin.Context, message string) {
+	abortWithError(c, http.StatusBadRequest, CodeInvalidArgument, message)
+}
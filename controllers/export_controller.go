@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ExportMetadata(c *gin.Context) {
+	filename := fmt.Sprintf("telegram-storage-export-%s.jsonl", time.Now().Format("20060102-150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	// Headers are already sent, so a failure can only be logged; the missing
+	// footer tells the importer the archive is incomplete.
+	if _, err := services.AppFileService.ExportMetadata(c.Request.Context(), c.Writer); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to export metadata", "error", err)
+	}
+}
+
+// ImportMetadata accepts an export archive as the request body. Query params:
+// mode=upsert|skip, dry_run=true, and repeated remap_bot=old:new and
+// remap_group=old:new.
+func ImportMetadata(c *gin.Context) {
+	opts := services.ImportOptions{
+		Mode:       c.Query("mode"),
+		BotRemap:   make(map[string]string),
+		GroupRemap: make(map[int64]int64),
+	}
+	opts.DryRun, _ = strconv.ParseBool(c.Query("dry_run"))
+
+	for _, pair := range c.QueryArray("remap_bot") {
+		from, to, ok := strings.Cut(pair, ":")
+		if !ok || from == "" || to == "" {
+			badRequest(c, fmt.Sprintf("invalid remap_bot: %s", pair))
+			return
+		}
+		opts.BotRemap[from] = to
+	}
+	for _, pair := range c.QueryArray("remap_group") {
+		from, to, ok := strings.Cut(pair, ":")
+		fromID, err1 := strconv.ParseInt(from, 10, 64)
+		toID, err2 := strconv.ParseInt(to, 10, 64)
+		if !ok || err1 != nil || err2 != nil {
+			badRequest(c, fmt.Sprintf("invalid remap_group: %s", pair))
+			return
+		}
+		opts.GroupRemap[fromID] = toID
+	}
+
+	result, err := services.AppFileService.ImportMetadata(c.Request.Context(), c.Request.Body, opts)
+	if err != nil {
+		c.Error(err)
+		status, body := errorResponse(c, err)
+		c.JSON(status, gin.H{"error": body, "result": result})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -3,31 +3,94 @@ package controllers
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 
+	"telegram-storage/configs"
+	"telegram-storage/models"
 	"telegram-storage/services"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Telegram holds the groups files are stored in. It is set at startup.
+var Telegram configs.TelegramConfig
+
 func InitNewUpload(c *gin.Context) {
 
 	var req struct {
 		Name     string `json:"name" binding:"required"`
 		Size     int64  `json:"size" binding:"required"`
 		MimeType string `json:"mime_type"`
+
+		StorageMode  string `json:"storage_mode"`
+		DataShards   int    `json:"data_shards"`
+		ParityShards int    `json:"parity_shards"`
+
+		// Whole-file deduplication: hash is the SHA-256 of the file; challenge_id
+		// and proof answer a challenge returned by a previous call.
+		Hash        string `json:"hash"`
+		ChallengeID string `json:"challenge_id"`
+		Proof       string `json:"proof"`
+
+		// Content-defined chunking: chunking is "fixed" (default) or "cdc";
+		// zero sizes use the server defaults.
+		Chunking   string `json:"chunking"`
+		CDCMinSize int64  `json:"cdc_min_size"`
+		CDCAvgSize int64  `json:"cdc_avg_size"`
+		CDCMaxSize int64  `json:"cdc_max_size"`
+
+		Compression string `json:"compression"` // "none" or "zstd"
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		badRequest(c, err.Error())
 		return
 	}
-	metadata, err := services.AppFileService.InitUpload(req.Name, req.Size, req.MimeType)
+
+	if req.Hash != "" {
+		groupID := Telegram.GroupID
+		metadata, challenge, err := services.AppFileService.DeduplicateUpload(c.Request.Context(), services.DedupRequest{
+			Name:        req.Name,
+			Size:        req.Size,
+			MimeType:    req.MimeType,
+			Hash:        req.Hash,
+			ChallengeID: req.ChallengeID,
+			Proof:       req.Proof,
+			StorageMode: req.StorageMode,
+		}, groupID)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if challenge != nil {
+			c.JSON(http.StatusOK, gin.H{"status": "challenge", "challenge": challenge})
+			return
+		}
+		if metadata != nil {
+			c.JSON(http.StatusOK, metadata)
+			return
+		}
+	}
+
+	opts := services.InitOptions{
+		StorageMode:  req.StorageMode,
+		DataShards:   req.DataShards,
+		ParityShards: req.ParityShards,
+		Hash:         req.Hash,
+		Chunking:     req.Chunking,
+		CDC: services.CDCParams{
+			MinSize: req.CDCMinSize,
+			AvgSize: req.CDCAvgSize,
+			MaxSize: req.CDCMaxSize,
+		},
+		Compression: req.Compression,
+	}
+	metadata, err := services.AppFileService.InitUpload(c.Request.Context(), req.Name, req.Size, req.MimeType, opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
@@ -39,40 +102,42 @@ func UploadChunk(c *gin.Context) {
 	sequenceStr := c.PostForm("sequence")
 	fileHeader, err := c.FormFile("file")
 	if uploadID == "" || sequenceStr == "" || err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing upload_id, sequence, or file"})
+		badRequest(c, "missing upload_id, sequence, or file")
 		return
 	}
 	sequence, err := strconv.Atoi(sequenceStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sequence"})
+		badRequest(c, "invalid sequence")
 		return
 	}
 
 	file, err := fileHeader.Open()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open file"})
+		respondError(c, fmt.Errorf("failed to open file: %w", err))
 		return
 	}
 	defer file.Close()
 
-	groupIDStr := os.Getenv("TELEGRAM_GROUP_ID")
-	if groupIDStr == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "TELEGRAM_GROUP_ID not configured"})
-		return
-	}
-	groupID, err := strconv.ParseInt(groupIDStr, 10, 64)
+	groupID := Telegram.GroupID
+
+	chunk, err := services.AppFileService.UploadChunk(c.Request.Context(), uploadID, sequence, file, fileHeader.Size, groupID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid TELEGRAM_GROUP_ID"})
+		respondError(c, err)
 		return
 	}
 
-	chunk, err := services.AppFileService.UploadChunk(uploadID, sequence, file, fileHeader.Size, groupID)
+	c.JSON(http.StatusOK, chunk)
+}
+
+// GetUploadStatus reports the parts received so far, for resuming an upload.
+func GetUploadStatus(c *gin.Context) {
+	status, err := services.AppFileService.GetUploadStatus(c.Request.Context(), c.Param("uploadID"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, chunk)
+	c.JSON(http.StatusOK, status)
 }
 
 func CompleteUpload(c *gin.Context) {
@@ -81,46 +146,172 @@ func CompleteUpload(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		badRequest(c, err.Error())
 		return
 	}
 
-	err := services.AppFileService.CompleteUpload(req.UploadID)
+	groupID := Telegram.GroupID
+	parityGroups := Telegram.ParityGroupIDs
+
+	status, err := services.AppFileService.CompleteUpload(c.Request.Context(), req.UploadID, groupID, parityGroups)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "completed"})
+	// Content-defined uploads are finished by a background job; clients poll
+	// GET /upload/:uploadID until the status is completed
+	if status != "completed" {
+		c.JSON(http.StatusAccepted, gin.H{"status": status})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": status})
 }
 
+// NextCursorHeader carries the cursor of the next page of a paginated file
+// list.
+const NextCursorHeader = "X-Next-Cursor"
+
+// defaultListLimit is the page size when only a cursor is given.
+const defaultListLimit = 100
+
+// ListFiles returns every completed file, or one page of them when limit or
+// cursor is given. Pages keep the array body and announce the next page in
+// the X-Next-Cursor header.
 func ListFiles(c *gin.Context) {
-	files, err := services.AppFileService.ListFiles()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	limitParam, cursor := c.Query("limit"), c.Query("cursor")
+	if limitParam == "" && cursor == "" {
+		files, err := services.AppFileService.ListFiles(c.Request.Context())
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, files)
 		return
 	}
 
+	limit := defaultListLimit
+	if limitParam != "" {
+		n, err := strconv.Atoi(limitParam)
+		if err != nil {
+			badRequest(c, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	files, next, err := services.AppFileService.ListFilesPage(c.Request.Context(), limit, cursor)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if next != "" {
+		c.Header(NextCursorHeader, next)
+	}
+	if files == nil {
+		files = []models.FileMetadata{}
+	}
 	c.JSON(http.StatusOK, files)
 }
 
-func GetFile(c *gin.Context) {
-	fileID := c.Param("fileID")
+// parseByteRange parses a single-range Range header ("bytes=a-b", "bytes=a-"
+// or "bytes=-n"). ok is false when the header should be ignored and the whole
+// file served; err is set when the range cannot be satisfied.
+func parseByteRange(header string, size int64) (start, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		suffix, perr := strconv.ParseInt(last, 10, 64)
+		if perr != nil || suffix <= 0 {
+			return 0, 0, false, fmt.Errorf("invalid range")
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true, nil
+	}
 
-	metadata, err := services.AppFileService.GetFileMetadata(fileID)
+	start, perr := strconv.ParseInt(first, 10, 64)
+	if perr != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range")
+	}
+	end := size - 1
+	if last != "" {
+		end, perr = strconv.ParseInt(last, 10, 64)
+		if perr != nil || end < start {
+			return 0, 0, false, fmt.Errorf("invalid range")
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, nil
+}
+
+func GetFile(c *gin.Context) {
+	metadata, err := services.AppFileService.GetFileMetadata(c.Request.Context(), c.Param("fileID"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
+		return
+	}
+	serveFile(c, metadata)
+}
+
+// serveFile answers with the content of a file, or the byte range asked for
+// in the Range header.
+func serveFile(c *gin.Context, metadata *models.FileMetadata) {
+	fileID := metadata.ID.Hex()
+	if metadata.Status != "completed" {
+		abortWithError(c, http.StatusConflict, CodeConflict, "file upload not completed")
 		return
 	}
 	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", metadata.Name))
 	c.Header("Content-Type", metadata.MimeType)
+	c.Header("Accept-Ranges", "bytes")
+
+	start, length := int64(0), metadata.Size
+	status := http.StatusOK
+	client := ""
+	if header := c.GetHeader("Range"); header != "" {
+		rangeStart, rangeLength, ok, err := parseByteRange(header, metadata.Size)
+		if err != nil {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", metadata.Size))
+			abortWithError(c, http.StatusRequestedRangeNotSatisfiable, CodeRangeNotSatisfiable, err.Error())
+			return
+		}
+		if ok {
+			start, length = rangeStart, rangeLength
+			status = http.StatusPartialContent
+			// Players issue sequential range requests; let the service read ahead for them
+			client = c.ClientIP() + " " + c.GetHeader("User-Agent")
+			c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, metadata.Size))
+		}
+	}
+	c.Header("Content-Length", strconv.FormatInt(length, 10))
+	c.Status(status)
 
 	c.Stream(func(w io.Writer) bool {
-		err := services.AppFileService.AssembleFile(fileID, w)
+		err := services.AppFileService.StreamRange(c.Request.Context(), client, fileID, start, length, w)
 		if err != nil {
-			log.Printf("Error when assembling file: %v", err)
+			slog.ErrorContext(c.Request.Context(), "Failed to stream file", "file_id", fileID, "error", err)
 			return false
 		}
 		return false
 	})
 }
+
+func DeleteFile(c *gin.Context) {
+	fileID := c.Param("fileID")
+
+	groupID := Telegram.GroupID
+
+	job, err := services.AppFileService.DeleteFile(c.Request.Context(), fileID, groupID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "deleting", "job_id": job.ID.Hex()})
+}
@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListJobs lists background jobs, newest first, optionally filtered by
+// ?type=, ?status= and ?limit= (default 100).
+func ListJobs(c *gin.Context) {
+	filter := services.JobFilter{Type: c.Query("type"), Status: c.Query("status")}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			badRequest(c, "invalid limit")
+			return
+		}
+		filter.Limit = n
+	}
+
+	jobs, err := services.AppFileService.Jobs().ListJobs(c.Request.Context(), filter)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+func GetJobStats(c *gin.Context) {
+	stats, err := services.AppFileService.Jobs().JobStats(c.Request.Context())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func GetJob(c *gin.Context) {
+	job, err := services.AppFileService.Jobs().GetJob(c.Request.Context(), c.Param("jobID"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// RetryJob requeues a dead or cancelled job.
+func RetryJob(c *gin.Context) {
+	job, err := services.AppFileService.Jobs().RetryJob(c.Request.Context(), c.Param("jobID"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// CancelJob cancels a queued or running job.
+func CancelJob(c *gin.Context) {
+	job, err := services.AppFileService.Jobs().CancelJob(c.Request.Context(), c.Param("jobID"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
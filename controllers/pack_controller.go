@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"net/http"
+
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CompactPacks(c *gin.Context) {
+	result, err := services.AppFileService.CompactPacks(c.Request.Context())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
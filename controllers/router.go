@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"telegram-storage/services"
+	"telegram-storage/tracing"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// NewRouter returns the HTTP API with its middleware. Handlers use
+// services.AppFileService and Telegram, which are set at startup.
+func NewRouter(corsOrigins []string) *gin.Engine {
+	router := gin.New()
+	router.Use(RequestID())
+
+	router.Use(otelgin.Middleware(tracing.ServiceName, otelgin.WithFilter(func(r *http.Request) bool {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			return false
+		}
+		return true
+	})))
+	router.Use(RequestLogger(), gin.Recovery())
+
+	router.Use(cors.New(cors.Config{
+		AllowOrigins:     corsOrigins,
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", RequestIDHeader},
+		ExposeHeaders:    []string{"Content-Length", RequestIDHeader, NextCursorHeader},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}))
+
+	router.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	router.GET("/readyz", func(c *gin.Context) {
+		if services.AppFileService == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	router.POST("/init", InitNewUpload)
+	router.POST("/upload", UploadChunk)
+	router.GET("/upload/:uploadID", GetUploadStatus)
+	router.POST("/complete", CompleteUpload)
+	router.GET("/files", ListFiles)
+	router.GET("/files/:fileID", GetFileMetadata)
+	router.GET("/download/:fileID", GetFile)
+	router.DELETE("/files/:fileID", DeleteFile)
+	router.POST("/files/:fileID/shares", CreateShare)
+	router.DELETE("/shares/:token", DeleteShare)
+	router.GET("/s/:token", GetSharedFile)
+	router.GET("/files/:fileID/stream", GetStreamStatus)
+	router.POST("/files/:fileID/stream", QueueStream)
+	router.GET("/files/:fileID/thumbnail", GetThumbnail)
+	router.GET("/stream/:fileID/master.m3u8", GetMasterPlaylist)
+	router.GET("/stream/:fileID/:rendition/:segment", GetStreamFile)
+
+	router.GET("/admin/scrub/report", GetScrubReport)
+	router.GET("/admin/export", ExportMetadata)
+	router.POST("/admin/import", ImportMetadata)
+	router.POST("/admin/packs/compact", CompactPacks)
+	router.GET("/admin/cache/stats", GetCacheStats)
+	router.DELETE("/admin/cache", PurgeCache)
+	router.GET("/admin/files/:fileID", GetFileMetadata)
+	router.POST("/admin/files/:fileID/verify", VerifyFile)
+	router.PUT("/admin/files/:fileID/chunks/:sequence", ReuploadChunk)
+	router.GET("/admin/chunks/:hash", GetStoredChunk)
+	router.GET("/admin/uploads", ListUploads)
+	router.DELETE("/admin/uploads", PurgeUploads)
+	router.GET("/admin/bots", GetBotStatus)
+	router.POST("/admin/indexes", SetupIndexes)
+	router.GET("/admin/jobs", ListJobs)
+	router.GET("/admin/jobs/stats", GetJobStats)
+	router.GET("/admin/jobs/:jobID", GetJob)
+	router.POST("/admin/jobs/:jobID/retry", RetryJob)
+	router.POST("/admin/jobs/:jobID/cancel", CancelJob)
+
+	return router
+}
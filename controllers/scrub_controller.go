@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"net/http"
+
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetScrubReport(c *gin.Context) {
+	report, err := services.AppFileService.GetScrubReport(c.Request.Context())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateShare creates a download link for a file. The optional body
+// {"ttl_seconds": n} limits how long the link works; without it the link
+// lasts until revoked or the file is deleted.
+func CreateShare(c *gin.Context) {
+	var req struct {
+		TTLSeconds int64 `json:"ttl_seconds"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		badRequest(c, err.Error())
+		return
+	}
+
+	share, err := services.AppFileService.CreateShare(c.Request.Context(), c.Param("fileID"), time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      share.Token,
+		"file_id":    share.FileID.Hex(),
+		"url":        "/s/" + share.Token,
+		"expires_at": share.ExpiresAt,
+	})
+}
+
+// DeleteShare revokes a download link.
+func DeleteShare(c *gin.Context) {
+	if err := services.AppFileService.DeleteShare(c.Request.Context(), c.Param("token")); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetSharedFile serves the file behind a download link, with Range support
+// like /download.
+func GetSharedFile(c *gin.Context) {
+	share, err := services.AppFileService.GetShare(c.Request.Context(), c.Param("token"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	metadata, err := services.AppFileService.GetFileMetadata(c.Request.Context(), share.FileID.Hex())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	serveFile(c, metadata)
+}
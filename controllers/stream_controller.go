@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"telegram-storage/models"
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mimeTypeM3U8 = "application/vnd.apple.mpegurl"
+	mimeTypeTS   = "video/mp2t"
+)
+
+// streamMetadata loads a file whose HLS renditions can be served.
+func streamMetadata(c *gin.Context) (*models.FileMetadata, bool) {
+	metadata, err := services.AppFileService.GetFileMetadata(c.Request.Context(), c.Param("fileID"))
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	if metadata.Stream == nil || len(metadata.Stream.Renditions) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "stream not available")
+		return nil, false
+	}
+	return metadata, true
+}
+
+// GetStreamStatus returns the HLS processing state of a file.
+func GetStreamStatus(c *gin.Context) {
+	metadata, err := services.AppFileService.GetFileMetadata(c.Request.Context(), c.Param("fileID"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if metadata.Stream == nil {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "file has no stream")
+		return
+	}
+
+	renditions := make([]string, 0, len(metadata.Stream.Renditions))
+	for _, r := range metadata.Stream.Renditions {
+		renditions = append(renditions, r.Name)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":     metadata.Stream.Status,
+		"error":      metadata.Stream.Error,
+		"renditions": renditions,
+		"queued_at":  metadata.Stream.QueuedAt,
+		"updated_at": metadata.Stream.UpdatedAt,
+	})
+}
+
+// QueueStream (re)queues HLS processing of a video file.
+func QueueStream(c *gin.Context) {
+	groupID := Telegram.GroupID
+	if err := services.AppFileService.QueueHLS(c.Request.Context(), c.Param("fileID"), groupID); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": models.StreamQueued})
+}
+
+func GetMasterPlaylist(c *gin.Context) {
+	metadata, ok := streamMetadata(c)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, mimeTypeM3U8, []byte(services.HLSMasterPlaylist(metadata)))
+}
+
+// GetStreamFile serves a rendition's playlist ("index.m3u8") or one of its
+// segments ("00042.ts").
+func GetStreamFile(c *gin.Context) {
+	metadata, ok := streamMetadata(c)
+	if !ok {
+		return
+	}
+	rendition := services.FindRendition(metadata, c.Param("rendition"))
+	if rendition == nil {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "rendition not found")
+		return
+	}
+
+	name := c.Param("segment")
+	if name == "index.m3u8" {
+		c.Data(http.StatusOK, mimeTypeM3U8, []byte(services.HLSMediaPlaylist(rendition)))
+		return
+	}
+	index, err := strconv.Atoi(strings.TrimSuffix(name, ".ts"))
+	if err != nil || !strings.HasSuffix(name, ".ts") || index < 0 || index >= len(rendition.Segments) {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "segment not found")
+		return
+	}
+
+	chunk := rendition.Segments[index].Chunk
+	c.Header("Content-Type", mimeTypeTS)
+	c.Header("Content-Length", strconv.FormatInt(chunk.Size, 10))
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Status(http.StatusOK)
+	if err := services.AppFileService.DownloadChunk(c.Request.Context(), chunk, c.Writer); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to stream segment", "error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"telegram-storage/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetThumbnail serves a JPEG thumbnail of a file. size is the wanted length
+// of the longer edge in pixels (default 256); the closest generated size at
+// least that large is returned. Thumbnails still being generated answer 202;
+// files they could not be generated for answer 404.
+func GetThumbnail(c *gin.Context) {
+	size := 256
+	if v := c.Query("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			badRequest(c, "invalid size")
+			return
+		}
+		size = n
+	}
+
+	thumb, err := services.AppFileService.GetThumbnail(c.Request.Context(), c.Param("fileID"), size)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if thumb == nil {
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusAccepted, gin.H{"status": "generating"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, "image/jpeg", thumb.Data)
+}
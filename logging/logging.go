@@ -0,0 +1,142 @@
+// Package logging configures the process-wide slog logger.
+//
+// Records carry the request ID and trace ID of the context they are logged
+// with, and bot tokens are redacted from every message and attribute before
+// a record is written.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config selects the level and format of log output.
+type Config struct {
+	Level  slog.Level `yaml:"level" env:"LOG_LEVEL"`   // debug, info, warn or error
+	Format string     `yaml:"format" env:"LOG_FORMAT"` // "json" or "text"
+}
+
+// DefaultConfig logs JSON at info level.
+func DefaultConfig() Config {
+	return Config{Level: slog.LevelInfo, Format: "json"}
+}
+
+// Setup installs the default logger. Output of the standard log package is
+// routed through it as well.
+func Setup(cfg Config) {
+	slog.SetDefault(slog.New(NewHandler(os.Stderr, cfg)))
+}
+
+// NewHandler returns a handler writing to w that adds context fields and
+// redacts bot tokens.
+func NewHandler(w io.Writer, cfg Config) slog.Handler {
+	opts := &slog.HandlerOptions{Level: cfg.Level}
+	var inner slog.Handler
+	if cfg.Format == "text" {
+		inner = slog.NewTextHandler(w, opts)
+	} else {
+		inner = slog.NewJSONHandler(w, opts)
+	}
+	return &handler{inner: inner}
+}
+
+// Fatal logs at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose log records carry id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Bot tokens look like "123456789:AA...". They end up in download URLs, and
+// so in the errors of failed downloads.
+var tokenPattern = regexp.MustCompile(`\d{5,}:[A-Za-z0-9_-]{30,}`)
+
+// Redact replaces anything that looks like a bot token in s.
+func Redact(s string) string {
+	if !strings.Contains(s, ":") {
+		return s
+	}
+	return tokenPattern.ReplaceAllString(s, "[REDACTED]")
+}
+
+type handler struct {
+	inner slog.Handler
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	if ctx != nil {
+		if id := RequestID(ctx); id != "" {
+			out.AddAttrs(slog.String("request_id", id))
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			out.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+		}
+	}
+	return h.inner.Handle(ctx, out)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &handler{inner: h.inner.WithAttrs(redacted)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{inner: h.inner.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		attrs := make([]any, len(group))
+		for i, g := range group {
+			attrs[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, attrs...)
+	case slog.KindAny:
+		// Errors and other values are flattened to their string form
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, Redact(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, Redact(x.String()))
+		default:
+			return slog.String(a.Key, Redact(fmt.Sprint(x)))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
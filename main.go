@@ -2,104 +2,73 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"telegram-storage/bot"
 	"telegram-storage/configs"
 	"telegram-storage/controllers"
+	"telegram-storage/logging"
 	"telegram-storage/services"
-	"time"
-
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"telegram-storage/tracing"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	flags := configs.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	logging.Setup(logging.DefaultConfig())
+	cfg, err := flags.Load()
+	if err != nil {
+		logging.Fatal("Failed to load configuration", "error", err)
 	}
+	logging.Setup(cfg.Log)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	router := gin.Default()
-
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
-
-	router.GET("/healthz", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
-	router.GET("/readyz", func(c *gin.Context) {
-		if services.AppFileService == nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready"})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{"status": "ready"})
-	})
-
-	client := configs.ConnectDB(ctx)
-	db := client.Database("telegram_storage")
-
-	botTokensStr := os.Getenv("BOT_TOKENS")
-	var botTokens []string
-	if botTokensStr != "" {
-		botTokens = strings.Split(botTokensStr, ",")
-		for i := range botTokens {
-			botTokens[i] = strings.TrimSpace(botTokens[i])
-		}
-	} else {
-		log.Println("[WARN] BOT_TOKENS not found, falling back to BOT_1_TOKEN, BOT_2_TOKEN, etc.")
-		botTokens = []string{
-			os.Getenv("BOT_1_TOKEN"),
-			os.Getenv("BOT_2_TOKEN"),
-			os.Getenv("BOT_3_TOKEN"),
-			os.Getenv("BOT_4_TOKEN"),
-			os.Getenv("BOT_5_TOKEN"),
-			os.Getenv("BOT_6_TOKEN"),
-			os.Getenv("BOT_7_TOKEN"),
-		}
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		logging.Fatal("Failed to set up tracing", "error", err)
 	}
 
-	botPool, err := bot.NewBotPool(botTokens)
+	client := configs.ConnectDB(ctx, cfg.Mongo)
+	db := client.Database(cfg.Mongo.Database)
+
+	botPool, err := bot.NewBotPool(cfg.Telegram.BotTokens)
 	if err != nil {
-		log.Fatalf("Failed to initialize bot pool: %v", err)
+		logging.Fatal("Failed to initialize bot pool", "error", err)
 	}
-	log.Printf("Bot pool initialized with %d bots", len(botPool.GetAllBots()))
+	slog.Info("Bot pool initialized", "bots", len(botPool.GetAllBots()))
 
 	if err := configs.SetupIndexes(db); err != nil {
-		log.Printf("[WARN] Failed to setup indexes: %v (continuing anyway)", err)
+		slog.Warn("Failed to set up indexes, continuing anyway", "error", err)
 	}
 
-	services.AppFileService = services.NewFileService(botPool, db)
-	log.Println("FileService initialized")
+	services.AppFileService = services.NewFileService(botPool, db, cfg.Storage)
+	controllers.Telegram = cfg.Telegram
+	slog.Info("FileService initialized")
 
-	router.POST("/init", controllers.InitNewUpload)
-	router.POST("/upload", controllers.UploadChunk)
-	router.POST("/complete", controllers.CompleteUpload)
-	router.GET("/files", controllers.ListFiles)
-	router.GET("/download/:fileID", controllers.GetFile)
+	go services.AppFileService.StartScrubber(ctx)
+	go services.AppFileService.StartPacker(ctx)
+	go services.AppFileService.StartSpoolSweeper(ctx)
+	go services.AppFileService.StartUploadExpiry(ctx, cfg.Telegram.GroupID)
+	services.AppFileService.StartJobs(ctx)
+
+	router := controllers.NewRouter(cfg.Server.CORSOrigins)
 
 	srv := &http.Server{
-		Addr:    ":80",
+		Addr:    cfg.Server.Addr,
 		Handler: router,
 	}
 
 	go func() {
-		log.Println("Server starting on :80")
+		slog.Info("Server starting", "addr", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed to start: %v", err)
+			logging.Fatal("Server failed to start", "error", err)
 		}
 	}()
 
@@ -107,20 +76,34 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 
 	cancel()
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer shutdownCancel()
 
 	if err := srv.Shutdown(shutdownCtx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shut down", "error", err)
+	}
+
+	// Packed files exist only in the local spool until their pack is sealed
+	if err := services.AppFileService.SealOpenPack(shutdownCtx); err != nil {
+		slog.Error("Failed to seal open pack, it is sealed on the next start", "error", err)
+	}
+
+	// Running jobs are handed back to the queue as their handlers return
+	if err := services.AppFileService.WaitJobs(shutdownCtx); err != nil {
+		slog.Error("Failed to stop jobs", "error", err)
 	}
 
 	if err := client.Disconnect(shutdownCtx); err != nil {
-		log.Printf("Error disconnecting from MongoDB: %v", err)
+		slog.Error("Failed to disconnect from MongoDB", "error", err)
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
 	}
 
-	log.Println("Server exited gracefully")
+	slog.Info("Server exited gracefully")
 }
@@ -0,0 +1,143 @@
+// Package metrics holds the Prometheus metrics served on /metrics.
+//
+// Bots are labelled by username. Tokens must never appear in a label.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const namespace = "tgstorage"
+
+// Outcomes of a Telegram request.
+const (
+	OutcomeOK          = "ok"
+	OutcomeError       = "error"
+	OutcomeRateLimited = "rate_limited"
+)
+
+// Chunks are up to 50MB (services.MaxChunkSize) and a send can take minutes
+// on a slow link.
+var transferBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 180, 300}
+
+var (
+	UploadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Bytes sent to Telegram, after compression.",
+	}, []string{"bot"})
+
+	UploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Time to send one chunk to Telegram.",
+		Buckets:   transferBuckets,
+	}, []string{"bot", "outcome"})
+
+	DownloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_total",
+		Help:      "Bytes read from the Telegram file server.",
+	}, []string{"bot"})
+
+	DownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_duration_seconds",
+		Help:      "Time to download one chunk from Telegram.",
+		Buckets:   transferBuckets,
+	}, []string{"bot", "outcome"})
+
+	TelegramRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_requests_total",
+		Help:      "Telegram requests by bot, method and outcome (ok, error, rate_limited).",
+	}, []string{"bot", "method", "outcome"})
+
+	UploadRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_retries_total",
+		Help:      "Upload attempts after the first.",
+	})
+
+	DownloadLimiterWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_limiter_wait_seconds",
+		Help:      "Time spent waiting on the download rate limiter.",
+		Buckets:   []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+
+	AssembliesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "assemblies_in_flight",
+		Help:      "Files or ranges currently being assembled.",
+	})
+
+	BufferedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffered_bytes",
+		Help:      "Chunk bytes held in memory, by budget (assemble, readahead).",
+	}, []string{"budget"})
+
+	MongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mongo_command_duration_seconds",
+		Help:      "MongoDB command latency by command and outcome.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command", "outcome"})
+)
+
+// Outcome classifies the result of a Telegram request. 429s are counted
+// separately because they mean a bot is being throttled; they are recognised
+// by the *tgbotapi.Error Telegram returns, also when wrapped by services.
+func Outcome(err error) string {
+	if err == nil {
+		return OutcomeOK
+	}
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) && tgErr.Code == http.StatusTooManyRequests {
+		return OutcomeRateLimited
+	}
+	return OutcomeError
+}
+
+// StatusOutcome classifies an HTTP response from the Telegram file server.
+func StatusOutcome(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return OutcomeRateLimited
+	case status >= 200 && status < 300:
+		return OutcomeOK
+	default:
+		return OutcomeError
+	}
+}
+
+// ObserveTelegram counts one Telegram request made by bot.
+func ObserveTelegram(bot, method, outcome string) {
+	TelegramRequests.WithLabelValues(bot, method, outcome).Inc()
+}
+
+// MongoMonitor records the latency of every command the driver runs.
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			MongoDuration.WithLabelValues(e.CommandName, OutcomeOK).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			MongoDuration.WithLabelValues(e.CommandName, OutcomeError).Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// Since returns the seconds elapsed since start.
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
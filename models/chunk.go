@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// StoredChunk is a unique piece of content held in Telegram. Every FileChunk
+// with the same hash points at the same document, and the Telegram message is
+// only deleted once RefCount drops to zero.
+type StoredChunk struct {
+	Hash       string    `bson:"_id" json:"hash"`
+	FileID     string    `bson:"file_id" json:"file_id"`
+	MessageID  int       `bson:"message_id" json:"message_id"`
+	BotToken   string    `bson:"bot_token" json:"bot_token"`
+	GroupID    int64     `bson:"group_id" json:"group_id"`
+	Size       int64     `bson:"size" json:"size"`
+	Codec      string    `bson:"codec,omitempty" json:"codec,omitempty"`
+	StoredSize int64     `bson:"stored_size,omitempty" json:"stored_size,omitempty"`
+	RefCount   int       `bson:"ref_count" json:"ref_count"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `bson:"updated_at" json:"updated_at"`
+}
@@ -6,12 +6,39 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// File health as last determined by the scrubber
+const (
+	HealthHealthy  = "healthy"
+	HealthDegraded = "degraded" // some chunks missing but recoverable from parity
+	HealthLost     = "lost"     // data cannot be fully reassembled
+)
+
+// Storage modes recorded per file. Files created before storage modes existed
+// have an empty StorageMode and are treated as StorageModeStandard.
+const (
+	StorageModeStandard = "standard"
+	StorageModeErasure  = "erasure"
+	StorageModePacked   = "packed" // small file stored inside a shared pack document
+)
+
 type FileChunk struct {
 	Sequence  int    `bson:"sequence" json:"sequence"`
 	MessageID int    `bson:"message_id" json:"message_id"`
 	FileID    string `bson:"file_id" json:"file_id"`
 	BotToken  string `bson:"bot_token" json:"bot_token"`
 	Size      int64  `bson:"size" json:"size"`
+	GroupID   int64  `bson:"group_id,omitempty" json:"group_id,omitempty"`
+	Hash      string `bson:"hash,omitempty" json:"hash,omitempty"`     // hex SHA-256 of the chunk bytes
+	Offset    int64  `bson:"offset,omitempty" json:"offset,omitempty"` // byte offset in the file, set for content-defined chunks
+
+	// Compression. Size is always the uncompressed size; StoredSize is the
+	// size of the Telegram document when Codec is set.
+	Codec      string `bson:"codec,omitempty" json:"codec,omitempty"`
+	StoredSize int64  `bson:"stored_size,omitempty" json:"stored_size,omitempty"`
+
+	// Erasure coding position, only set on parity chunks
+	Stripe int `bson:"stripe,omitempty" json:"stripe,omitempty"`
+	Shard  int `bson:"shard,omitempty" json:"shard,omitempty"`
 }
 
 type FileMetadata struct {
@@ -23,4 +50,40 @@ type FileMetadata struct {
 	Chunks    []FileChunk        `bson:"chunks" json:"chunks"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+
+	StorageMode  string      `bson:"storage_mode,omitempty" json:"storage_mode,omitempty"`
+	DataShards   int         `bson:"data_shards,omitempty" json:"data_shards,omitempty"`
+	ParityShards int         `bson:"parity_shards,omitempty" json:"parity_shards,omitempty"`
+	ParityChunks []FileChunk `bson:"parity_chunks,omitempty" json:"parity_chunks,omitempty"`
+
+	// Content-defined chunking. Parts are the client uploads spooled until
+	// completion, when they are re-chunked into Chunks.
+	Chunking   string      `bson:"chunking,omitempty" json:"chunking,omitempty"`
+	CDCMinSize int64       `bson:"cdc_min_size,omitempty" json:"cdc_min_size,omitempty"`
+	CDCAvgSize int64       `bson:"cdc_avg_size,omitempty" json:"cdc_avg_size,omitempty"`
+	CDCMaxSize int64       `bson:"cdc_max_size,omitempty" json:"cdc_max_size,omitempty"`
+	Parts      []FileChunk `bson:"parts,omitempty" json:"parts,omitempty"`
+
+	Compression string `bson:"compression,omitempty" json:"compression,omitempty"`
+
+	Pack *PackRef `bson:"pack,omitempty" json:"pack,omitempty"` // set for StorageModePacked
+
+	Stream     *StreamInfo `bson:"stream,omitempty" json:"stream,omitempty"`         // HLS renditions of video files
+	Thumbnails []int       `bson:"thumbnails,omitempty" json:"thumbnails,omitempty"` // generated thumbnail sizes
+
+	ThumbnailError string `bson:"thumbnail_error,omitempty" json:"thumbnail_error,omitempty"` // why thumbnail generation gave up
+
+	Hash         string `bson:"hash,omitempty" json:"hash,omitempty"` // hex SHA-256 of the whole file
+	HashVerified bool   `bson:"hash_verified,omitempty" json:"hash_verified,omitempty"`
+
+	ManifestMessageID int `bson:"manifest_message_id,omitempty" json:"manifest_message_id,omitempty"`
+
+	Health         string     `bson:"health,omitempty" json:"health,omitempty"`
+	LastVerifiedAt *time.Time `bson:"last_verified_at,omitempty" json:"last_verified_at,omitempty"`
+	BadChunks      []int      `bson:"bad_chunks,omitempty" json:"bad_chunks,omitempty"`
+}
+
+// IsErasureCoded reports whether the file's chunks are protected by parity stripes.
+func (m *FileMetadata) IsErasureCoded() bool {
+	return m.StorageMode == StorageModeErasure && m.DataShards > 0 && m.ParityShards > 0
 }
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Job states. Queued jobs wait for RunAt; running jobs hold a lease that their
+// worker keeps extending. Dead jobs ran out of attempts and stay until an
+// operator retries them.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+	JobCancelled = "cancelled"
+)
+
+// Job is a unit of background work stored in the jobs collection.
+type Job struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Type        string             `bson:"type" json:"type"`
+	Status      string             `bson:"status" json:"status"`
+	Payload     bson.M             `bson:"payload,omitempty" json:"payload,omitempty"`
+	UniqueKey   string             `bson:"unique_key,omitempty" json:"unique_key,omitempty"` // at most one queued or running job per key
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	MaxAttempts int                `bson:"max_attempts" json:"max_attempts"`
+	RunAt       time.Time          `bson:"run_at" json:"run_at"`
+	Host        string             `bson:"host,omitempty" json:"host,omitempty"` // set for jobs only this host can run
+	LeaseOwner  string             `bson:"lease_owner,omitempty" json:"lease_owner,omitempty"`
+	LeaseUntil  *time.Time         `bson:"lease_until,omitempty" json:"lease_until,omitempty"`
+	LastError   string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	StartedAt   *time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	FinishedAt  *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
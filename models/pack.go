@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Pack states. An open pack is still accepting files and only exists in the
+// spool of the host that created it; a sealed pack is a Telegram document.
+const (
+	PackOpen   = "open"
+	PackSealed = "sealed"
+)
+
+// PackRef locates a small file inside a pack.
+type PackRef struct {
+	PackID primitive.ObjectID `bson:"pack_id" json:"pack_id"`
+	Offset int64              `bson:"offset" json:"offset"`
+	Length int64              `bson:"length" json:"length"`
+
+	// Location is the pack's Telegram document, set once the pack is sealed
+	Location *FileChunk `bson:"location,omitempty" json:"location,omitempty"`
+}
+
+// Pack is a Telegram document holding many small files back to back.
+type Pack struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Status    string             `bson:"status" json:"status"`
+	GroupID   int64              `bson:"group_id" json:"group_id"`
+	Size      int64              `bson:"size" json:"size"`             // bytes of file data, excluding the index
+	LiveBytes int64              `bson:"live_bytes" json:"live_bytes"` // bytes still referenced by files
+	Location  *FileChunk         `bson:"location,omitempty" json:"location,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	SealedAt  *time.Time         `bson:"sealed_at,omitempty" json:"sealed_at,omitempty"`
+}
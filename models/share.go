@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Share is a link that lets anyone holding its token download one file
+// without further credentials. Shares without ExpiresAt last until revoked
+// or the file is deleted.
+type Share struct {
+	Token     string             `bson:"_id" json:"token"`
+	FileID    primitive.ObjectID `bson:"file_id" json:"file_id"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Adaptive streaming states of a video file
+const (
+	StreamQueued     = "queued"
+	StreamProcessing = "processing"
+	StreamReady      = "ready"
+	StreamFailed     = "failed"
+)
+
+// HLSSegment is one media segment of a rendition, stored as a single chunk.
+type HLSSegment struct {
+	Duration float64   `bson:"duration" json:"duration"` // seconds
+	Chunk    FileChunk `bson:"chunk" json:"chunk"`
+}
+
+// HLSRendition is one quality level of a video.
+type HLSRendition struct {
+	Name           string       `bson:"name" json:"name"` // e.g. "720p"
+	Width          int          `bson:"width" json:"width"`
+	Height         int          `bson:"height" json:"height"`
+	Bandwidth      int          `bson:"bandwidth" json:"bandwidth"` // peak bits per second
+	TargetDuration int          `bson:"target_duration" json:"target_duration"`
+	Segments       []HLSSegment `bson:"segments" json:"segments"`
+}
+
+// StreamInfo tracks HLS processing of a video file. The renditions are
+// derived data: they are not part of the manifest and can always be
+// regenerated from the original.
+type StreamInfo struct {
+	Status     string         `bson:"status" json:"status"`
+	Error      string         `bson:"error,omitempty" json:"error,omitempty"`
+	GroupID    int64          `bson:"group_id" json:"-"` // where segments are uploaded
+	Renditions []HLSRendition `bson:"renditions,omitempty" json:"renditions,omitempty"`
+	QueuedAt   time.Time      `bson:"queued_at" json:"queued_at"`
+	UpdatedAt  time.Time      `bson:"updated_at" json:"updated_at"`
+}
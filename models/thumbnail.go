@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Thumbnail is a JPEG preview of a file, at most Size pixels on its longer
+// edge. Thumbnails are derived data and are regenerated when missing.
+type Thumbnail struct {
+	ID        string             `bson:"_id" json:"id"` // "<file id>_<size>"
+	FileID    primitive.ObjectID `bson:"file_id" json:"file_id"`
+	Size      int                `bson:"size" json:"size"`
+	Width     int                `bson:"width" json:"width"`
+	Height    int                `bson:"height" json:"height"`
+	Data      []byte             `bson:"data" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
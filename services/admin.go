@@ -0,0 +1,262 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"telegram-storage/metrics"
+	"telegram-storage/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/time/rate"
+)
+
+// Maintenance operations used by the admin API and tgstorectl.
+
+// DB returns the metadata database, e.g. to set up its indexes.
+func (s *FileService) DB() *mongo.Database {
+	return s.db
+}
+
+// GetStoredChunk returns the chunks collection record for a content hash.
+func (s *FileService) GetStoredChunk(ctx context.Context, hash string) (*models.StoredChunk, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var stored models.StoredChunk
+	err := s.db.Collection("chunks").FindOne(ctx, bson.M{"_id": hash}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, errorf(ErrNotFound, "chunk not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk: %w", err)
+	}
+	return &stored, nil
+}
+
+// ListUploads returns pending uploads created more than olderThan ago, oldest
+// first.
+func (s *FileService) ListUploads(ctx context.Context, olderThan time.Duration) ([]models.FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"status": "pending", "created_at": bson.M{"$lte": time.Now().Add(-olderThan)}}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := s.db.Collection("files").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploads: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	uploads := []models.FileMetadata{}
+	if err := cursor.All(ctx, &uploads); err != nil {
+		return nil, fmt.Errorf("failed to decode uploads: %w", err)
+	}
+	return uploads, nil
+}
+
+// PurgeUploads deletes pending uploads created more than olderThan ago,
+// releasing the chunks they already sent. StartUploadExpiry runs it for
+// uploads older than UploadConfig.PendingTTL.
+func (s *FileService) PurgeUploads(ctx context.Context, olderThan time.Duration, defaultGroupID int64) ([]models.Job, error) {
+	uploads, err := s.ListUploads(ctx, olderThan)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []models.Job{}
+	for _, upload := range uploads {
+		job, err := s.DeleteFile(ctx, upload.ID.Hex(), defaultGroupID)
+		if err != nil {
+			return jobs, fmt.Errorf("failed to purge upload %s: %w", upload.ID.Hex(), err)
+		}
+		jobs = append(jobs, *job)
+	}
+	slog.InfoContext(ctx, "Uploads purged", "older_than", olderThan, "count", len(jobs))
+	return jobs, nil
+}
+
+// StartUploadExpiry queues an expire_uploads job immediately and then every
+// uploadExpiryInterval until ctx is cancelled. Abandoned uploads hold chunk
+// references and Telegram messages, so they are deleted through the same
+// path as any other file rather than dropped from the database.
+func (s *FileService) StartUploadExpiry(ctx context.Context, defaultGroupID int64) {
+	ticker := time.NewTicker(uploadExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		_, _, err := s.jobs.Enqueue(ctx, JobTypeExpireUploads, bson.M{"group_id": defaultGroupID},
+			JobOptions{UniqueKey: JobTypeExpireUploads, MaxAttempts: 1})
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to queue upload expiry", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+const uploadExpiryInterval = time.Hour
+
+// VerifyFile checks every chunk of a file right away, like the scrubber
+// does, and returns the file with its updated health.
+func (s *FileService) VerifyFile(ctx context.Context, fileID string, verifyHash bool) (*models.FileMetadata, error) {
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Status != "completed" {
+		return nil, errorf(ErrConflict, "file upload not completed")
+	}
+	if err := s.ScrubFile(ctx, metadata, rate.NewLimiter(rate.Inf, 1), verifyHash); err != nil {
+		return nil, err
+	}
+	return s.GetFileMetadata(ctx, fileID)
+}
+
+// BotStatus is the result of checking one bot of the pool.
+type BotStatus struct {
+	Username string        `json:"username"`
+	OK       bool          `json:"ok"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// CheckBots calls getMe with every bot in the pool.
+func (s *FileService) CheckBots(ctx context.Context) []BotStatus {
+	statuses := []BotStatus{}
+	for _, b := range s.botPool.GetAllBots() {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		_, err := b.GetMe()
+		metrics.ObserveTelegram(b.Self.UserName, "getMe", metrics.Outcome(err))
+
+		status := BotStatus{Username: b.Self.UserName, OK: err == nil, Latency: time.Since(start)}
+		if err != nil {
+			status.Error = telegramError(err).Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// ReuploadChunk sends a local copy of a data chunk to Telegram and points
+// every file using the chunk's old document at the new one. It is meant for
+// chunks the scrubber reported lost; data must match the recorded size and
+// hash. The old message is deleted if it still exists.
+func (s *FileService) ReuploadChunk(ctx context.Context, fileID string, sequence int, data io.Reader, size int64, groupID int64) (*models.FileChunk, error) {
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Pack != nil {
+		return nil, errorf(ErrInvalidArgument, "packed files have no chunks of their own")
+	}
+
+	var old *models.FileChunk
+	for i := range metadata.Chunks {
+		if metadata.Chunks[i].Sequence == sequence {
+			old = &metadata.Chunks[i]
+			break
+		}
+	}
+	if old == nil {
+		return nil, errorf(ErrNotFound, "file has no chunk %d", sequence)
+	}
+	if size != old.Size {
+		return nil, errorf(ErrInvalidArgument, "chunk %d is %d bytes, got %d", sequence, old.Size, size)
+	}
+
+	data, hash, err := hashChunk(data)
+	if err != nil {
+		return nil, err
+	}
+	if old.Hash != "" && hash != old.Hash {
+		return nil, errorf(ErrConflict, "data does not match chunk %d: expected hash %s, got %s", sequence, old.Hash, hash)
+	}
+
+	chunk := *old
+	chunk.Hash = hash
+	chunk.Codec, chunk.StoredSize = "", 0
+	var stored io.Reader = data
+	if s.cfg.Compression == CompressionZstd {
+		compressed, codec, err := compressChunk(data)
+		if err != nil {
+			return nil, err
+		}
+		stored = bytes.NewReader(compressed)
+		if codec != "" {
+			chunk.Codec, chunk.StoredSize = codec, int64(len(compressed))
+		}
+	}
+
+	caption := fmt.Sprintf("ID: %s\nPart: %d", fileID, sequence)
+	if chunk.Codec != "" {
+		caption += fmt.Sprintf("\nCodec: %s\nSize: %d", chunk.Codec, size)
+	}
+	err = s.withRetry(ctx, fmt.Sprintf("Chunk %d", sequence), stored, func(attempt int) error {
+		currentBot := s.botPool.GetNextBot()
+		if currentBot == nil {
+			return errorf(ErrUpstreamUnavailable, "no bots available")
+		}
+		msg, err := sendDocument(ctx, currentBot, groupID, fmt.Sprintf("chunk_%s_%d", fileID, sequence), caption, stored)
+		if err != nil {
+			return err
+		}
+		chunk.MessageID = msg.MessageID
+		chunk.FileID = msg.Document.FileID
+		chunk.BotToken = currentBot.Self.UserName
+		chunk.GroupID = groupID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dbCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	location := bson.M{
+		"file_id":     chunk.FileID,
+		"message_id":  chunk.MessageID,
+		"bot_token":   chunk.BotToken,
+		"group_id":    chunk.GroupID,
+		"codec":       chunk.Codec,
+		"stored_size": chunk.StoredSize,
+	}
+	set := bson.M{"updated_at": time.Now()}
+	for field, value := range location {
+		set["chunks.$[c]."+field] = value
+	}
+	set["chunks.$[c].hash"] = hash
+	res, err := s.db.Collection("files").UpdateMany(dbCtx,
+		bson.M{"chunks.file_id": old.FileID},
+		bson.M{"$set": set},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"c.file_id": old.FileID}}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update files: %w", err)
+	}
+
+	location["updated_at"] = time.Now()
+	if _, err := s.db.Collection("chunks").UpdateOne(dbCtx,
+		bson.M{"_id": hash, "file_id": old.FileID}, bson.M{"$set": location}); err != nil {
+		return nil, fmt.Errorf("failed to update chunk record: %w", err)
+	}
+
+	if err := s.deleteChunkMessage(*old, groupID); err != nil {
+		slog.DebugContext(ctx, "Old chunk message not deleted", "file_id", fileID, "sequence", sequence, "error", err)
+	}
+	slog.InfoContext(ctx, "Chunk re-uploaded", "file_id", fileID, "sequence", sequence, "bot", chunk.BotToken,
+		"message_id", chunk.MessageID, "files_updated", res.ModifiedCount)
+	return &chunk, nil
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"telegram-storage/metrics"
+	"telegram-storage/models"
+	"time"
+)
+
+// Files are assembled with a small prefetch window. The chunk at the write
+// position is streamed straight from Telegram to the client; the chunks after
+// it are fetched ahead into memory while the shared memory budget allows, and
+// otherwise spilled to temp files (or simply fetched when their turn comes if
+// spilling is disabled). Memory use is therefore bounded by the budget no
+// matter how many downloads run at once, and cancelling the request context
+// stops every fetch belonging to it.
+
+// AssembleConfig controls file assembly.
+type AssembleConfig struct {
+	MemoryBudget int64 `yaml:"memory_budget" env:"ASSEMBLE_MEMORY_BUDGET"` // bytes of prefetched chunks held in memory across all downloads
+	Window       int   `yaml:"window" env:"ASSEMBLE_WINDOW"`               // chunks fetched concurrently per download, including the one being streamed
+	Spill        bool  `yaml:"spill" env:"ASSEMBLE_SPILL"`                 // spill prefetched chunks to disk when the memory budget is exhausted
+}
+
+func defaultAssembleConfig() AssembleConfig {
+	return AssembleConfig{MemoryBudget: 256 << 20, Window: 8, Spill: true}
+}
+
+// memoryBudget is a byte budget that is only ever acquired without waiting,
+// so a download can never block on memory held by another download.
+type memoryBudget struct {
+	name  string // metrics label
+	mu    sync.Mutex
+	used  int64
+	limit int64
+}
+
+func (b *memoryBudget) tryAcquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	metrics.BufferedBytes.WithLabelValues(b.name).Set(float64(b.used))
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	metrics.BufferedBytes.WithLabelValues(b.name).Set(float64(b.used))
+	b.mu.Unlock()
+}
+
+// prefetched is a chunk fetched ahead of the write position.
+type prefetched struct {
+	done    chan struct{}
+	data    []byte        // held in memory against budget
+	held    int64         // budget bytes held
+	budget  *memoryBudget // assembly or read-ahead budget
+	file    *os.File      // spilled to disk
+	skipped bool          // no memory and no spill: fetch when its turn comes
+	err     error
+}
+
+func (p *prefetched) writeTo(w io.Writer) error {
+	if p.file != nil {
+		if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind spilled chunk: %w", err)
+		}
+		_, err := io.Copy(w, p.file)
+		return err
+	}
+	_, err := w.Write(p.data)
+	return err
+}
+
+func (s *FileService) releasePrefetched(p *prefetched) {
+	if p.held > 0 {
+		p.budget.release(p.held)
+		p.held = 0
+	}
+	p.data = nil
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+		p.file = nil
+	}
+}
+
+// rangeWriter passes on only the bytes of a chunk inside [skip, skip+limit)
+// and discards the rest, so whole chunks can be copied into a range response.
+type rangeWriter struct {
+	w     io.Writer
+	skip  int64
+	limit int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if r.skip > 0 {
+		drop := min(r.skip, int64(len(p)))
+		p = p[drop:]
+		r.skip -= drop
+	}
+	if int64(len(p)) > r.limit {
+		p = p[:r.limit]
+	}
+	if len(p) > 0 {
+		written, err := r.w.Write(p)
+		r.limit -= int64(written)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fetchChunk writes the original bytes of a chunk to w, reconstructing it
+// from parity when the download of an erasure-coded file fails part way.
+func (s *FileService) fetchChunk(ctx context.Context, metadata *models.FileMetadata, chunks []models.FileChunk, c models.FileChunk, w io.Writer) error {
+	cw := &countingWriter{w: w}
+	err := s.DownloadChunk(ctx, c, cw)
+	if err == nil || !metadata.IsErasureCoded() || ctx.Err() != nil {
+		return err
+	}
+
+	slog.WarnContext(ctx, "Chunk download failed, reconstructing from parity", "sequence", c.Sequence, "error", err)
+	data, err := s.reconstructChunk(ctx, metadata, chunks, c.Sequence)
+	if err != nil {
+		return err
+	}
+	if cw.n > int64(len(data)) {
+		return fmt.Errorf("chunk %d is shorter than recorded", c.Sequence)
+	}
+	_, err = cw.Write(data[cw.n:])
+	return err
+}
+
+// prefetch starts fetching a chunk ahead of the write position.
+func (s *FileService) prefetch(ctx context.Context, metadata *models.FileMetadata, chunks []models.FileChunk, c models.FileChunk) *prefetched {
+	p := &prefetched{done: make(chan struct{})}
+
+	inMemory := s.assembleBudget.tryAcquire(c.Size)
+	if !inMemory && !s.assembleCfg.Spill {
+		p.skipped = true
+		close(p.done)
+		return p
+	}
+
+	go func() {
+		defer close(p.done)
+
+		if inMemory {
+			p.held, p.budget = c.Size, s.assembleBudget
+			buf := bytes.NewBuffer(make([]byte, 0, c.Size))
+			if p.err = s.fetchChunk(ctx, metadata, chunks, c, buf); p.err == nil {
+				p.data = buf.Bytes()
+			}
+			return
+		}
+
+		dir := filepath.Join(s.spoolDir, "assemble")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			p.err = fmt.Errorf("failed to create spill dir: %w", err)
+			return
+		}
+		f, err := os.CreateTemp(dir, "chunk-*")
+		if err != nil {
+			p.err = fmt.Errorf("failed to create spill file: %w", err)
+			return
+		}
+		p.file = f
+		p.err = s.fetchChunk(ctx, metadata, chunks, c, f)
+	}()
+	return p
+}
+
+// assembleRange writes a byte range of a file. sess, when not nil, supplies
+// chunks buffered by read-ahead and is told where the request stopped.
+func (s *FileService) assembleRange(ctx context.Context, metadata *models.FileMetadata, offset, length int64, writer io.Writer, sess *readAheadSession) error {
+	if metadata.StorageMode == models.StorageModePacked {
+		return s.readPacked(ctx, metadata, offset, length, writer)
+	}
+
+	chunks := uniqueChunks(metadata.Chunks)
+	if len(chunks) == 0 || length == 0 {
+		return nil
+	}
+
+	// Only the chunks overlapping [offset, offset+length) are fetched
+	offsets := chunkOffsets(chunks)
+	end := offset + length
+	first := sort.Search(len(chunks), func(i int) bool { return offsets[i]+chunks[i].Size > offset })
+	last := sort.Search(len(chunks), func(i int) bool { return offsets[i] >= end })
+	selected := chunks[first:last]
+
+	metrics.AssembliesInFlight.Inc()
+	defer metrics.AssembliesInFlight.Dec()
+
+	if sess != nil {
+		// Buffer what follows the range while it is being served
+		s.fillReadAhead(sess, metadata, chunks, first, last)
+		counted := &countingWriter{w: writer}
+		writer = counted
+		defer func() { s.endReadAhead(sess, metadata, chunks, offsets, offset+counted.n) }()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pending := make(map[int]*prefetched)
+	defer func() {
+		// Stop outstanding fetches and give back what they hold
+		cancel()
+		for _, p := range pending {
+			<-p.done
+			s.releasePrefetched(p)
+		}
+	}()
+
+	startTime := time.Now()
+	slog.DebugContext(ctx, "Assembling file", "file_id", metadata.ID.Hex(), "name", metadata.Name,
+		"offset", offset, "length", length, "chunks", len(selected), "window", s.assembleCfg.Window)
+
+	var totalWritten int64
+	for i, c := range selected {
+		for j := i + 1; j < min(len(selected), i+s.assembleCfg.Window); j++ {
+			if pending[j] == nil && !sess.has(s.readAhead, first+j) {
+				pending[j] = s.prefetch(ctx, metadata, chunks, selected[j])
+			}
+		}
+
+		chunkStart := offsets[first+i]
+		skip := max(offset-chunkStart, 0)
+		limit := min(end, chunkStart+c.Size) - chunkStart - skip
+		out := &countingWriter{w: &rangeWriter{w: writer, skip: skip, limit: limit}}
+
+		var err error
+		p := pending[i]
+		delete(pending, i)
+		if p == nil {
+			p = sess.take(s.readAhead, first+i)
+		}
+		if p != nil {
+			<-p.done
+			if p.skipped {
+				err = s.fetchChunk(ctx, metadata, chunks, c, out)
+			} else if err = p.err; err == nil {
+				err = p.writeTo(out)
+			}
+			s.releasePrefetched(p)
+		} else {
+			err = s.fetchChunk(ctx, metadata, chunks, c, out)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed chunk %d: %w", c.Sequence, err)
+		}
+		if out.n < c.Size {
+			return fmt.Errorf("chunk %d is shorter than recorded", c.Sequence)
+		}
+		totalWritten += limit
+	}
+
+	slog.DebugContext(ctx, "File assembled", "file_id", metadata.ID.Hex(), "bytes", totalWritten, "duration", time.Since(startTime))
+	return nil
+}
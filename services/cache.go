@@ -0,0 +1,334 @@
+package services
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The chunk cache keeps the original bytes of recently used chunks on local
+// disk, keyed by their SHA-256, so popular files do not have to be fetched
+// from Telegram again. Entries are evicted least recently used first once the
+// cache exceeds MaxBytes, expire after TTL, and are re-hashed on every read so
+// a corrupted file is dropped instead of served. Chunks without a recorded
+// hash are never cached.
+
+// ChunkCacheConfig controls the chunk cache.
+type ChunkCacheConfig struct {
+	Dir          string        `yaml:"dir" env:"CACHE_DIR"`                     // empty means <spool>/cache
+	MaxBytes     int64         `yaml:"max_bytes" env:"CACHE_MAX_BYTES"`         // 0 disables the cache
+	TTL          time.Duration `yaml:"ttl" env:"CACHE_TTL"`                     // 0 keeps entries until evicted
+	WriteThrough bool          `yaml:"write_through" env:"CACHE_WRITE_THROUGH"` // cache chunks as they are uploaded
+}
+
+func defaultChunkCacheConfig() ChunkCacheConfig {
+	return ChunkCacheConfig{WriteThrough: true}
+}
+
+// CacheStats reports chunk cache usage.
+type CacheStats struct {
+	Enabled   bool  `json:"enabled"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Writes    int64 `json:"writes"`
+	Evictions int64 `json:"evictions"`
+	Expired   int64 `json:"expired"`
+	Corrupt   int64 `json:"corrupt"`
+}
+
+type cacheEntry struct {
+	hash     string
+	size     int64
+	storedAt time.Time
+	elem     *list.Element
+}
+
+type chunkCache struct {
+	cfg ChunkCacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List // front = most recently used
+	stats   CacheStats
+}
+
+// newChunkCache opens the cache directory and indexes what is already there.
+// It returns nil when the cache is disabled.
+func newChunkCache(cfg ChunkCacheConfig) (*chunkCache, error) {
+	if cfg.MaxBytes <= 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+
+	c := &chunkCache{
+		cfg:     cfg,
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+		stats:   CacheStats{Enabled: true, MaxBytes: cfg.MaxBytes},
+	}
+
+	dirEntries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache dir: %w", err)
+	}
+	type found struct {
+		hash    string
+		size    int64
+		modTime time.Time
+	}
+	var existing []found
+	for _, de := range dirEntries {
+		path := filepath.Join(cfg.Dir, de.Name())
+		if !sha256Hex.MatchString(de.Name()) {
+			// Leftover temp file from an interrupted write
+			os.Remove(path)
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		existing = append(existing, found{de.Name(), info.Size(), info.ModTime()})
+	}
+	// Oldest first, so the newest end up at the front of the LRU list
+	sort.Slice(existing, func(i, j int) bool { return existing[i].modTime.Before(existing[j].modTime) })
+	for _, f := range existing {
+		c.insertLocked(f.hash, f.size, f.modTime)
+	}
+	c.evictLocked()
+
+	slog.Info("Chunk cache opened", "dir", cfg.Dir, "entries", len(c.entries), "bytes", c.stats.Bytes, "max_bytes", cfg.MaxBytes)
+	return c, nil
+}
+
+func (c *chunkCache) path(hash string) string {
+	return filepath.Join(c.cfg.Dir, hash)
+}
+
+func (c *chunkCache) insertLocked(hash string, size int64, storedAt time.Time) {
+	if old, ok := c.entries[hash]; ok {
+		c.lru.Remove(old.elem)
+		c.stats.Bytes -= old.size
+	}
+	e := &cacheEntry{hash: hash, size: size, storedAt: storedAt}
+	e.elem = c.lru.PushFront(e)
+	c.entries[hash] = e
+	c.stats.Bytes += size
+	c.stats.Entries = len(c.entries)
+}
+
+func (c *chunkCache) removeLocked(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.hash)
+	c.stats.Bytes -= e.size
+	c.stats.Entries = len(c.entries)
+	os.Remove(c.path(e.hash))
+}
+
+func (c *chunkCache) evictLocked() {
+	for c.stats.Bytes > c.cfg.MaxBytes {
+		back := c.lru.Back()
+		if back == nil {
+			return
+		}
+		c.removeLocked(back.Value.(*cacheEntry))
+		c.stats.Evictions++
+	}
+}
+
+// get copies a cached chunk to w. It reports false without writing anything
+// on a miss, an expired entry or a failed integrity check.
+func (c *chunkCache) get(hash string, size int64, w io.Writer) (bool, error) {
+	c.mu.Lock()
+	e, ok := c.entries[hash]
+	switch {
+	case !ok || e.size != size:
+		c.stats.Misses++
+		c.mu.Unlock()
+		return false, nil
+	case c.cfg.TTL > 0 && time.Since(e.storedAt) > c.cfg.TTL:
+		c.removeLocked(e)
+		c.stats.Expired++
+		c.stats.Misses++
+		c.mu.Unlock()
+		return false, nil
+	}
+	c.lru.MoveToFront(e.elem)
+	c.mu.Unlock()
+
+	f, err := os.Open(c.path(hash))
+	if err != nil {
+		c.drop(hash, false)
+		return false, nil
+	}
+	defer f.Close()
+
+	// Verify before writing so a corrupt entry never reaches the client
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil || hex.EncodeToString(hasher.Sum(nil)) != hash {
+		slog.Warn("Cache entry failed integrity check, dropping", "hash", hash)
+		c.drop(hash, true)
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, nil
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return true, fmt.Errorf("failed to write cached chunk: %w", err)
+	}
+
+	c.mu.Lock()
+	c.stats.Hits++
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *chunkCache) drop(hash string, corrupt bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[hash]; ok {
+		c.removeLocked(e)
+	}
+	if corrupt {
+		c.stats.Corrupt++
+	}
+	c.stats.Misses++
+}
+
+// writer returns a cacheWriter that stores whatever is written to it under
+// hash once commit is called, or nil if the chunk should not be cached.
+func (c *chunkCache) writer(hash string, size int64) *cacheWriter {
+	if hash == "" || size > c.cfg.MaxBytes {
+		return nil
+	}
+	c.mu.Lock()
+	_, cached := c.entries[hash]
+	c.mu.Unlock()
+	if cached {
+		return nil
+	}
+
+	f, err := os.CreateTemp(c.cfg.Dir, "tmp-*")
+	if err != nil {
+		slog.Warn("Failed to create cache file", "error", err)
+		return nil
+	}
+	return &cacheWriter{cache: c, hash: hash, file: f, hasher: sha256.New()}
+}
+
+// put stores a chunk read from r.
+func (c *chunkCache) put(hash string, size int64, r io.Reader) {
+	cw := c.writer(hash, size)
+	if cw == nil {
+		return
+	}
+	if _, err := io.Copy(cw, r); err != nil {
+		cw.abort()
+		return
+	}
+	cw.commit()
+}
+
+func (c *chunkCache) remove(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[hash]; ok {
+		c.removeLocked(e)
+	}
+}
+
+// purge drops every entry and returns how many were removed.
+func (c *chunkCache) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	for _, e := range c.entries {
+		c.removeLocked(e)
+	}
+	return n
+}
+
+func (c *chunkCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// cacheWriter spools a chunk to a temp file and adds it to the cache only if
+// the bytes match the expected hash.
+type cacheWriter struct {
+	cache  *chunkCache
+	hash   string
+	file   *os.File
+	hasher hash.Hash
+	size   int64
+	failed bool
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	// Cache failures never fail the download
+	if !w.failed {
+		if _, err := w.file.Write(p); err != nil {
+			w.failed = true
+		}
+		w.hasher.Write(p)
+		w.size += int64(len(p))
+	}
+	return len(p), nil
+}
+
+func (w *cacheWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (w *cacheWriter) commit() {
+	sum := hex.EncodeToString(w.hasher.Sum(nil))
+	if err := w.file.Close(); err != nil || w.failed || sum != w.hash {
+		os.Remove(w.file.Name())
+		return
+	}
+
+	c := w.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(w.file.Name(), c.path(w.hash)); err != nil {
+		os.Remove(w.file.Name())
+		return
+	}
+	c.insertLocked(w.hash, w.size, time.Now())
+	c.stats.Writes++
+	c.evictLocked()
+}
+
+// CacheStats returns chunk cache statistics.
+func (s *FileService) CacheStats() CacheStats {
+	if s.cache == nil {
+		return CacheStats{}
+	}
+	return s.cache.snapshot()
+}
+
+// PurgeCache empties the chunk cache.
+func (s *FileService) PurgeCache() int {
+	if s.cache == nil {
+		return 0
+	}
+	n := s.cache.purge()
+	slog.Info("Cache purged", "entries", n)
+	return n
+}
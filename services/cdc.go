@@ -0,0 +1,358 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"os"
+	"sync"
+	"telegram-storage/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Content-defined chunking (FastCDC with normalized chunking). Clients upload
+// arbitrary parts which are spooled; at completion the server re-chunks the
+// byte stream at content-defined boundaries, so an insertion only changes the
+// chunks around it and the rest deduplicate against earlier versions.
+
+const (
+	ChunkingFixed = "fixed"
+	ChunkingCDC   = "cdc"
+
+	MinCDCChunkSize     = 64 * 1024
+	MaxCDCChunksPerFile = 20000
+)
+
+// CDCParams bounds the size of content-defined chunks.
+type CDCParams struct {
+	MinSize int64 `yaml:"min_size" env:"CDC_MIN_SIZE"`
+	AvgSize int64 `yaml:"avg_size" env:"CDC_AVG_SIZE"`
+	MaxSize int64 `yaml:"max_size" env:"CDC_MAX_SIZE"`
+}
+
+// DefaultCDCParams are the chunk sizes used when neither the configuration
+// nor the client chooses any: 1 MB / 4 MB / 16 MB.
+func DefaultCDCParams() CDCParams {
+	return CDCParams{MinSize: 1 << 20, AvgSize: 4 << 20, MaxSize: 16 << 20}
+}
+
+func (p CDCParams) validate() error {
+	if p.MinSize < MinCDCChunkSize || p.MinSize >= p.AvgSize || p.AvgSize >= p.MaxSize || p.MaxSize > MaxChunkSize {
+		return errorf(ErrInvalidArgument, "invalid CDC sizes: need %d <= min < avg < max <= %d (got %d/%d/%d)",
+			MinCDCChunkSize, MaxChunkSize, p.MinSize, p.AvgSize, p.MaxSize)
+	}
+	return nil
+}
+
+// gearTable holds the 256 random values of the gear hash. It is generated
+// from a fixed seed with splitmix64 and must never change, or chunk
+// boundaries (and with them deduplication) would shift for existing data.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cdcChunker splits a stream into content-defined chunks.
+type cdcChunker struct {
+	r      io.Reader
+	params CDCParams
+	maskS  uint64 // stricter mask used before the average size
+	maskL  uint64 // looser mask used after it
+	buf    []byte
+	n      int
+	eof    bool
+}
+
+func newCDCChunker(r io.Reader, params CDCParams) *cdcChunker {
+	avgBits := bits.Len64(uint64(params.AvgSize)) - 1
+	topBits := func(n int) uint64 { return ^uint64(0) << (64 - n) }
+	return &cdcChunker{
+		r:      r,
+		params: params,
+		maskS:  topBits(avgBits + 2),
+		maskL:  topBits(avgBits - 2),
+		buf:    make([]byte, params.MaxSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one.
+func (c *cdcChunker) Next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		read, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cutPoint(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	copy(c.buf, c.buf[cut:c.n])
+	c.n -= cut
+	return chunk, nil
+}
+
+func (c *cdcChunker) cutPoint(data []byte) int {
+	n := len(data)
+	minSize, avgSize := int(c.params.MinSize), int(c.params.AvgSize)
+	if n <= minSize {
+		return n
+	}
+	normal := min(avgSize, n)
+
+	var h uint64
+	i := minSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// uploadPart spools one client part of a CDC upload. Nothing is sent to
+// Telegram until the upload is completed.
+func (s *FileService) uploadPart(ctx context.Context, metadata *models.FileMetadata, sequence int, data io.Reader, size int64) (*models.FileChunk, error) {
+	if size > MaxChunkSize {
+		return nil, errorf(ErrTooLarge, "chunk size %d exceeds maximum %d", size, MaxChunkSize)
+	}
+	if metadata.Status != "pending" {
+		return nil, errorf(ErrConflict, "upload is %s", metadata.Status)
+	}
+	uploadID := metadata.ID.Hex()
+	path, err := s.spoolPart(uploadID, sequence, data)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat spooled part: %w", err)
+	}
+	if info.Size() != size {
+		return nil, errorf(ErrInvalidArgument, "part %d size mismatch: expected %d, got %d", sequence, size, info.Size())
+	}
+
+	part := models.FileChunk{Sequence: sequence, Size: size}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	// A re-sent part overwrites the spool file; its record is kept as is
+	_, err = s.db.Collection("files").UpdateOne(ctx,
+		bson.M{"_id": metadata.ID, "parts.sequence": bson.M{"$ne": sequence}},
+		bson.M{"$push": bson.M{"parts": part}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update db: %w", err)
+	}
+
+	slog.DebugContext(ctx, "Part spooled", "upload_id", uploadID, "sequence", sequence, "size", size)
+	return &part, nil
+}
+
+func (s *FileService) setChunkOffset(ctx context.Context, metadata *models.FileMetadata, sequence int, offset int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := s.db.Collection("files").UpdateOne(ctx,
+		bson.M{"_id": metadata.ID, "chunks.sequence": sequence},
+		bson.M{"$set": bson.M{"chunks.$.offset": offset}})
+	if err != nil {
+		return fmt.Errorf("failed to record offset: %w", err)
+	}
+	return nil
+}
+
+// chunkCDCUpload re-chunks the spooled parts of a CDC upload and uploads each
+// chunk through the normal (deduplicating) chunk path. Chunks already stored
+// by an earlier attempt are skipped by uploadChunkOnce, so a failed
+// completion can simply be retried.
+func (s *FileService) chunkCDCUpload(ctx context.Context, metadata *models.FileMetadata, groupID int64) error {
+	uploadID := metadata.ID.Hex()
+	parts := uniqueChunks(metadata.Parts)
+	if err := validateContiguousChunks(metadata, parts); err != nil {
+		return fmt.Errorf("upload incomplete: %w", err)
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		f, err := os.Open(s.spoolPartPath(uploadID, p.Sequence))
+		if err != nil {
+			return fmt.Errorf("part %d missing from spool: %w", p.Sequence, err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	params := CDCParams{MinSize: metadata.CDCMinSize, AvgSize: metadata.CDCAvgSize, MaxSize: metadata.CDCMaxSize}
+	chunker := newCDCChunker(io.MultiReader(readers...), params)
+
+	startTime := time.Now()
+	semaphore := make(chan struct{}, s.cfg.Upload.CDCWorkers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	var offset int64
+	sequence := 0
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			setErr(fmt.Errorf("failed to read parts: %w", err))
+			break
+		}
+		if sequence >= MaxCDCChunksPerFile {
+			setErr(fmt.Errorf("file produced more than %d chunks", MaxCDCChunksPerFile))
+			break
+		}
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		if metadata.IsErasureCoded() {
+			if _, err := s.spoolChunk(uploadID, sequence, bytes.NewReader(data)); err != nil {
+				setErr(err)
+				break
+			}
+		}
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(seq int, off int64, data []byte) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			_, err := s.uploadChunkWithRetry(ctx, uploadID, seq, bytes.NewReader(data), int64(len(data)), groupID, metadata.Compression)
+			if err == nil {
+				err = s.setChunkOffset(ctx, metadata, seq, off)
+			}
+			if err != nil {
+				setErr(fmt.Errorf("chunk %d: %w", seq, err))
+			}
+		}(sequence, offset, data)
+
+		offset += int64(len(data))
+		sequence++
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if offset != metadata.Size {
+		return fmt.Errorf("chunked %d bytes, expected %d", offset, metadata.Size)
+	}
+
+	slog.InfoContext(ctx, "Upload chunked", "upload_id", uploadID, "chunks", sequence,
+		"avg_size", offset/int64(max(sequence, 1)), "duration", time.Since(startTime))
+	return nil
+}
+
+// queueChunkUpload marks a content-defined upload as processing and queues
+// the job that chunks and completes it. The job reads the parts from this
+// host's spool, so it is pinned here. Completing again while the job is
+// queued or running does not start another one; completing after it failed
+// tries again.
+func (s *FileService) queueChunkUpload(ctx context.Context, metadata *models.FileMetadata, groupID int64, parityGroups []int64) (string, error) {
+	if err := validateContiguousChunks(metadata, uniqueChunks(metadata.Parts)); err != nil {
+		return "", errorf(ErrConflict, "upload incomplete: %w", err)
+	}
+
+	dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	res, err := s.db.Collection("files").UpdateOne(dbCtx,
+		bson.M{"_id": metadata.ID, "status": bson.M{"$in": bson.A{"pending", "processing"}}},
+		bson.M{"$set": bson.M{"status": "processing", "updated_at": time.Now()}})
+	if err != nil {
+		return "", fmt.Errorf("failed to update db: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return "", errorf(ErrConflict, "upload is %s", metadata.Status)
+	}
+
+	payload := bson.M{"file_id": metadata.ID.Hex(), "group_id": groupID}
+	if len(parityGroups) > 0 {
+		payload["parity_groups"] = parityGroups
+	}
+	_, _, err = s.jobs.Enqueue(ctx, JobTypeChunkUpload, payload,
+		JobOptions{UniqueKey: chunkUploadJobKey(metadata.ID.Hex()), Local: true})
+	if err != nil {
+		return "", err
+	}
+	return "processing", nil
+}
+
+func chunkUploadJobKey(uploadID string) string {
+	return fmt.Sprintf("%s:%s", JobTypeChunkUpload, uploadID)
+}
+
+// runChunkUpload is the chunk_upload job: it re-chunks a content-defined
+// upload and completes it. When the last attempt fails the upload goes back
+// to pending, so the client sees the failure and upload expiry eventually
+// reclaims an upload nobody completes again.
+func (s *FileService) runChunkUpload(ctx context.Context, job *models.Job) error {
+	metadata, err := s.jobFile(ctx, job)
+	if err != nil || metadata == nil || metadata.Status != "processing" {
+		return err
+	}
+	groupID := payloadInt64(job, "group_id")
+
+	err = s.chunkCDCUpload(ctx, metadata, groupID)
+	if err == nil {
+		metadata, err = s.GetFileMetadata(ctx, metadata.ID.Hex())
+	}
+	if err == nil {
+		err = s.finishUpload(ctx, metadata, groupID, payloadInt64s(job, "parity_groups"))
+	}
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() == nil && job.Attempts >= job.MaxAttempts {
+		dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_, updateErr := s.db.Collection("files").UpdateOne(dbCtx,
+			bson.M{"_id": metadata.ID, "status": "processing"},
+			bson.M{"$set": bson.M{"status": "pending", "updated_at": time.Now()}})
+		if updateErr != nil {
+			slog.ErrorContext(ctx, "Failed to reset upload after chunking failed", "upload_id", metadata.ID.Hex(), "error", updateErr)
+		}
+	}
+	return fmt.Errorf("failed to chunk upload: %w", err)
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"telegram-storage/models"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunks of compressible files are zstd-compressed before upload when that
+// saves at least minCompressionSaving. FileChunk.Size, Hash and offsets always
+// describe the original bytes; only StoredSize and Codec reflect what is held
+// in Telegram, and DownloadChunk hands back the original bytes. Erasure parity
+// is computed over the original bytes as well.
+
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+
+	CodecZstd = "zstd"
+
+	minCompressionSaving = 0.10
+)
+
+// zstdEncoder is shared by all uploads; EncodeAll is safe for concurrent use.
+var zstdEncoder *zstd.Encoder
+
+func init() {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create zstd encoder: %v", err))
+	}
+	zstdEncoder = enc
+}
+
+// incompressibleTypes are mime types (or prefixes ending in "/") whose
+// content is already compressed.
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/vnd.rar",
+	"application/x-bzip2", "application/x-xz", "application/zstd",
+	"application/pdf", "application/epub+zip",
+	"application/vnd.openxmlformats-officedocument.",
+}
+
+// compressibleExceptions are uncompressed formats under the prefixes above.
+var compressibleExceptions = []string{"image/bmp", "image/svg+xml", "audio/wav", "audio/x-wav"}
+
+func isCompressibleMimeType(mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	for _, t := range compressibleExceptions {
+		if mimeType == t {
+			return true
+		}
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(mimeType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressChunk compresses a chunk and returns the bytes to store and their
+// codec. The original bytes are returned with an empty codec when compression
+// does not pay off.
+func compressChunk(r io.Reader) ([]byte, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read chunk: %w", err)
+	}
+	compressed := zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if float64(len(compressed)) > float64(len(data))*(1-minCompressionSaving) {
+		return data, "", nil
+	}
+	return compressed, CodecZstd, nil
+}
+
+// decodeChunk wraps a stored chunk stream so it yields the original bytes.
+func decodeChunk(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return io.NopCloser(r), nil
+	case CodecZstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(2*MaxChunkSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown chunk codec: %s", codec)
+}
+
+// storedSize is the size of the chunk as held in Telegram.
+func storedSize(c models.FileChunk) int64 {
+	if c.StoredSize > 0 {
+		return c.StoredSize
+	}
+	return c.Size
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Config holds every setting of a FileService. Fields are tagged with their
+// key in the config file and the environment variable that overrides it.
+type Config struct {
+	SpoolDir    string `yaml:"spool_dir" env:"SPOOL_DIR"`
+	Compression string `yaml:"compression" env:"COMPRESSION"` // default for uploads that do not choose: none or zstd
+	FFmpeg      string `yaml:"ffmpeg" env:"FFMPEG_PATH"`      // looked up in PATH unless it is a path
+	FFprobe     string `yaml:"ffprobe" env:"FFPROBE_PATH"`
+
+	Upload    UploadConfig     `yaml:"upload"`
+	Download  DownloadConfig   `yaml:"download"`
+	CDC       CDCParams        `yaml:"cdc"`
+	Assemble  AssembleConfig   `yaml:"assemble"`
+	ReadAhead ReadAheadConfig  `yaml:"readahead"`
+	Cache     ChunkCacheConfig `yaml:"cache"`
+	Pack      PackConfig       `yaml:"pack"`
+	Scrub     ScrubConfig      `yaml:"scrub"`
+	Thumbnail ThumbnailConfig  `yaml:"thumbnail"`
+	HLS       HLSConfig        `yaml:"hls"`
+	Jobs      JobConfig        `yaml:"jobs"`
+}
+
+// UploadConfig controls how chunks are sent to Telegram.
+type UploadConfig struct {
+	MaxRetries int           `yaml:"max_retries" env:"UPLOAD_MAX_RETRIES"` // attempts per chunk, including the first
+	RetryDelay time.Duration `yaml:"retry_delay" env:"UPLOAD_RETRY_DELAY"` // base of the exponential backoff between attempts
+	CDCWorkers int           `yaml:"cdc_workers" env:"CDC_UPLOAD_WORKERS"` // chunks of a content-defined upload sent concurrently
+	PendingTTL time.Duration `yaml:"pending_ttl" env:"UPLOAD_PENDING_TTL"` // uploads left pending this long are deleted with their chunks
+}
+
+// DownloadConfig limits requests to Telegram when reading files.
+type DownloadConfig struct {
+	Rate  float64 `yaml:"rate" env:"DOWNLOAD_RATE"` // chunk downloads started per second, across all bots
+	Burst int     `yaml:"burst" env:"DOWNLOAD_BURST"`
+}
+
+// DefaultConfig returns the built-in settings.
+func DefaultConfig() Config {
+	return Config{
+		SpoolDir:    filepath.Join(os.TempDir(), "telegram-storage-spool"),
+		Compression: CompressionNone,
+		FFmpeg:      "ffmpeg",
+		FFprobe:     "ffprobe",
+		Upload:      UploadConfig{MaxRetries: 3, RetryDelay: 2 * time.Second, CDCWorkers: 8, PendingTTL: 24 * time.Hour},
+		Download:    DownloadConfig{Rate: 20, Burst: 40},
+		CDC:         DefaultCDCParams(),
+		Assemble:    defaultAssembleConfig(),
+		ReadAhead:   defaultReadAheadConfig(),
+		Cache:       defaultChunkCacheConfig(),
+		Pack:        defaultPackConfig(),
+		Scrub:       defaultScrubConfig(),
+		Thumbnail:   defaultThumbnailConfig(),
+		HLS:         defaultHLSConfig(),
+		Jobs:        defaultJobConfig(),
+	}
+}
+
+// Validate reports every invalid setting, naming each by its config file key.
+// Lists are sorted and pack sizes clamped to what fits in one chunk.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.SpoolDir != "", "spool_dir must be set")
+	check(c.Compression == CompressionNone || c.Compression == CompressionZstd, "compression must be %q or %q", CompressionNone, CompressionZstd)
+
+	check(c.Upload.MaxRetries >= 1, "upload.max_retries must be at least 1")
+	check(c.Upload.RetryDelay > 0, "upload.retry_delay must be positive")
+	check(c.Upload.CDCWorkers >= 1, "upload.cdc_workers must be at least 1")
+	check(c.Upload.PendingTTL > 0, "upload.pending_ttl must be positive")
+	check(c.Download.Rate > 0, "download.rate must be positive")
+	check(c.Download.Burst >= 1, "download.burst must be at least 1")
+
+	if err := c.CDC.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("cdc: %v", err))
+	}
+
+	check(c.Assemble.MemoryBudget >= 0, "assemble.memory_budget must not be negative")
+	check(c.Assemble.Window >= 1, "assemble.window must be at least 1")
+
+	check(c.ReadAhead.Chunks >= 0, "readahead.chunks must not be negative")
+	check(c.ReadAhead.MemoryBudget >= 0, "readahead.memory_budget must not be negative")
+	check(c.ReadAhead.Idle > 0, "readahead.idle must be positive")
+
+	check(c.Cache.MaxBytes >= 0, "cache.max_bytes must not be negative")
+	check(c.Cache.TTL >= 0, "cache.ttl must not be negative")
+
+	check(c.Pack.Threshold >= 0, "pack.threshold must not be negative")
+	check(c.Pack.TargetSize >= 0, "pack.target_size must not be negative")
+	check(c.Pack.MaxAge > 0, "pack.max_age must be positive")
+	check(c.Pack.CompactRatio >= 0 && c.Pack.CompactRatio <= 1, "pack.compact_ratio must be between 0 and 1")
+	check(c.Pack.CompactInterval > 0, "pack.compact_interval must be positive")
+	// A sealed pack (data plus index) must fit in one chunk
+	c.Pack.TargetSize = min(c.Pack.TargetSize, MaxChunkSize/2)
+	c.Pack.Threshold = min(c.Pack.Threshold, c.Pack.TargetSize)
+
+	check(c.Scrub.Interval >= 0, "scrub.interval must not be negative")
+	check(c.Scrub.Rate > 0, "scrub.rate must be positive")
+
+	check(len(c.Thumbnail.Sizes) > 0, "thumbnail.sizes must not be empty")
+	for _, n := range c.Thumbnail.Sizes {
+		check(n > 0 && n <= 2048, "thumbnail.sizes: %d is not between 1 and 2048", n)
+	}
+	sort.Ints(c.Thumbnail.Sizes)
+	check(c.Thumbnail.MaxSourceBytes > 0, "thumbnail.max_source_bytes must be positive")
+	check(c.Thumbnail.MaxPixels > 0, "thumbnail.max_pixels must be positive")
+	check(c.Thumbnail.VideoPrefix > 0, "thumbnail.video_prefix must be positive")
+	check(c.Thumbnail.Workers >= 1, "thumbnail.workers must be at least 1")
+
+	check(len(c.HLS.Heights) > 0, "hls.renditions must not be empty")
+	for _, h := range c.HLS.Heights {
+		check(h > 0 && h%2 == 0, "hls.renditions: %d is not a positive even height", h)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(c.HLS.Heights)))
+	check(c.HLS.SegmentSeconds >= 1, "hls.segment_seconds must be at least 1")
+	check(c.HLS.Workers >= 1, "hls.workers must be at least 1")
+
+	check(c.Jobs.Lease > 0, "jobs.lease must be positive")
+	check(c.Jobs.PollInterval > 0, "jobs.poll_interval must be positive")
+	check(c.Jobs.MaxAttempts >= 1, "jobs.max_attempts must be at least 1")
+	check(c.Jobs.Backoff > 0, "jobs.backoff must be positive")
+	check(c.Jobs.MaxBackoff > 0, "jobs.max_backoff must be positive")
+	for jobType, n := range c.Jobs.Concurrency {
+		check(slices.Contains(jobTypes, jobType), "jobs.concurrency: unknown job type %q", jobType)
+		check(n >= 0, "jobs.concurrency.%s must not be negative", jobType)
+	}
+
+	return errors.Join(errs...)
+}
+
+// resolveTools looks up ffmpeg and ffprobe, leaving video thumbnails and HLS
+// processing disabled when a program they need is missing.
+func (c *Config) resolveTools() {
+	ffmpeg, err := exec.LookPath(c.FFmpeg)
+	if err != nil {
+		slog.Info("ffmpeg not found, video thumbnails and processing disabled", "error", err)
+		return
+	}
+	c.Thumbnail.FFmpeg = ffmpeg
+
+	if !c.HLS.Enabled {
+		return
+	}
+	ffprobe, err := exec.LookPath(c.FFprobe)
+	if err != nil {
+		slog.Info("ffprobe not found, video processing disabled", "error", err)
+		return
+	}
+	c.HLS.FFmpeg, c.HLS.FFprobe = ffmpeg, ffprobe
+}
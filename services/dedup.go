@@ -0,0 +1,310 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"telegram-storage/models"
+	"telegram-storage/tracing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Chunks are content-addressed: the "chunks" collection maps a chunk's
+// SHA-256 to the Telegram document holding it, with a reference count of the
+// file chunks using it. Parity chunks and chunks uploaded before deduplication
+// existed are not registered and are owned by exactly one file.
+
+// hashChunk returns the SHA-256 of a chunk and a reader positioned at its
+// start. Seekable readers are rewound; anything else is buffered in memory,
+// which is bounded by MaxChunkSize.
+func hashChunk(r io.Reader) (io.Reader, string, error) {
+	hasher := sha256.New()
+
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to hash chunk: %w", err)
+		}
+		if _, err := io.Copy(hasher, seeker); err != nil {
+			return nil, "", fmt.Errorf("failed to hash chunk: %w", err)
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, "", fmt.Errorf("failed to rewind chunk: %w", err)
+		}
+		return seeker, hex.EncodeToString(hasher.Sum(nil)), nil
+	}
+
+	data, err := io.ReadAll(io.TeeReader(r, hasher))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to hash chunk: %w", err)
+	}
+	return bytes.NewReader(data), hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// acquireChunk takes a reference on an already stored chunk with the given
+// hash and size. It returns nil if no such chunk exists.
+func (s *FileService) acquireChunk(ctx context.Context, hash string, size int64) (*models.StoredChunk, error) {
+	var stored models.StoredChunk
+	err := s.db.Collection("chunks").FindOneAndUpdate(ctx,
+		bson.M{"_id": hash, "size": size},
+		bson.M{"$inc": bson.M{"ref_count": 1}, "$set": bson.M{"updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up chunk: %w", err)
+	}
+	return &stored, nil
+}
+
+// registerChunk records a freshly sent chunk with one reference. If another
+// upload registered the same content first, that chunk is acquired instead
+// and returned so the caller can discard its own copy.
+func (s *FileService) registerChunk(ctx context.Context, chunk models.FileChunk) (*models.StoredChunk, error) {
+	now := time.Now()
+	_, err := s.db.Collection("chunks").InsertOne(ctx, models.StoredChunk{
+		Hash:       chunk.Hash,
+		FileID:     chunk.FileID,
+		MessageID:  chunk.MessageID,
+		BotToken:   chunk.BotToken,
+		GroupID:    chunk.GroupID,
+		Size:       chunk.Size,
+		Codec:      chunk.Codec,
+		StoredSize: chunk.StoredSize,
+		RefCount:   1,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	})
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, fmt.Errorf("failed to register chunk: %w", err)
+	}
+
+	existing, err := s.acquireChunk(ctx, chunk.Hash, chunk.Size)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, fmt.Errorf("chunk %s registered concurrently with a different size", chunk.Hash)
+	}
+	return existing, nil
+}
+
+// releaseChunk drops one reference to a file chunk and deletes the Telegram
+// message once nothing refers to it. Unregistered chunks are deleted directly.
+func (s *FileService) releaseChunk(ctx context.Context, chunk models.FileChunk, defaultGroupID int64) error {
+	if chunk.Hash != "" {
+		collection := s.db.Collection("chunks")
+		filter := bson.M{"_id": chunk.Hash, "file_id": chunk.FileID}
+
+		var stored models.StoredChunk
+		err := collection.FindOneAndUpdate(ctx, filter,
+			bson.M{"$inc": bson.M{"ref_count": -1}, "$set": bson.M{"updated_at": time.Now()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&stored)
+		switch {
+		case err == nil:
+			if stored.RefCount > 0 {
+				return nil
+			}
+			res, err := collection.DeleteOne(ctx, bson.M{"_id": chunk.Hash, "ref_count": bson.M{"$lte": 0}})
+			if err != nil {
+				return fmt.Errorf("failed to remove chunk record: %w", err)
+			}
+			if res.DeletedCount == 0 {
+				// Re-acquired by a concurrent upload
+				return nil
+			}
+		case err != mongo.ErrNoDocuments:
+			return fmt.Errorf("failed to release chunk: %w", err)
+		}
+	}
+
+	if s.cache != nil && chunk.Hash != "" {
+		s.cache.remove(chunk.Hash)
+	}
+	return s.deleteChunkMessage(chunk, defaultGroupID)
+}
+
+func (s *FileService) deleteChunkMessage(chunk models.FileChunk, defaultGroupID int64) error {
+	groupID := chunk.GroupID
+	if groupID == 0 {
+		groupID = defaultGroupID
+	}
+	if groupID == 0 || chunk.MessageID == 0 {
+		return fmt.Errorf("chunk %d has no message to delete", chunk.Sequence)
+	}
+
+	targetBot, err := s.botForChunk(chunk)
+	if err != nil {
+		return err
+	}
+	if _, err := targetBot.Request(tgbotapi.NewDeleteMessage(groupID, chunk.MessageID)); err != nil {
+		return fmt.Errorf("failed to delete message %d: %w", chunk.MessageID, telegramError(err))
+	}
+	return nil
+}
+
+// DeleteFile removes a file record and releases its chunks. Messages that
+// cannot be deleted are logged and left behind rather than failing the delete,
+// since the file is already gone from the index.
+func (s *FileService) DeleteFile(ctx context.Context, fileID string, defaultGroupID int64) (_ *models.Job, err error) {
+	ctx, span := tracing.Start(ctx, "FileService.DeleteFile", tracing.AttrFileID.String(fileID))
+	defer func() { tracing.End(span, err) }()
+
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Hide the file right away; its chunks are released by a delete_file job
+	_, err = s.db.Collection("files").UpdateOne(ctx, bson.M{"_id": metadata.ID},
+		bson.M{"$set": bson.M{"status": "deleting", "updated_at": time.Now()}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete file: %w", err)
+	}
+	job, _, err := s.enqueueFileJob(ctx, JobTypeDeleteFile, fileID, defaultGroupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete file: %w", err)
+	}
+	slog.InfoContext(ctx, "File marked for deletion", "file_id", fileID, "name", metadata.Name, "job_id", job.ID.Hex())
+	return job, nil
+}
+
+// deleteFileNow removes a file and releases everything it references.
+func (s *FileService) deleteFileNow(ctx context.Context, fileID string, defaultGroupID int64) error {
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Collection("files").DeleteOne(ctx, bson.M{"_id": metadata.ID})
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	if res.DeletedCount == 0 {
+		return errorf(ErrNotFound, "file not found")
+	}
+
+	failed := 0
+	if metadata.Pack != nil {
+		if err := s.releasePacked(ctx, metadata.Pack); err != nil {
+			slog.WarnContext(ctx, "Failed to release pack bytes", "file_id", fileID, "error", err)
+			failed++
+		}
+	}
+	for _, c := range uniqueChunks(metadata.Chunks) {
+		if err := s.releaseChunk(ctx, c, defaultGroupID); err != nil {
+			slog.WarnContext(ctx, "Failed to release chunk", "file_id", fileID, "sequence", c.Sequence, "error", err)
+			failed++
+		}
+	}
+	for _, c := range streamChunks(metadata) {
+		if err := s.releaseChunk(ctx, c, defaultGroupID); err != nil {
+			slog.WarnContext(ctx, "Failed to release HLS segment", "file_id", fileID, "sequence", c.Sequence, "error", err)
+			failed++
+		}
+	}
+	for _, p := range metadata.ParityChunks {
+		if err := s.deleteChunkMessage(p, defaultGroupID); err != nil {
+			slog.WarnContext(ctx, "Failed to delete parity chunk", "file_id", fileID, "stripe", p.Stripe, "shard", p.Shard, "error", err)
+			failed++
+		}
+	}
+	s.removeSpool(fileID)
+	s.deleteThumbnails(ctx, metadata)
+	s.deleteShares(ctx, metadata)
+
+	if metadata.ManifestMessageID != 0 {
+		if err := s.postTombstone(ctx, fileID, defaultGroupID); err != nil {
+			slog.WarnContext(ctx, "Failed to post tombstone", "file_id", fileID, "error", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "File deleted", "file_id", fileID, "name", metadata.Name, "chunks", len(metadata.Chunks), "failed", failed)
+	return nil
+}
+
+// RebuildChunkRefs recomputes the chunks collection from the chunk lists of
+// all files, e.g. after the files collection was restored from Telegram. When
+// the same content is stored in several documents, the most referenced one
+// is registered and the rest stay owned by their single file.
+func (s *FileService) RebuildChunkRefs(ctx context.Context) (int, error) {
+	type key struct{ hash, fileID string }
+	refs := make(map[key]*models.StoredChunk)
+
+	opts := options.Find().SetProjection(bson.M{"chunks": 1, "stream.renditions.segments.chunk": 1})
+	cursor, err := s.db.Collection("files").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	now := time.Now()
+	for cursor.Next(ctx) {
+		var metadata models.FileMetadata
+		if err := cursor.Decode(&metadata); err != nil {
+			return 0, fmt.Errorf("failed to decode file: %w", err)
+		}
+		for _, c := range append(uniqueChunks(metadata.Chunks), streamChunks(&metadata)...) {
+			if c.Hash == "" {
+				continue
+			}
+			k := key{c.Hash, c.FileID}
+			if stored, ok := refs[k]; ok {
+				stored.RefCount++
+				continue
+			}
+			refs[k] = &models.StoredChunk{
+				Hash:       c.Hash,
+				FileID:     c.FileID,
+				MessageID:  c.MessageID,
+				BotToken:   c.BotToken,
+				GroupID:    c.GroupID,
+				Size:       c.Size,
+				Codec:      c.Codec,
+				StoredSize: c.StoredSize,
+				RefCount:   1,
+				CreatedAt:  now,
+				UpdatedAt:  now,
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	best := make(map[string]*models.StoredChunk)
+	for _, stored := range refs {
+		if cur, ok := best[stored.Hash]; !ok || stored.RefCount > cur.RefCount {
+			best[stored.Hash] = stored
+		}
+	}
+
+	collection := s.db.Collection("chunks")
+	for hash, stored := range best {
+		_, err := collection.ReplaceOne(ctx, bson.M{"_id": hash}, stored, options.Replace().SetUpsert(true))
+		if err != nil {
+			return 0, fmt.Errorf("failed to write chunk %s: %w", hash, err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Chunk references rebuilt", "chunks", len(best))
+	return len(best), nil
+}
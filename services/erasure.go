@@ -0,0 +1,297 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"telegram-storage/models"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/klauspost/reedsolomon"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	DefaultDataShards   = 4
+	DefaultParityShards = 2
+	MaxErasureShards    = 64
+)
+
+// Erasure-coded files group data chunks into stripes of DataShards chunks.
+// Chunk with sequence s belongs to stripe s/DataShards at shard s%DataShards;
+// each stripe gets ParityShards parity chunks stored as shards
+// DataShards..DataShards+ParityShards-1. All shards of a stripe are padded to
+// the size of its largest data chunk, and a short final stripe is padded with
+// all-zero data shards that are never stored.
+
+func validateErasureParams(dataShards, parityShards int) error {
+	if dataShards < 1 || parityShards < 1 {
+		return errorf(ErrInvalidArgument, "invalid erasure parameters: data_shards and parity_shards must be >= 1")
+	}
+	if dataShards+parityShards > MaxErasureShards {
+		return errorf(ErrInvalidArgument, "invalid erasure parameters: data_shards + parity_shards must be <= %d", MaxErasureShards)
+	}
+	return nil
+}
+
+// uniqueChunks returns chunks sorted by sequence with duplicate sequences removed.
+func uniqueChunks(chunks []models.FileChunk) []models.FileChunk {
+	sorted := make([]models.FileChunk, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Sequence < sorted[j].Sequence
+	})
+
+	out := sorted[:0]
+	for i, c := range sorted {
+		if i > 0 && c.Sequence == sorted[i-1].Sequence {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// validateContiguousChunks checks that chunks cover sequences 0..n-1 and add up
+// to the declared file size.
+func validateContiguousChunks(metadata *models.FileMetadata, chunks []models.FileChunk) error {
+	var total int64
+	for i, c := range chunks {
+		if c.Sequence != i {
+			return fmt.Errorf("missing chunk %d", i)
+		}
+		total += c.Size
+	}
+	if total != metadata.Size {
+		return fmt.Errorf("uploaded %d bytes, expected %d", total, metadata.Size)
+	}
+	return nil
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func padShard(data []byte, size int) []byte {
+	if len(data) == size {
+		return data
+	}
+	padded := make([]byte, size)
+	copy(padded, data)
+	return padded
+}
+
+func parityByShard(metadata *models.FileMetadata, stripe int) map[int]models.FileChunk {
+	parity := make(map[int]models.FileChunk)
+	for _, p := range metadata.ParityChunks {
+		if p.Stripe == stripe {
+			parity[p.Shard] = p
+		}
+	}
+	return parity
+}
+
+func (s *FileService) downloadChunkBytes(ctx context.Context, chunk models.FileChunk) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := s.DownloadChunk(ctx, chunk, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadDataShard prefers the local spool and falls back to Telegram, so parity
+// can still be computed after a restart wiped the spool.
+func (s *FileService) loadDataShard(ctx context.Context, uploadID string, chunk models.FileChunk) ([]byte, error) {
+	data, err := s.readSpooledChunk(uploadID, chunk.Sequence)
+	if err == nil && int64(len(data)) == chunk.Size {
+		return data, nil
+	}
+	return s.downloadChunkBytes(ctx, chunk)
+}
+
+func (s *FileService) sendDocumentWithRetry(ctx context.Context, b *tgbotapi.BotAPI, groupID int64, name, caption string, data []byte) (*tgbotapi.Message, error) {
+	var lastErr error
+	for attempt := 0; attempt < s.cfg.Upload.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * s.cfg.Upload.RetryDelay)
+		}
+		msg, err := sendDocument(ctx, b, groupID, name, caption, bytes.NewReader(data))
+		if err == nil {
+			return msg, nil
+		}
+		lastErr = err
+		if !isRetryableError(err) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("failed after %d retries: %w", s.cfg.Upload.MaxRetries, lastErr)
+}
+
+// encodeParity computes and uploads the parity chunks of every stripe that
+// does not have them yet. Calling it again after a partial failure resumes
+// with the remaining stripes.
+func (s *FileService) encodeParity(ctx context.Context, metadata *models.FileMetadata, chunks []models.FileChunk, groupID int64, parityGroups []int64) error {
+	k, m := metadata.DataShards, metadata.ParityShards
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return fmt.Errorf("failed to create encoder: %w", err)
+	}
+
+	uploadID := metadata.ID.Hex()
+	collection := s.db.Collection("files")
+	stripes := (len(chunks) + k - 1) / k
+
+	for stripe := 0; stripe < stripes; stripe++ {
+		if len(parityByShard(metadata, stripe)) == m {
+			continue
+		}
+
+		shards := make([][]byte, k+m)
+		usedBots := make(map[string]bool)
+		shardSize := 0
+		for i := 0; i < k; i++ {
+			seq := stripe*k + i
+			if seq >= len(chunks) {
+				continue
+			}
+			data, err := s.loadDataShard(ctx, uploadID, chunks[seq])
+			if err != nil {
+				return fmt.Errorf("failed to read chunk %d for parity: %w", seq, err)
+			}
+			shards[i] = data
+			usedBots[chunks[seq].BotToken] = true
+			if len(data) > shardSize {
+				shardSize = len(data)
+			}
+		}
+		for i := range shards {
+			shards[i] = padShard(shards[i], shardSize)
+		}
+
+		if err := enc.Encode(shards); err != nil {
+			return fmt.Errorf("failed to encode stripe %d: %w", stripe, err)
+		}
+
+		parity := make([]models.FileChunk, 0, m)
+		for j := 0; j < m; j++ {
+			shard := k + j
+			targetBot := s.botPool.GetNextBotExcluding(usedBots)
+			if targetBot == nil {
+				return errorf(ErrUpstreamUnavailable, "no bots available")
+			}
+			usedBots[targetBot.Self.UserName] = true
+
+			targetGroup := groupID
+			if len(parityGroups) > 0 {
+				targetGroup = parityGroups[j%len(parityGroups)]
+			}
+
+			name := fmt.Sprintf("parity_%s_%d_%d", uploadID, stripe, shard)
+			caption := fmt.Sprintf("ID: %s\nStripe: %d\nShard: %d", uploadID, stripe, shard)
+			msg, err := s.sendDocumentWithRetry(ctx, targetBot, targetGroup, name, caption, shards[shard])
+			if err != nil {
+				return fmt.Errorf("failed to upload parity %d of stripe %d: %w", shard, stripe, err)
+			}
+
+			parity = append(parity, models.FileChunk{
+				Sequence:  stripe*m + j,
+				MessageID: msg.MessageID,
+				FileID:    msg.Document.FileID,
+				BotToken:  targetBot.Self.UserName,
+				Size:      int64(shardSize),
+				GroupID:   targetGroup,
+				Hash:      hashBytes(shards[shard]),
+				Stripe:    stripe,
+				Shard:     shard,
+			})
+		}
+
+		dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err = collection.UpdateOne(dbCtx, bson.M{"_id": metadata.ID}, bson.M{
+			"$push": bson.M{"parity_chunks": bson.M{"$each": parity}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to save parity for stripe %d: %w", stripe, err)
+		}
+		metadata.ParityChunks = append(metadata.ParityChunks, parity...)
+
+		slog.DebugContext(ctx, "Stripe encoded", "upload_id", uploadID, "stripe", stripe, "stripes", stripes,
+			"data_shards", k, "parity_shards", m, "shard_size", shardSize)
+	}
+
+	return nil
+}
+
+// reconstructChunk rebuilds a data chunk of an erasure-coded file from any
+// DataShards surviving shards of its stripe.
+func (s *FileService) reconstructChunk(ctx context.Context, metadata *models.FileMetadata, chunks []models.FileChunk, sequence int) ([]byte, error) {
+	k, m := metadata.DataShards, metadata.ParityShards
+	stripe := sequence / k
+
+	parity := parityByShard(metadata, stripe)
+	if len(parity) == 0 {
+		return nil, fmt.Errorf("stripe %d has no parity", stripe)
+	}
+	var shardSize int
+	for _, p := range parity {
+		shardSize = int(p.Size)
+		break
+	}
+
+	shards := make([][]byte, k+m)
+	available := 0
+	for i := 0; i < k && available < k; i++ {
+		seq := stripe*k + i
+		if seq >= len(chunks) {
+			shards[i] = make([]byte, shardSize)
+			available++
+			continue
+		}
+		if seq == sequence {
+			continue
+		}
+		data, err := s.downloadChunkBytes(ctx, chunks[seq])
+		if err != nil {
+			slog.WarnContext(ctx, "Data shard unavailable", "shard", i, "stripe", stripe, "error", err)
+			continue
+		}
+		shards[i] = padShard(data, shardSize)
+		available++
+	}
+	for j := 0; j < m && available < k; j++ {
+		p, ok := parity[k+j]
+		if !ok {
+			continue
+		}
+		data, err := s.downloadChunkBytes(ctx, p)
+		if err != nil {
+			slog.WarnContext(ctx, "Parity shard unavailable", "shard", k+j, "stripe", stripe, "error", err)
+			continue
+		}
+		shards[k+j] = padShard(data, shardSize)
+		available++
+	}
+
+	if available < k {
+		return nil, fmt.Errorf("stripe %d unrecoverable: only %d of %d required shards available", stripe, available, k)
+	}
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decoder: %w", err)
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, fmt.Errorf("failed to reconstruct stripe %d: %w", stripe, err)
+	}
+
+	slog.InfoContext(ctx, "Chunk reconstructed from parity", "file_id", metadata.ID.Hex(), "sequence", sequence, "stripe", stripe)
+	return shards[sequence%k][:chunks[sequence].Size], nil
+}
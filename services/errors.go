@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Error kinds. Service errors wrap one of these so callers can tell failures
+// apart with errors.Is; the API maps each kind to a status code. Errors of no
+// kind are internal failures.
+var (
+	ErrNotFound            = errors.New("not found")
+	ErrInvalidArgument     = errors.New("invalid argument")
+	ErrConflict            = errors.New("conflict")
+	ErrQuotaExceeded       = errors.New("quota exceeded")
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	ErrTooLarge            = errors.New("too large")
+)
+
+// kindError tags an error with a kind without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// errorf formats an error of the given kind. %w wraps as in fmt.Errorf.
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+// telegramError classifies a failed Telegram request: throttling is
+// ErrQuotaExceeded, transport and server failures are ErrUpstreamUnavailable,
+// and anything else Telegram rejected is left untyped. Request URLs are
+// dropped since they contain the bot token.
+func telegramError(err error) error {
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) {
+		switch {
+		case tgErr.Code == http.StatusTooManyRequests:
+			return &kindError{kind: ErrQuotaExceeded, err: err}
+		case tgErr.Code >= http.StatusInternalServerError:
+			return &kindError{kind: ErrUpstreamUnavailable, err: err}
+		}
+		return err
+	}
+	return &kindError{kind: ErrUpstreamUnavailable, err: withoutURL(err)}
+}
+
+// statusError classifies a non-success response from the Telegram file server.
+func statusError(status int) error {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return errorf(ErrQuotaExceeded, "download failed with status: %d", status)
+	case status >= http.StatusInternalServerError:
+		return errorf(ErrUpstreamUnavailable, "download failed with status: %d", status)
+	}
+	return fmt.Errorf("download failed with status: %d", status)
+}
+
+// withoutURL drops the request URL from transport errors, since Telegram
+// URLs contain the bot token.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// RetryAfter returns the number of seconds Telegram asked to wait before
+// retrying a throttled request, or 0 when it did not say.
+func RetryAfter(err error) int {
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) {
+		return tgErr.RetryAfter
+	}
+	return 0
+}
+
+// isRetryableError reports whether a failed operation may succeed if tried
+// again: Telegram throttling or outages, and network failures.
+func isRetryableError(err error) bool {
+	if errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, ErrQuotaExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		mongo.IsNetworkError(err) || mongo.IsTimeout(err)
+}
@@ -0,0 +1,335 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"telegram-storage/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Metadata archives are JSONL: a header line, one line per document, and a
+// footer with per-type counts so a truncated archive can be detected. Document
+// bodies are canonical MongoDB Extended JSON, which keeps ObjectIDs, dates and
+// int64s intact across the round trip.
+
+const (
+	ExportFormatVersion = 1
+	maxExportLineSize   = 64 * 1024 * 1024
+)
+
+const (
+	ImportModeUpsert = "upsert" // replace existing documents
+	ImportModeSkip   = "skip"   // keep existing documents untouched
+)
+
+// exportCollections lists the collections included in an archive, keyed by the
+// record type written for each document.
+var exportCollections = []struct {
+	recordType string
+	collection string
+}{
+	{"file", "files"},
+	{"manifest_head", "manifest_heads"},
+	{"chunk", "chunks"},
+	{"pack", "packs"},
+	{"share", "shares"},
+}
+
+type exportLine struct {
+	Type       string          `json:"type"`
+	Version    int             `json:"version,omitempty"`
+	ExportedAt *time.Time      `json:"exported_at,omitempty"`
+	Counts     map[string]int  `json:"counts,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+// ExportMetadata streams every exported collection to w.
+func (s *FileService) ExportMetadata(ctx context.Context, w io.Writer) (map[string]int, error) {
+	enc := json.NewEncoder(w)
+
+	now := time.Now()
+	if err := enc.Encode(exportLine{Type: "header", Version: ExportFormatVersion, ExportedAt: &now}); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	counts := make(map[string]int)
+	for _, ec := range exportCollections {
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		cursor, err := s.db.Collection(ec.collection).Find(ctx, bson.M{}, opts)
+		if err != nil {
+			return counts, fmt.Errorf("failed to read %s: %w", ec.collection, err)
+		}
+
+		for cursor.Next(ctx) {
+			data, err := bson.MarshalExtJSON(cursor.Current, true, false)
+			if err != nil {
+				cursor.Close(ctx)
+				return counts, fmt.Errorf("failed to encode %s document: %w", ec.recordType, err)
+			}
+			if err := enc.Encode(exportLine{Type: ec.recordType, Data: data}); err != nil {
+				cursor.Close(ctx)
+				return counts, fmt.Errorf("failed to write %s: %w", ec.recordType, err)
+			}
+			counts[ec.recordType]++
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return counts, fmt.Errorf("failed to read %s: %w", ec.collection, err)
+		}
+	}
+
+	if err := enc.Encode(exportLine{Type: "footer", Counts: counts}); err != nil {
+		return counts, fmt.Errorf("failed to write footer: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Metadata exported", "counts", counts)
+	return counts, nil
+}
+
+// ImportOptions controls ImportMetadata.
+type ImportOptions struct {
+	Mode       string            // ImportModeUpsert (default) or ImportModeSkip
+	BotRemap   map[string]string // old bot username -> new bot username
+	GroupRemap map[int64]int64   // old Telegram group ID -> new group ID
+	DryRun     bool
+}
+
+// ImportResult summarises an import.
+type ImportResult struct {
+	Version  int            `json:"version"`
+	Counts   map[string]int `json:"counts"`
+	Inserted int            `json:"inserted"`
+	Updated  int            `json:"updated"`
+	Skipped  int            `json:"skipped"`
+	Complete bool           `json:"complete"` // the archive footer was read and counts matched
+}
+
+// ImportMetadata reads an archive produced by ExportMetadata. Documents are
+// written by _id, so importing the same archive twice is a no-op.
+func (s *FileService) ImportMetadata(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	if opts.Mode == "" {
+		opts.Mode = ImportModeUpsert
+	}
+	if opts.Mode != ImportModeUpsert && opts.Mode != ImportModeSkip {
+		return nil, errorf(ErrInvalidArgument, "invalid import mode: %s", opts.Mode)
+	}
+
+	collections := make(map[string]string)
+	for _, ec := range exportCollections {
+		collections[ec.recordType] = ec.collection
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 1024*1024), maxExportLineSize)
+
+	result := &ImportResult{Counts: make(map[string]int)}
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		var line exportLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return result, errorf(ErrInvalidArgument, "line %d: invalid record: %w", lineNo, err)
+		}
+
+		switch {
+		case lineNo == 1:
+			if line.Type != "header" {
+				return result, errorf(ErrInvalidArgument, "line 1: missing archive header")
+			}
+			if line.Version > ExportFormatVersion {
+				return result, errorf(ErrInvalidArgument, "archive version %d is newer than supported version %d", line.Version, ExportFormatVersion)
+			}
+			result.Version = line.Version
+			continue
+		case line.Type == "footer":
+			result.Complete = countsMatch(line.Counts, result.Counts)
+			continue
+		}
+
+		collection, ok := collections[line.Type]
+		if !ok {
+			slog.WarnContext(ctx, "Skipping unknown record type", "line", lineNo, "type", line.Type)
+			continue
+		}
+
+		doc, id, err := decodeImportRecord(line.Type, line.Data, opts)
+		if err != nil {
+			return result, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		result.Counts[line.Type]++
+		if opts.DryRun {
+			continue
+		}
+
+		if err := s.importDocument(ctx, collection, id, doc, opts.Mode, result); err != nil {
+			return result, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if lineNo == 0 {
+		return result, errorf(ErrInvalidArgument, "empty archive")
+	}
+
+	if !result.Complete {
+		slog.WarnContext(ctx, "Import finished without a matching footer; the archive may be truncated")
+	}
+	slog.InfoContext(ctx, "Metadata imported", "counts", result.Counts, "inserted", result.Inserted,
+		"updated", result.Updated, "skipped", result.Skipped)
+	return result, nil
+}
+
+func (s *FileService) importDocument(ctx context.Context, collection string, id interface{}, doc interface{}, mode string, result *ImportResult) error {
+	dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	coll := s.db.Collection(collection)
+	if mode == ImportModeSkip {
+		_, err := coll.InsertOne(dbCtx, doc)
+		if mongo.IsDuplicateKeyError(err) {
+			result.Skipped++
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to insert into %s: %w", collection, err)
+		}
+		result.Inserted++
+		return nil
+	}
+
+	res, err := coll.ReplaceOne(dbCtx, bson.M{"_id": id}, doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to upsert into %s: %w", collection, err)
+	}
+	if res.UpsertedCount > 0 {
+		result.Inserted++
+	} else {
+		result.Updated++
+	}
+	return nil
+}
+
+// decodeImportRecord decodes a record body and applies bot and group remaps.
+// It returns the document to store and its _id.
+func decodeImportRecord(recordType string, data json.RawMessage, opts ImportOptions) (interface{}, interface{}, error) {
+	switch recordType {
+	case "file":
+		var metadata models.FileMetadata
+		if err := bson.UnmarshalExtJSON(data, true, &metadata); err != nil {
+			return nil, nil, errorf(ErrInvalidArgument, "invalid file record: %w", err)
+		}
+		remapChunks(metadata.Chunks, opts)
+		remapChunks(metadata.ParityChunks, opts)
+		if metadata.Pack != nil && metadata.Pack.Location != nil {
+			remapChunk(metadata.Pack.Location, opts)
+		}
+		if metadata.Stream != nil {
+			if group, ok := opts.GroupRemap[metadata.Stream.GroupID]; ok {
+				metadata.Stream.GroupID = group
+			}
+			for i := range metadata.Stream.Renditions {
+				for j := range metadata.Stream.Renditions[i].Segments {
+					remapChunk(&metadata.Stream.Renditions[i].Segments[j].Chunk, opts)
+				}
+			}
+		}
+		return &metadata, metadata.ID, nil
+
+	case "chunk":
+		var stored models.StoredChunk
+		if err := bson.UnmarshalExtJSON(data, true, &stored); err != nil {
+			return nil, nil, errorf(ErrInvalidArgument, "invalid chunk record: %w", err)
+		}
+		if bot, ok := opts.BotRemap[stored.BotToken]; ok {
+			stored.BotToken = bot
+		}
+		if group, ok := opts.GroupRemap[stored.GroupID]; ok {
+			stored.GroupID = group
+		}
+		return &stored, stored.Hash, nil
+
+	case "pack":
+		var pack models.Pack
+		if err := bson.UnmarshalExtJSON(data, true, &pack); err != nil {
+			return nil, nil, errorf(ErrInvalidArgument, "invalid pack record: %w", err)
+		}
+		if group, ok := opts.GroupRemap[pack.GroupID]; ok {
+			pack.GroupID = group
+		}
+		if pack.Location != nil {
+			remapChunk(pack.Location, opts)
+		}
+		return &pack, pack.ID, nil
+
+	case "manifest_head":
+		var head manifestHead
+		if err := bson.UnmarshalExtJSON(data, true, &head); err != nil {
+			return nil, nil, errorf(ErrInvalidArgument, "invalid manifest head record: %w", err)
+		}
+		if bot, ok := opts.BotRemap[head.Bot]; ok {
+			head.Bot = bot
+		}
+		if group, ok := opts.GroupRemap[head.GroupID]; ok {
+			head.GroupID = group
+		}
+		return &head, head.GroupID, nil
+
+	case "share":
+		var share models.Share
+		if err := bson.UnmarshalExtJSON(data, true, &share); err != nil {
+			return nil, nil, errorf(ErrInvalidArgument, "invalid share record: %w", err)
+		}
+		if share.Token == "" || share.FileID.IsZero() {
+			return nil, nil, errorf(ErrInvalidArgument, "share record needs a token and a file_id")
+		}
+		return &share, share.Token, nil
+	}
+
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON(data, true, &doc); err != nil {
+		return nil, nil, errorf(ErrInvalidArgument, "invalid %s record: %w", recordType, err)
+	}
+	for _, e := range doc {
+		if e.Key == "_id" {
+			return doc, e.Value, nil
+		}
+	}
+	return nil, nil, errorf(ErrInvalidArgument, "%s record has no _id", recordType)
+}
+
+func remapChunks(chunks []models.FileChunk, opts ImportOptions) {
+	for i := range chunks {
+		remapChunk(&chunks[i], opts)
+	}
+}
+
+func remapChunk(chunk *models.FileChunk, opts ImportOptions) {
+	if bot, ok := opts.BotRemap[chunk.BotToken]; ok {
+		chunk.BotToken = bot
+	}
+	if group, ok := opts.GroupRemap[chunk.GroupID]; ok {
+		chunk.GroupID = group
+	}
+}
+
+func countsMatch(expected, got map[string]int) bool {
+	if len(expected) != len(got) {
+		return false
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,340 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"regexp"
+	"strings"
+	"telegram-storage/models"
+	"telegram-storage/tracing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Whole-file deduplication lets a client that declares a file's SHA-256 at
+// /init skip the upload when identical content is already stored. Two rules
+// keep it from being abused:
+//
+//   - Only files whose hash the server computed itself (HashVerified) can be
+//     deduplicated against, so a client cannot plant content under someone
+//     else's hash.
+//   - The client must prove it holds the content by hashing a random byte
+//     range chosen by the server together with a single-use nonce, so knowing
+//     a hash is not enough to obtain the file.
+
+const (
+	ChallengeTTL       = 10 * time.Minute
+	ChallengeMaxLength = 64 * 1024
+)
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// errNotShareable means a source file has chunks that were never registered
+// for sharing (e.g. uploaded before chunk deduplication), so it cannot be
+// cloned and the client has to upload the content itself.
+var errNotShareable = errors.New("chunk is not shared")
+
+func normalizeFileHash(hash string) (string, error) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if !sha256Hex.MatchString(hash) {
+		return "", errorf(ErrInvalidArgument, "invalid hash: expected hex-encoded SHA-256")
+	}
+	return hash, nil
+}
+
+// DedupChallenge asks the client for SHA-256(nonce || file[offset:offset+length]).
+type DedupChallenge struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Hash      string             `bson:"hash" json:"-"`
+	Size      int64              `bson:"size" json:"-"`
+	SourceID  primitive.ObjectID `bson:"source_id" json:"-"`
+	Offset    int64              `bson:"offset" json:"offset"`
+	Length    int64              `bson:"length" json:"length"`
+	Nonce     string             `bson:"nonce" json:"nonce"`
+	CreatedAt time.Time          `bson:"created_at" json:"-"`
+}
+
+// DedupRequest carries the dedup-related fields of an /init call.
+type DedupRequest struct {
+	Name        string
+	Size        int64
+	MimeType    string
+	Hash        string
+	ChallengeID string
+	Proof       string
+	StorageMode string // as requested; only standard uploads are deduplicated
+}
+
+// DeduplicateUpload tries to satisfy an upload from existing content. Without
+// a challenge answer it returns a challenge if a verified match exists; with a
+// valid answer it returns a completed file sharing the existing chunks. Both
+// results are nil when the content is not stored yet and the client should
+// upload normally. That is also the answer when another storage mode than
+// standard was asked for, since a clone is always stored in standard mode.
+func (s *FileService) DeduplicateUpload(ctx context.Context, req DedupRequest, groupID int64) (_ *models.FileMetadata, _ *DedupChallenge, err error) {
+	ctx, span := tracing.Start(ctx, "FileService.DeduplicateUpload", tracing.AttrChunkSize.Int64(req.Size))
+	defer func() { tracing.End(span, err) }()
+
+	hash, err := normalizeFileHash(req.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.StorageMode != "" && req.StorageMode != models.StorageModeStandard {
+		return nil, nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	if req.ChallengeID == "" {
+		source, err := s.findVerifiedFile(ctx, hash, req.Size)
+		if err != nil || source == nil {
+			return nil, nil, err
+		}
+		challenge, err := s.createChallenge(ctx, source)
+		return nil, challenge, err
+	}
+
+	challenge, err := s.takeChallenge(ctx, req.ChallengeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if challenge.Hash != hash || challenge.Size != req.Size {
+		return nil, nil, errorf(ErrInvalidArgument, "challenge does not match the declared file")
+	}
+
+	source, err := s.GetFileMetadata(ctx, challenge.SourceID.Hex())
+	if err != nil {
+		return nil, nil, fmt.Errorf("deduplication source unavailable: %w", err)
+	}
+	if err := s.checkProof(ctx, source, challenge, req.Proof); err != nil {
+		return nil, nil, err
+	}
+
+	metadata, err := s.cloneFile(ctx, source, req)
+	if errors.Is(err, errNotShareable) {
+		slog.InfoContext(ctx, "Deduplication source cannot be shared, falling back to upload", "source_id", source.ID.Hex(), "error", err)
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := s.postManifest(ctx, metadata, groupID); err != nil {
+		slog.WarnContext(ctx, "Failed to post manifest", "file_id", metadata.ID.Hex(), "error", err)
+	}
+	slog.InfoContext(ctx, "Upload satisfied by existing file", "file_id", metadata.ID.Hex(), "source_id", source.ID.Hex(),
+		"name", req.Name, "size", req.Size)
+	return metadata, nil, nil
+}
+
+func (s *FileService) findVerifiedFile(ctx context.Context, hash string, size int64) (*models.FileMetadata, error) {
+	var source models.FileMetadata
+	// Packed files have no shareable chunks
+	filter := bson.M{"hash": hash, "size": size, "status": "completed", "hash_verified": true,
+		"storage_mode": bson.M{"$ne": models.StorageModePacked}}
+	err := s.db.Collection("files").FindOne(ctx, filter).Decode(&source)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up file hash: %w", err)
+	}
+	return &source, nil
+}
+
+func randomInt64(max int64) (int64, error) {
+	if max <= 0 {
+		return 0, nil
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		return 0, err
+	}
+	return n.Int64(), nil
+}
+
+func (s *FileService) createChallenge(ctx context.Context, source *models.FileMetadata) (*DedupChallenge, error) {
+	length := min(int64(ChallengeMaxLength), source.Size)
+	offset, err := randomInt64(source.Size - length + 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create challenge: %w", err)
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create challenge: %w", err)
+	}
+
+	challenge := &DedupChallenge{
+		ID:        primitive.NewObjectID(),
+		Hash:      source.Hash,
+		Size:      source.Size,
+		SourceID:  source.ID,
+		Offset:    offset,
+		Length:    length,
+		Nonce:     hex.EncodeToString(nonce),
+		CreatedAt: time.Now(),
+	}
+	if _, err := s.db.Collection("dedup_challenges").InsertOne(ctx, challenge); err != nil {
+		return nil, fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// takeChallenge loads and deletes a challenge so each one can be answered once.
+func (s *FileService) takeChallenge(ctx context.Context, challengeID string) (*DedupChallenge, error) {
+	oid, err := primitive.ObjectIDFromHex(challengeID)
+	if err != nil {
+		return nil, errorf(ErrInvalidArgument, "invalid challenge id: %w", err)
+	}
+
+	var challenge DedupChallenge
+	err = s.db.Collection("dedup_challenges").FindOneAndDelete(ctx, bson.M{"_id": oid}).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, errorf(ErrNotFound, "challenge not found or already used")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load challenge: %w", err)
+	}
+	// The TTL index removes stale challenges lazily; enforce the deadline here
+	if time.Since(challenge.CreatedAt) > ChallengeTTL {
+		return nil, errorf(ErrConflict, "challenge expired")
+	}
+	return &challenge, nil
+}
+
+func (s *FileService) checkProof(ctx context.Context, source *models.FileMetadata, challenge *DedupChallenge, proof string) error {
+	data, err := s.readFileRange(ctx, source, challenge.Offset, challenge.Length)
+	if err != nil {
+		return fmt.Errorf("failed to read challenge range: %w", err)
+	}
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil {
+		return fmt.Errorf("corrupt challenge nonce: %w", err)
+	}
+
+	hasher := sha256.New()
+	hasher.Write(nonce)
+	hasher.Write(data)
+	expected := hex.EncodeToString(hasher.Sum(nil))
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(proof))) != 1 {
+		return errorf(ErrInvalidArgument, "proof of possession failed")
+	}
+	return nil
+}
+
+// readFileRange returns length bytes of a file starting at offset.
+func (s *FileService) readFileRange(ctx context.Context, metadata *models.FileMetadata, offset, length int64) ([]byte, error) {
+	if offset < 0 || offset+length > metadata.Size {
+		return nil, fmt.Errorf("range %d+%d outside file", offset, length)
+	}
+	var out bytes.Buffer
+	if err := s.assembleRange(ctx, metadata, offset, length, &out, nil); err != nil {
+		return nil, err
+	}
+	if int64(out.Len()) != length {
+		return nil, fmt.Errorf("read %d bytes of range %d+%d", out.Len(), offset, length)
+	}
+	return out.Bytes(), nil
+}
+
+// cloneFile creates a completed file that shares source's data chunks, taking
+// a reference on each. Parity chunks are owned by a single file, so the clone
+// is stored in standard mode.
+func (s *FileService) cloneFile(ctx context.Context, source *models.FileMetadata, req DedupRequest) (*models.FileMetadata, error) {
+	chunks := uniqueChunks(source.Chunks)
+	acquired := make([]models.FileChunk, 0, len(chunks))
+	release := func() {
+		for _, c := range acquired {
+			if err := s.releaseChunk(ctx, c, 0); err != nil {
+				slog.ErrorContext(ctx, "Failed to release chunk", "hash", c.Hash, "error", err)
+			}
+		}
+	}
+
+	collection := s.db.Collection("chunks")
+	for _, c := range chunks {
+		if c.Hash == "" {
+			release()
+			return nil, fmt.Errorf("chunk %d: %w", c.Sequence, errNotShareable)
+		}
+		res, err := collection.UpdateOne(ctx,
+			bson.M{"_id": c.Hash, "file_id": c.FileID},
+			bson.M{"$inc": bson.M{"ref_count": 1}, "$set": bson.M{"updated_at": time.Now()}})
+		if err == nil && res.MatchedCount == 0 {
+			err = errNotShareable
+		}
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("failed to reference chunk %d: %w", c.Sequence, err)
+		}
+		acquired = append(acquired, c)
+	}
+
+	now := time.Now()
+	mimeType := req.MimeType
+	if mimeType == "" {
+		mimeType = source.MimeType
+	}
+	metadata := &models.FileMetadata{
+		ID:           primitive.NewObjectID(),
+		Name:         req.Name,
+		Size:         source.Size,
+		MimeType:     mimeType,
+		Status:       "completed",
+		Chunks:       chunks,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		StorageMode:  models.StorageModeStandard,
+		Hash:         source.Hash,
+		HashVerified: true,
+	}
+	if _, err := s.db.Collection("files").InsertOne(ctx, metadata); err != nil {
+		release()
+		return nil, fmt.Errorf("failed to insert file metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// verifyFileHash recomputes a completed file's SHA-256 and marks the declared
+// hash as verified, or drops it if the content does not match.
+func (s *FileService) verifyFileHash(ctx context.Context, fileID string) error {
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	if metadata.Hash == "" || metadata.HashVerified {
+		return nil
+	}
+
+	hasher := sha256.New()
+	if err := s.AssembleFile(ctx, fileID, hasher); err != nil {
+		return fmt.Errorf("failed to hash %s: %w", fileID, err)
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+
+	update := bson.M{"$set": bson.M{"hash_verified": true}}
+	if actual != metadata.Hash {
+		slog.WarnContext(ctx, "Declared file hash does not match content", "file_id", fileID, "declared", metadata.Hash, "actual", actual)
+		update = bson.M{"$set": bson.M{"hash": actual, "hash_verified": true}}
+	}
+
+	dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("files").UpdateOne(dbCtx, bson.M{"_id": metadata.ID}, update); err != nil {
+		return fmt.Errorf("failed to record hash for %s: %w", fileID, err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"telegram-storage/metrics"
+	"telegram-storage/tracing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// getFile returns a download path that Telegram keeps valid for at least an
+// hour. Paths are cached per bot (a file_id is only usable by the bot that
+// resolved it) and refreshed early, or as soon as the file server rejects
+// one.
+
+const (
+	filePathTTL        = 50 * time.Minute
+	filePathSweepLimit = 10000
+)
+
+type filePathKey struct {
+	bot    string
+	fileID string
+}
+
+type filePathEntry struct {
+	path    string
+	expires time.Time
+}
+
+type filePathCache struct {
+	mu      sync.Mutex
+	entries map[filePathKey]filePathEntry
+}
+
+func (c *filePathCache) get(bot, fileID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[filePathKey{bot, fileID}]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.path, true
+}
+
+func (c *filePathCache) put(bot, fileID, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[filePathKey]filePathEntry)
+	}
+	if len(c.entries) >= filePathSweepLimit {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[filePathKey{bot, fileID}] = filePathEntry{path: path, expires: time.Now().Add(filePathTTL)}
+}
+
+func (c *filePathCache) invalidate(bot, fileID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, filePathKey{bot, fileID})
+}
+
+// fileLink returns the download URL of a document, calling getFile only when
+// no fresh path is cached. cached reports whether the path came from the cache.
+func (s *FileService) fileLink(ctx context.Context, b *tgbotapi.BotAPI, fileID string) (link string, cached bool, err error) {
+	if path, ok := s.filePaths.get(b.Self.UserName, fileID); ok {
+		file := tgbotapi.File{FileID: fileID, FilePath: path}
+		return file.Link(b.Token), true, nil
+	}
+
+	_, span := tracing.Start(ctx, "telegram.getFile", tracing.AttrBot.String(b.Self.UserName))
+	file, err := b.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	metrics.ObserveTelegram(b.Self.UserName, "getFile", metrics.Outcome(err))
+	if err != nil {
+		err = telegramError(err)
+		tracing.End(span, err)
+		return "", false, err
+	}
+	tracing.End(span, nil)
+	s.filePaths.put(b.Self.UserName, fileID, file.FilePath)
+	return file.Link(b.Token), false, nil
+}
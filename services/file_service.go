@@ -3,16 +3,21 @@ package services
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
-	"sort"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"telegram-storage/bot"
+	"telegram-storage/metrics"
 	"telegram-storage/models"
+	"telegram-storage/tracing"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -20,52 +25,195 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/time/rate"
 )
 
 const (
 	MaxChunkSize     = 50 * 1024 * 1024 // 50MB per Telegram limit
 	MaxChunksPerFile = 1000
-	MaxRetries       = 3
-	RetryDelay       = 2 * time.Second
 )
 
+// downloadClient has no overall timeout: response bodies are copied straight
+// to clients, so a slow reader would trip it. Stalled fetches are caught by
+// stallTimer instead.
 var downloadClient = &http.Client{
-	Timeout: 120 * time.Second,
 	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 50,
-		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   50,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: chunkReadTimeout,
 	},
 }
 
+// SetDownloadTransport replaces the transport chunk content is fetched from
+// Telegram's file endpoint with, e.g. to route it to a stand-in server in
+// tests.
+func SetDownloadTransport(rt http.RoundTripper) {
+	downloadClient.Transport = rt
+}
+
 type FileService struct {
+	cfg             Config
 	botPool         *bot.BotPool
 	db              *mongo.Database
 	uploadLocks     sync.Map
 	downloadLimiter *rate.Limiter
+	spoolDir        string
+	scrub           scrubState
+	manifestMu      sync.Mutex
+	packs           packState
+	assembleCfg     AssembleConfig
+	assembleBudget  *memoryBudget
+	cache           *chunkCache // nil when disabled
+	filePaths       filePathCache
+	readAhead       *readAhead
+	hls             hlsState
+	thumbs          thumbnailState
+	jobs            *JobQueue
+}
+
+// InitOptions carries the optional per-file settings chosen at /init.
+type InitOptions struct {
+	StorageMode  string
+	DataShards   int
+	ParityShards int
+	Hash         string // client-declared SHA-256 of the whole file, verified after completion
+
+	// Chunking is ChunkingFixed (default) or ChunkingCDC. Zero CDC sizes
+	// fall back to DefaultCDCParams.
+	Chunking string
+	CDC      CDCParams
+
+	// Compression is CompressionNone or CompressionZstd; empty uses the
+	// configured default. It is ignored for already-compressed mime types.
+	Compression string
 }
 
 var AppFileService *FileService
 
-func NewFileService(botPool *bot.BotPool, db *mongo.Database) *FileService {
-	return &FileService{
+// NewFileService creates the service. cfg should have been validated.
+func NewFileService(botPool *bot.BotPool, db *mongo.Database, cfg Config) *FileService {
+	cfg.resolveTools()
+	if cfg.Cache.Dir == "" {
+		cfg.Cache.Dir = filepath.Join(cfg.SpoolDir, "cache")
+	}
+
+	cache, err := newChunkCache(cfg.Cache)
+	if err != nil {
+		slog.Warn("Chunk cache disabled", "error", err)
+	}
+
+	s := &FileService{
+		cfg:             cfg,
 		botPool:         botPool,
 		db:              db,
 		uploadLocks:     sync.Map{},
-		downloadLimiter: rate.NewLimiter(rate.Limit(20), 40),
-	}
+		downloadLimiter: rate.NewLimiter(rate.Limit(cfg.Download.Rate), cfg.Download.Burst),
+		spoolDir:        cfg.SpoolDir,
+		packs:           packState{cfg: cfg.Pack},
+		assembleCfg:     cfg.Assemble,
+		assembleBudget:  &memoryBudget{name: "assemble", limit: cfg.Assemble.MemoryBudget},
+		cache:           cache,
+		readAhead:       newReadAhead(cfg.ReadAhead),
+		hls:             hlsState{cfg: cfg.HLS},
+		thumbs:          thumbnailState{cfg: cfg.Thumbnail},
+		scrub:           scrubState{cfg: cfg.Scrub},
+		jobs:            newJobQueue(db, cfg.Jobs),
+	}
+	s.registerJobHandlers()
+	return s
 }
 
-func (s *FileService) InitUpload(name string, size int64, mimeType string) (*models.FileMetadata, error) {
+func (s *FileService) InitUpload(ctx context.Context, name string, size int64, mimeType string, opts InitOptions) (_ *models.FileMetadata, err error) {
+	ctx, span := tracing.Start(ctx, "FileService.InitUpload", tracing.AttrChunkSize.Int64(size))
+	defer func() { tracing.End(span, err) }()
 
 	if size <= 0 {
-		return nil, fmt.Errorf("invalid file size: %d", size)
+		return nil, errorf(ErrInvalidArgument, "invalid file size: %d", size)
+	}
+
+	chunking := opts.Chunking
+	if chunking == "" {
+		chunking = ChunkingFixed
+	}
+	var cdc CDCParams
+	switch chunking {
+	case ChunkingFixed:
+		expectedChunks := int(math.Ceil(float64(size) / float64(MaxChunkSize)))
+		if expectedChunks > MaxChunksPerFile {
+			return nil, errorf(ErrTooLarge, "file too large: would require %d chunks (max: %d)", expectedChunks, MaxChunksPerFile)
+		}
+	case ChunkingCDC:
+		cdc = s.cfg.CDC
+		if opts.CDC.MinSize != 0 {
+			cdc.MinSize = opts.CDC.MinSize
+		}
+		if opts.CDC.AvgSize != 0 {
+			cdc.AvgSize = opts.CDC.AvgSize
+		}
+		if opts.CDC.MaxSize != 0 {
+			cdc.MaxSize = opts.CDC.MaxSize
+		}
+		if err := cdc.validate(); err != nil {
+			return nil, err
+		}
+		expectedChunks := int(math.Ceil(float64(size) / float64(cdc.AvgSize)))
+		if expectedChunks > MaxCDCChunksPerFile {
+			return nil, errorf(ErrTooLarge, "file too large: would require ~%d chunks (max: %d)", expectedChunks, MaxCDCChunksPerFile)
+		}
+	default:
+		return nil, errorf(ErrInvalidArgument, "invalid chunking: %s", chunking)
 	}
 
-	expectedChunks := int(math.Ceil(float64(size) / float64(MaxChunkSize)))
-	if expectedChunks > MaxChunksPerFile {
-		return nil, fmt.Errorf("file too large: would require %d chunks (max: %d)", expectedChunks, MaxChunksPerFile)
+	storageMode := opts.StorageMode
+	if storageMode == "" {
+		storageMode = models.StorageModeStandard
+		if chunking == ChunkingFixed && s.shouldPack(size) {
+			storageMode = models.StorageModePacked
+		}
+	}
+	var dataShards, parityShards int
+	switch storageMode {
+	case models.StorageModeStandard:
+	case models.StorageModePacked:
+		if chunking != ChunkingFixed || !s.shouldPack(size) {
+			return nil, errorf(ErrInvalidArgument, "packed storage requires fixed chunking and a file of at most %d bytes", s.packs.cfg.Threshold)
+		}
+	case models.StorageModeErasure:
+		dataShards, parityShards = opts.DataShards, opts.ParityShards
+		if dataShards == 0 {
+			dataShards = DefaultDataShards
+		}
+		if parityShards == 0 {
+			parityShards = DefaultParityShards
+		}
+		if err := validateErasureParams(dataShards, parityShards); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errorf(ErrInvalidArgument, "invalid storage mode: %s", storageMode)
+	}
+
+	compression := opts.Compression
+	if compression == "" {
+		compression = s.cfg.Compression
+	}
+	switch compression {
+	case CompressionNone:
+	case CompressionZstd:
+		if !isCompressibleMimeType(mimeType) || storageMode == models.StorageModePacked {
+			compression = CompressionNone
+		}
+	default:
+		return nil, errorf(ErrInvalidArgument, "invalid compression: %s", compression)
+	}
+
+	var hash string
+	if opts.Hash != "" {
+		if hash, err = normalizeFileHash(opts.Hash); err != nil {
+			return nil, err
+		}
 	}
 
 	metadata := models.FileMetadata{
@@ -77,26 +225,41 @@ func (s *FileService) InitUpload(name string, size int64, mimeType string) (*mod
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		Chunks:    []models.FileChunk{},
+
+		StorageMode:  storageMode,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		Hash:         hash,
+	}
+	if chunking == ChunkingCDC {
+		metadata.Chunking = ChunkingCDC
+		metadata.CDCMinSize = cdc.MinSize
+		metadata.CDCAvgSize = cdc.AvgSize
+		metadata.CDCMaxSize = cdc.MaxSize
+	}
+	if compression != CompressionNone {
+		metadata.Compression = compression
 	}
 
+	span.SetAttributes(tracing.AttrFileID.String(metadata.ID.Hex()))
 	collection := s.db.Collection("files")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err := collection.InsertOne(ctx, metadata)
+	_, err = collection.InsertOne(ctx, metadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to insert file metadata: %v", err)
+		return nil, fmt.Errorf("failed to insert file metadata: %w", err)
 	}
 
-	log.Printf("[InitUpload] Created upload %s for file '%s' (%d bytes, ~%d chunks)",
-		metadata.ID.Hex(), name, size, expectedChunks)
+	slog.InfoContext(ctx, "Upload created", "upload_id", metadata.ID.Hex(), "name", name, "size", size,
+		"mode", storageMode, "chunking", chunking, "compression", compression)
 	return &metadata, nil
 }
 
 func (s *FileService) chunkExists(ctx context.Context, uploadID string, sequence int) (bool, error) {
 	oid, err := primitive.ObjectIDFromHex(uploadID)
 	if err != nil {
-		return false, fmt.Errorf("invalid upload id: %v", err)
+		return false, errorf(ErrInvalidArgument, "invalid upload id: %w", err)
 	}
 
 	collection := s.db.Collection("files")
@@ -113,19 +276,58 @@ func (s *FileService) chunkExists(ctx context.Context, uploadID string, sequence
 	return count > 0, nil
 }
 
-func (s *FileService) uploadChunkWithRetry(uploadID string, sequence int, chunkData io.Reader, chunkSize int64, groupID int64) (*models.FileChunk, error) {
+func (s *FileService) uploadChunkWithRetry(ctx context.Context, uploadID string, sequence int, chunkData io.Reader, chunkSize int64, groupID int64, compression string) (*models.FileChunk, error) {
+	var chunk *models.FileChunk
+	err := s.withRetry(ctx, fmt.Sprintf("Chunk %d", sequence), chunkData, func(attempt int) error {
+		ctx, span := tracing.Start(ctx, "FileService.uploadChunkOnce",
+			tracing.AttrFileID.String(uploadID),
+			tracing.AttrChunkSequence.Int(sequence),
+			tracing.AttrChunkSize.Int64(chunkSize),
+			tracing.AttrAttempt.Int(attempt))
+		var err error
+		chunk, err = s.uploadChunkOnce(ctx, uploadID, sequence, chunkData, chunkSize, groupID, compression)
+		if err == nil {
+			span.SetAttributes(tracing.AttrBot.String(chunk.BotToken))
+		}
+		tracing.End(span, err)
+		return err
+	})
+	return chunk, err
+}
+
+// withRetry runs upload until it succeeds, fails with an error that is not
+// worth retrying, or ctx is done, rewinding data between attempts. Throttled
+// attempts wait as long as Telegram asked. label names the upload in logs;
+// upload is passed the attempt number, starting at 1.
+func (s *FileService) withRetry(ctx context.Context, label string, data io.Reader, upload func(attempt int) error) error {
+	maxRetries := s.cfg.Upload.MaxRetries
 	var lastErr error
 
-	for attempt := 0; attempt < MaxRetries; attempt++ {
+	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			backoff := time.Duration(math.Pow(2, float64(attempt))) * RetryDelay
-			log.Printf("[Retry] Chunk %d attempt %d/%d, waiting %v", sequence, attempt+1, MaxRetries, backoff)
-			time.Sleep(backoff)
+			metrics.UploadRetries.Inc()
+			backoff := time.Duration(math.Pow(2, float64(attempt))) * s.cfg.Upload.RetryDelay
+			if seconds := RetryAfter(lastErr); seconds > 0 {
+				backoff = time.Duration(seconds) * time.Second
+			}
+			slog.WarnContext(ctx, "Retrying upload", "upload", label, "attempt", attempt+1, "max_attempts", maxRetries, "backoff", backoff, "error", lastErr)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return fmt.Errorf("%s: %w (last error: %v)", strings.ToLower(label), ctx.Err(), lastErr)
+			}
+
+			// The failed attempt may have consumed part of the reader
+			if seeker, ok := data.(io.Seeker); ok {
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return fmt.Errorf("failed to rewind %s: %w", strings.ToLower(label), err)
+				}
+			}
 		}
 
-		chunk, err := s.uploadChunkOnce(uploadID, sequence, chunkData, chunkSize, groupID)
+		err := upload(attempt + 1)
 		if err == nil {
-			return chunk, nil
+			return nil
 		}
 
 		lastErr = err
@@ -135,24 +337,16 @@ func (s *FileService) uploadChunkWithRetry(uploadID string, sequence int, chunkD
 		}
 	}
 
-	return nil, fmt.Errorf("failed after %d retries: %v", MaxRetries, lastErr)
+	return fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
 }
 
-func isRetryableError(err error) bool {
-	errMsg := err.Error()
-	return strings.Contains(errMsg, "timeout") ||
-		strings.Contains(errMsg, "Too Many Requests") ||
-		strings.Contains(errMsg, "connection") ||
-		strings.Contains(errMsg, "EOF")
-}
-
-func (s *FileService) uploadChunkOnce(uploadID string, sequence int, chunkData io.Reader, chunkSize int64, groupID int64) (*models.FileChunk, error) {
+func (s *FileService) uploadChunkOnce(ctx context.Context, uploadID string, sequence int, chunkData io.Reader, chunkSize int64, groupID int64, compression string) (*models.FileChunk, error) {
 	startTime := time.Now()
-	log.Printf("[DEBUG] [%s] Start processing chunk %d", startTime.Format("15:04:05.000"), sequence) // LOG START
+	slog.DebugContext(ctx, "Uploading chunk", "upload_id", uploadID, "sequence", sequence, "size", chunkSize)
 
 	oid, err := primitive.ObjectIDFromHex(uploadID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid upload id: %v", err)
+		return nil, errorf(ErrInvalidArgument, "invalid upload id: %w", err)
 	}
 
 	// Lock removed to allow parallel uploads
@@ -160,115 +354,364 @@ func (s *FileService) uploadChunkOnce(uploadID string, sequence int, chunkData i
 	// Duplicate chunks (if any) are handled during assembly.
 
 	if chunkSize > MaxChunkSize {
-		return nil, fmt.Errorf("chunk size %d exceeds maximum %d", chunkSize, MaxChunkSize)
+		return nil, errorf(ErrTooLarge, "chunk size %d exceeds maximum %d", chunkSize, MaxChunkSize)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	exists, err := s.chunkExists(ctx, uploadID, sequence)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check chunk existence: %v", err)
+		return nil, fmt.Errorf("failed to check chunk existence: %w", err)
 	}
 	if exists {
-		log.Printf("[UploadChunk] Chunk %d already exists for upload %s (idempotent)", sequence, uploadID)
+		slog.DebugContext(ctx, "Chunk already uploaded", "upload_id", uploadID, "sequence", sequence)
+		return &models.FileChunk{Sequence: sequence}, nil
+	}
+
+	chunk, deduplicated, err := s.storeChunk(ctx, fmt.Sprintf("chunk_%s_%d", uploadID, sequence),
+		fmt.Sprintf("ID: %s\nPart: %d", uploadID, sequence), chunkData, chunkSize, groupID, compression)
+	if err != nil {
+		return nil, err
+	}
+	chunk.Sequence = sequence
+
+	// Only push if a concurrent request has not already stored this sequence,
+	// otherwise the reference taken above would never be released.
+	collection := s.db.Collection("files")
+	filter := bson.M{"_id": oid, "chunks.sequence": bson.M{"$ne": sequence}}
+	update := bson.M{
+		"$push": bson.M{"chunks": chunk},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+
+	res, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil || res.MatchedCount == 0 {
+		if releaseErr := s.releaseChunk(ctx, chunk, groupID); releaseErr != nil {
+			slog.ErrorContext(ctx, "Failed to release chunk", "hash", chunk.Hash, "error", releaseErr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update db: %w", err)
+		}
+		slog.DebugContext(ctx, "Chunk already uploaded", "upload_id", uploadID, "sequence", sequence)
 		return &models.FileChunk{Sequence: sequence}, nil
 	}
 
-	currentBot := s.botPool.GetNextBot()
-	if currentBot == nil {
-		return nil, fmt.Errorf("no bots available")
+	slog.DebugContext(ctx, "Chunk uploaded", "upload_id", uploadID, "sequence", sequence, "size", chunkSize,
+		"stored_size", storedSize(chunk), "duration", time.Since(startTime), "bot", chunk.BotToken,
+		"message_id", chunk.MessageID, "deduplicated", deduplicated)
+	return &chunk, nil
+}
+
+// storeChunk stores chunk data under a new reference: it reuses the Telegram
+// document of identical content when there is one and otherwise uploads the
+// data as a document called name. The caller owns the reference and must
+// release it if the chunk ends up unused.
+func (s *FileService) storeChunk(ctx context.Context, name, caption string, chunkData io.Reader, chunkSize int64, groupID int64, compression string) (models.FileChunk, bool, error) {
+	chunkData, hash, err := hashChunk(chunkData)
+	if err != nil {
+		return models.FileChunk{}, false, err
 	}
+	original := chunkData
 
-	fileName := fmt.Sprintf("chunk_%s_%d", uploadID, sequence)
-	fileReader := tgbotapi.FileReader{Name: fileName, Reader: chunkData}
-	doc := tgbotapi.NewDocument(groupID, fileReader)
-	doc.Caption = fmt.Sprintf("ID: %s\nPart: %d", uploadID, sequence)
+	chunk := models.FileChunk{
+		Size: chunkSize,
+		Hash: hash,
+	}
 
-	msg, err := currentBot.Send(doc)
+	// Reuse the Telegram document if this content is already stored
+	stored, err := s.acquireChunk(ctx, hash, chunkSize)
 	if err != nil {
-		return nil, fmt.Errorf("telegram upload failed: %v", err)
+		return chunk, false, err
+	}
+	deduplicated := stored != nil
+
+	if !deduplicated {
+		currentBot := s.botPool.GetNextBot()
+		if currentBot == nil {
+			return chunk, false, errorf(ErrUpstreamUnavailable, "no bots available")
+		}
+
+		if compression == CompressionZstd {
+			stored, codec, err := compressChunk(chunkData)
+			if err != nil {
+				return chunk, false, err
+			}
+			chunkData = bytes.NewReader(stored)
+			if codec != "" {
+				chunk.Codec = codec
+				chunk.StoredSize = int64(len(stored))
+			}
+		}
+
+		if chunk.Codec != "" {
+			caption += fmt.Sprintf("\nCodec: %s\nSize: %d", chunk.Codec, chunkSize)
+		}
+		msg, err := sendDocument(ctx, currentBot, groupID, name, caption, chunkData)
+		if err != nil {
+			return chunk, false, err
+		}
+		chunk.MessageID = msg.MessageID
+		chunk.FileID = msg.Document.FileID
+		chunk.BotToken = currentBot.Self.UserName
+		chunk.GroupID = groupID
+
+		stored, err = s.registerChunk(ctx, chunk)
+		if err != nil {
+			return chunk, false, err
+		}
+		if stored != nil {
+			// Lost a race with another upload of the same content; keep theirs
+			if err := s.deleteChunkMessage(chunk, groupID); err != nil {
+				slog.WarnContext(ctx, "Failed to delete duplicate chunk", "hash", hash, "error", err)
+			}
+			deduplicated = true
+		}
+	}
+	if deduplicated {
+		chunk.MessageID = stored.MessageID
+		chunk.FileID = stored.FileID
+		chunk.BotToken = stored.BotToken
+		chunk.GroupID = stored.GroupID
+		chunk.Codec = stored.Codec
+		chunk.StoredSize = stored.StoredSize
 	}
 
+	if s.cache != nil && s.cache.cfg.WriteThrough {
+		// Make just-uploaded files instant to read back
+		if seeker, ok := original.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+				s.cache.put(hash, chunkSize, original)
+			}
+		}
+	}
+	return chunk, deduplicated, nil
+}
+
+func sendDocument(ctx context.Context, b *tgbotapi.BotAPI, groupID int64, name, caption string, data io.Reader) (_ *tgbotapi.Message, err error) {
+	// The bot API client takes no context, so the span only times the call
+	_, span := tracing.Start(ctx, "telegram.sendDocument", tracing.AttrBot.String(b.Self.UserName))
+	defer func() { tracing.End(span, err) }()
+
+	counted := &countingReader{r: data}
+	doc := tgbotapi.NewDocument(groupID, tgbotapi.FileReader{Name: name, Reader: counted})
+	doc.Caption = caption
+
+	start := time.Now()
+	msg, err := b.Send(doc)
+	outcome := metrics.Outcome(err)
+	metrics.ObserveTelegram(b.Self.UserName, "sendDocument", outcome)
+	metrics.UploadDuration.WithLabelValues(b.Self.UserName, outcome).Observe(metrics.Since(start))
+	metrics.UploadBytes.WithLabelValues(b.Self.UserName).Add(float64(counted.n))
+	span.SetAttributes(tracing.AttrChunkSize.Int64(counted.n))
+	if err != nil {
+		return nil, fmt.Errorf("telegram upload failed: %w", telegramError(err))
+	}
 	if msg.Document == nil {
 		return nil, fmt.Errorf("no document in message")
 	}
+	return &msg, nil
+}
 
-	chunk := models.FileChunk{
-		Sequence:  sequence,
-		MessageID: msg.MessageID,
-		FileID:    msg.Document.FileID,
-		BotToken:  currentBot.Self.UserName,
-		Size:      chunkSize,
+func (s *FileService) UploadChunk(ctx context.Context, uploadID string, sequence int, chunkData io.Reader, chunkSize int64, groupID int64) (_ *models.FileChunk, err error) {
+	ctx, span := tracing.Start(ctx, "FileService.UploadChunk",
+		tracing.AttrFileID.String(uploadID),
+		tracing.AttrChunkSequence.Int(sequence),
+		tracing.AttrChunkSize.Int64(chunkSize))
+	defer func() { tracing.End(span, err) }()
+
+	metadata, err := s.GetFileMetadata(ctx, uploadID)
+	if err != nil {
+		return nil, err
 	}
 
-	collection := s.db.Collection("files")
-	filter := bson.M{"_id": oid}
-	update := bson.M{
-		"$push": bson.M{"chunks": chunk},
-		"$set":  bson.M{"updated_at": time.Now()},
+	if metadata.Chunking == ChunkingCDC {
+		return s.uploadPart(ctx, metadata, sequence, chunkData, chunkSize)
+	}
+	if metadata.StorageMode == models.StorageModePacked {
+		return s.uploadPacked(ctx, metadata, sequence, chunkData, chunkSize, groupID)
 	}
 
-	_, err = collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		return nil, fmt.Errorf("failed to update db: %v", err)
+	// Erasure-coded uploads keep a local copy of each chunk until parity is computed
+	if metadata.IsErasureCoded() {
+		path, err := s.spoolChunk(uploadID, sequence, chunkData)
+		if err != nil {
+			return nil, err
+		}
+		spooled, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spooled chunk: %w", err)
+		}
+		defer spooled.Close()
+		chunkData = spooled
 	}
 
-	log.Printf("[Upload] Chunk %d/%s uploaded (%.2f KB, %v, bot: %s, msg: %d)",
-		sequence, uploadID, float64(chunkSize)/1024, time.Since(startTime), currentBot.Self.UserName, msg.MessageID)
-	return &chunk, nil
+	return s.uploadChunkWithRetry(ctx, uploadID, sequence, chunkData, chunkSize, groupID, metadata.Compression)
 }
 
-func (s *FileService) UploadChunk(uploadID string, sequence int, chunkData io.Reader, chunkSize int64, groupID int64) (*models.FileChunk, error) {
-	return s.uploadChunkWithRetry(uploadID, sequence, chunkData, chunkSize, groupID)
+// CompleteUpload marks an upload as completed and returns the file's new
+// status. For erasure-coded files it first computes the parity stripes,
+// placing parity shards round-robin over parityGroups (or groupID when none
+// are configured). Content-defined uploads still have to be re-chunked and
+// sent to Telegram, which takes too long for a request: they are queued and
+// left "processing" until the job completes them.
+func (s *FileService) CompleteUpload(ctx context.Context, uploadID string, groupID int64, parityGroups []int64) (status string, err error) {
+	ctx, span := tracing.Start(ctx, "FileService.CompleteUpload", tracing.AttrFileID.String(uploadID))
+	defer func() { tracing.End(span, err) }()
+
+	metadata, err := s.GetFileMetadata(ctx, uploadID)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case metadata.Status == "completed":
+		return metadata.Status, nil
+	case metadata.Chunking == ChunkingCDC:
+		return s.queueChunkUpload(ctx, metadata, groupID, parityGroups)
+	}
+	if err := s.finishUpload(ctx, metadata, groupID, parityGroups); err != nil {
+		return "", err
+	}
+	return "completed", nil
 }
 
-func (s *FileService) CompleteUpload(uploadID string) error {
-	oid, err := primitive.ObjectIDFromHex(uploadID)
-	if err != nil {
-		return fmt.Errorf("invalid upload id: %v", err)
+// finishUpload does the work of completing an upload whose chunks are all
+// stored.
+func (s *FileService) finishUpload(ctx context.Context, metadata *models.FileMetadata, groupID int64, parityGroups []int64) error {
+	uploadID := metadata.ID.Hex()
+	if metadata.StorageMode == models.StorageModePacked && metadata.Pack == nil {
+		return errorf(ErrConflict, "upload incomplete: file has not been uploaded")
+	}
+	if metadata.IsErasureCoded() {
+		chunks := uniqueChunks(metadata.Chunks)
+		if err := validateContiguousChunks(metadata, chunks); err != nil {
+			return errorf(ErrConflict, "upload incomplete: %w", err)
+		}
+		if err := s.encodeParity(ctx, metadata, chunks, groupID, parityGroups); err != nil {
+			return fmt.Errorf("failed to encode parity: %w", err)
+		}
+	}
+	if metadata.IsErasureCoded() || metadata.Chunking == ChunkingCDC {
+		s.removeSpool(uploadID)
 	}
 
 	collection := s.db.Collection("files")
-	filter := bson.M{"_id": oid}
-	update := bson.M{"$set": bson.M{"status": "completed", "updated_at": time.Now()}}
+	filter := bson.M{"_id": metadata.ID}
+	update := bson.M{
+		"$set":   bson.M{"status": "completed", "updated_at": time.Now()},
+		"$unset": bson.M{"parts": ""},
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	res, err := collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return fmt.Errorf("failed to complete upload: %v", err)
+		return fmt.Errorf("failed to complete upload: %w", err)
 	}
 	if res.MatchedCount == 0 {
-		return fmt.Errorf("upload not found")
+		return errorf(ErrNotFound, "upload not found")
 	}
 
 	s.uploadLocks.Delete(uploadID)
-	log.Printf("[Complete] Upload %s marked as completed", uploadID)
+	metadata.Status = "completed"
+	slog.InfoContext(ctx, "Upload completed", "upload_id", uploadID)
+
+	// A declared hash only becomes a deduplication target once the server
+	// has hashed the stored content itself
+	if metadata.Hash != "" && !metadata.HashVerified {
+		if _, _, err := s.enqueueFileJob(ctx, JobTypeVerifyHash, uploadID, 0); err != nil {
+			slog.WarnContext(ctx, "Failed to queue hash verification", "upload_id", uploadID, "error", err)
+		}
+	}
+
+	if err := s.queueHLS(ctx, metadata, groupID); err != nil {
+		slog.WarnContext(ctx, "Failed to queue video processing", "upload_id", uploadID, "error", err)
+	}
+	if err := s.queueThumbnails(ctx, metadata); err != nil {
+		slog.WarnContext(ctx, "Failed to queue thumbnails", "upload_id", uploadID, "error", err)
+	}
+
+	// The manifest only matters for disaster recovery, so a failure here
+	// should not fail the upload. Packed files get theirs when the pack is sealed.
+	packPending := metadata.Pack != nil && metadata.Pack.Location == nil
+	if metadata.ManifestMessageID == 0 && !packPending {
+		if _, err := s.postManifest(ctx, metadata, groupID); err != nil {
+			slog.WarnContext(ctx, "Failed to post manifest", "file_id", uploadID, "error", err)
+		}
+	}
 	return nil
 }
 
-func (s *FileService) GetFileMetadata(fileID string) (*models.FileMetadata, error) {
+func (s *FileService) GetFileMetadata(ctx context.Context, fileID string) (*models.FileMetadata, error) {
 	oid, err := primitive.ObjectIDFromHex(fileID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid file id: %v", err)
+		return nil, errorf(ErrInvalidArgument, "invalid file id: %w", err)
 	}
 
 	collection := s.db.Collection("files")
 	var metadata models.FileMetadata
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	if err = collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&metadata); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("file not found")
+			return nil, errorf(ErrNotFound, "file not found")
 		}
-		return nil, fmt.Errorf("failed to get metadata: %v", err)
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
 	}
 	return &metadata, nil
 }
 
+// UploadStatus reports which parts of an upload the server has, so a client
+// can resume it.
+type UploadStatus struct {
+	UploadID string         `json:"upload_id"`
+	Name     string         `json:"name"`
+	Size     int64          `json:"size"`
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"` // why processing a completed upload failed
+	Received []UploadedPart `json:"received"`
+}
+
+type UploadedPart struct {
+	Sequence int   `json:"sequence"`
+	Size     int64 `json:"size"`
+}
+
+func (s *FileService) GetUploadStatus(ctx context.Context, uploadID string) (*UploadStatus, error) {
+	metadata, err := s.GetFileMetadata(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &UploadStatus{
+		UploadID: uploadID,
+		Name:     metadata.Name,
+		Size:     metadata.Size,
+		Status:   metadata.Status,
+		Received: []UploadedPart{},
+	}
+	parts := metadata.Chunks
+	if metadata.Chunking == ChunkingCDC && metadata.Status != "completed" {
+		parts = metadata.Parts
+		job, err := s.jobs.latestJob(ctx, chunkUploadJobKey(uploadID))
+		if err != nil {
+			return nil, err
+		}
+		if job != nil && job.Status == models.JobDead {
+			status.Error = job.LastError
+		}
+	}
+	for _, c := range uniqueChunks(parts) {
+		status.Received = append(status.Received, UploadedPart{Sequence: c.Sequence, Size: c.Size})
+	}
+	if metadata.Pack != nil {
+		status.Received = append(status.Received, UploadedPart{Sequence: 0, Size: metadata.Size})
+	}
+	return status, nil
+}
+
 func (s *FileService) findBotByUsername(username string) *tgbotapi.BotAPI {
 	for _, bot := range s.botPool.GetAllBots() {
 		if bot.Self.UserName == username {
@@ -278,173 +721,297 @@ func (s *FileService) findBotByUsername(username string) *tgbotapi.BotAPI {
 	return nil
 }
 
-func (s *FileService) DownloadChunk(chunk models.FileChunk, writer io.Writer) error {
-	if err := s.downloadLimiter.Wait(context.Background()); err != nil {
-		return fmt.Errorf("rate limit error: %v", err)
-	}
-
+// botForChunk returns the bot that uploaded the chunk, or the next bot in the
+// pool if that bot is no longer configured.
+func (s *FileService) botForChunk(chunk models.FileChunk) (*tgbotapi.BotAPI, error) {
 	targetBot := s.findBotByUsername(chunk.BotToken)
 	if targetBot == nil {
-		log.Printf("[Download] Bot '%s' not found for chunk %d, using fallback", chunk.BotToken, chunk.Sequence)
+		slog.Warn("Bot of chunk not configured, using fallback", "bot", chunk.BotToken, "sequence", chunk.Sequence)
 		targetBot = s.botPool.GetNextBot()
 		if targetBot == nil {
-			return fmt.Errorf("no bots available")
+			return nil, errorf(ErrUpstreamUnavailable, "no bots available")
 		}
 	}
+	return targetBot, nil
+}
 
-	fileConfig := tgbotapi.FileConfig{FileID: chunk.FileID}
-	file, err := targetBot.GetFile(fileConfig)
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+// botLabel names the bot that serves chunk in metrics. Only configured
+// usernames are used, so a label can never carry anything else.
+func (s *FileService) botLabel(chunk models.FileChunk) string {
+	if b := s.findBotByUsername(chunk.BotToken); b != nil {
+		return b.Self.UserName
 	}
+	return "unknown"
+}
 
-	link := file.Link(targetBot.Token)
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+// meteredBody counts the bytes read from the Telegram file server.
+type meteredBody struct {
+	io.ReadCloser
+	bot string
+}
+
+func (m *meteredBody) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	metrics.DownloadBytes.WithLabelValues(m.bot).Add(float64(n))
+	return n, err
+}
+
+// openChunk starts downloading a chunk's Telegram document. A non-empty
+// byteRange is sent as the Range header; callers must check whether the
+// server answered 206 or returned the whole document.
+func (s *FileService) openChunk(ctx context.Context, chunk models.FileChunk, byteRange string) (*http.Response, error) {
+	waitStart := time.Now()
+	err := s.downloadLimiter.Wait(ctx)
+	metrics.DownloadLimiterWait.Observe(metrics.Since(waitStart))
+	if err != nil {
+		return nil, fmt.Errorf("rate limit error: %w", err)
+	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	targetBot, err := s.botForChunk(chunk)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return nil, err
 	}
+	bot := targetBot.Self.UserName
+
+	for {
+		link, cached, err := s.fileLink(ctx, targetBot, chunk.FileID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+
+		resp, err := downloadClient.Do(req)
+		if err != nil {
+			metrics.ObserveTelegram(bot, "download", metrics.OutcomeError)
+			return nil, fmt.Errorf("failed to download file: %w", telegramError(err))
+		}
+		metrics.ObserveTelegram(bot, "download", metrics.StatusOutcome(resp.StatusCode))
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+			resp.Body = &meteredBody{ReadCloser: resp.Body, bot: bot}
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		// A cached path may have expired early; resolve it again once
+		if cached && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest) {
+			s.filePaths.invalidate(bot, chunk.FileID)
+			continue
+		}
+		return nil, statusError(resp.StatusCode)
+	}
+}
+
+// DownloadChunk writes the stored bytes of a chunk to writer. Chunks are
+// served from the local cache when possible and added to it otherwise.
+func (s *FileService) DownloadChunk(ctx context.Context, chunk models.FileChunk, writer io.Writer) error {
+	if s.cache != nil && chunk.Hash != "" {
+		if hit, err := s.cache.get(chunk.Hash, chunk.Size, writer); hit {
+			return err
+		}
+		if cw := s.cache.writer(chunk.Hash, chunk.Size); cw != nil {
+			if err := s.downloadChunkUncached(ctx, chunk, io.MultiWriter(writer, cw)); err != nil {
+				cw.abort()
+				return err
+			}
+			cw.commit()
+			return nil
+		}
+	}
+	return s.downloadChunkUncached(ctx, chunk, writer)
+}
+
+// downloadChunkUncached always fetches the chunk from Telegram.
+func (s *FileService) downloadChunkUncached(ctx context.Context, chunk models.FileChunk, writer io.Writer) (err error) {
+	ctx, span := tracing.Start(ctx, "FileService.downloadChunk",
+		tracing.AttrChunkSequence.Int(chunk.Sequence),
+		tracing.AttrChunkSize.Int64(chunk.Size),
+		tracing.AttrBot.String(s.botLabel(chunk)))
+	defer func() { tracing.End(span, err) }()
 
-	resp, err := downloadClient.Do(req)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stall := newStallTimer(cancel)
+	defer stall.stop()
+
+	start := time.Now()
+	resp, err := s.openChunk(ctx, chunk, "")
 	if err != nil {
-		return fmt.Errorf("failed to download file: %v", err)
+		metrics.DownloadDuration.WithLabelValues(s.botLabel(chunk), metrics.OutcomeError).Observe(metrics.Since(start))
+		return stall.wrap(err)
 	}
 	defer resp.Body.Close()
+	stall.stop()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed with status: %d", resp.StatusCode)
+	body, err := decodeChunk(chunk.Codec, stall.reader(resp.Body))
+	if err != nil {
+		return stall.wrap(err)
 	}
+	defer body.Close()
 
-	written, err := io.Copy(writer, resp.Body)
+	written, err := io.Copy(writer, body)
+	metrics.DownloadDuration.WithLabelValues(s.botLabel(chunk), metrics.Outcome(err)).Observe(metrics.Since(start))
 	if err != nil {
-		return fmt.Errorf("failed to write file: %v", err)
+		return fmt.Errorf("failed to write file: %w", stall.wrap(err))
 	}
 
 	if written != chunk.Size {
-		log.Printf("[Download] Chunk %d size mismatch: expected %d, got %d", chunk.Sequence, chunk.Size, written)
+		slog.WarnContext(ctx, "Chunk size mismatch", "sequence", chunk.Sequence, "expected", chunk.Size, "got", written)
 	}
 
 	return nil
 }
 
-func (s *FileService) AssembleFile(fileID string, writer io.Writer) error {
-	metadata, err := s.GetFileMetadata(fileID)
+func (s *FileService) AssembleFile(ctx context.Context, fileID string, writer io.Writer) (err error) {
+	ctx, span := tracing.Start(ctx, "FileService.AssembleFile", tracing.AttrFileID.String(fileID))
+	defer func() { tracing.End(span, err) }()
+
+	metadata, err := s.GetFileMetadata(ctx, fileID)
 	if err != nil {
 		return err
 	}
 	if metadata.Status != "completed" {
-		return fmt.Errorf("file upload not completed")
-	}
-
-	// Sắp xếp chunks trước (bắt buộc)
-	sort.Slice(metadata.Chunks, func(i, j int) bool {
-		return metadata.Chunks[i].Sequence < metadata.Chunks[j].Sequence
-	})
-
-	totalChunks := len(metadata.Chunks)
-	if totalChunks == 0 {
-		return nil
-	}
-
-	// === CÀI ĐẶT NÀY QUYẾT ĐỊNH TỐC ĐỘ & MEMORY ===
-	const maxConcurrent = 15 // 10–20 là sweet spot
-	// ===============================================
-
-	semaphore := make(chan struct{}, maxConcurrent) // giới hạn số goroutine download cùng lúc
-
-	type chunkResult struct {
-		seq  int
-		data []byte
-		err  error
+		return errorf(ErrConflict, "file upload not completed")
 	}
+	return s.assembleRange(ctx, metadata, 0, metadata.Size, writer, nil)
+}
 
-	resultChan := make(chan chunkResult, totalChunks)
+// AssembleRange writes length bytes of a file starting at offset, downloading
+// only the chunks that overlap the range.
+func (s *FileService) AssembleRange(ctx context.Context, fileID string, offset, length int64, writer io.Writer) error {
+	return s.StreamRange(ctx, "", fileID, offset, length, writer)
+}
 
-	// Launch tất cả worker
-	for _, chunk := range metadata.Chunks {
-		semaphore <- struct{}{} // acquire
-		go func(c models.FileChunk) {
-			defer func() { <-semaphore }() // release
+// StreamRange is AssembleRange for a range request from client, any string
+// that identifies the reader. Clients reading sequentially get read-ahead.
+func (s *FileService) StreamRange(ctx context.Context, client, fileID string, offset, length int64, writer io.Writer) (err error) {
+	ctx, span := tracing.Start(ctx, "FileService.StreamRange",
+		tracing.AttrFileID.String(fileID),
+		attribute.Int64("range.offset", offset),
+		attribute.Int64("range.length", length))
+	defer func() { tracing.End(span, err) }()
 
-			var buf bytes.Buffer
-			if err := s.DownloadChunk(c, &buf); err != nil {
-				resultChan <- chunkResult{seq: c.Sequence, err: err}
-				return
-			}
-			// Chuyển thành []byte để gửi qua channel (chunk max 50MB → an toàn)
-			data := buf.Bytes()
-			resultChan <- chunkResult{seq: c.Sequence, data: data}
-		}(chunk)
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return err
 	}
-
-	// Thu thập kết quả theo đúng thứ tự
-	buffer := make(map[int][]byte) // buffer các chunk về sớm
-	nextSeq := 0
-	received := 0
-	totalWritten := int64(0)
-
-	log.Printf("[Download] Assembling '%s' (%d chunks, concurrent: %d)", metadata.Name, totalChunks, maxConcurrent)
-
-	for received < totalChunks {
-		res := <-resultChan
-		received++
-
-		if res.err != nil {
-			// Một chunk lỗi → hủy toàn bộ (không thể stream tiếp)
-			return fmt.Errorf("failed chunk %d: %v", res.seq, res.err)
-		}
-
-		buffer[res.seq] = res.data
-
-		// Viết tất cả chunk liên tiếp mà đã có
-		for {
-			if data, ok := buffer[nextSeq]; ok {
-				n, err := writer.Write(data)
-				if err != nil {
-					return err
-				}
-				totalWritten += int64(n)
-				delete(buffer, nextSeq)
-				nextSeq++
-
-				// Log progress
-				if nextSeq%10 == 0 || nextSeq == totalChunks {
-					log.Printf("[Download] Progress: %d/%d chunks (%.1f MB)",
-						nextSeq, totalChunks, float64(totalWritten)/(1024*1024))
-				}
-			} else {
-				break
-			}
-		}
+	if metadata.Status != "completed" {
+		return errorf(ErrConflict, "file upload not completed")
 	}
-
-	if totalWritten != metadata.Size {
-		log.Printf("[Download] WARNING: Size mismatch for '%s': expected %d, wrote %d", metadata.Name, metadata.Size, totalWritten)
+	if offset < 0 || length < 0 || offset+length > metadata.Size {
+		return errorf(ErrInvalidArgument, "range %d+%d outside file of %d bytes", offset, length, metadata.Size)
 	}
+	return s.assembleRange(ctx, metadata, offset, length, writer, s.beginReadAhead(client, metadata, offset))
+}
 
-	log.Printf("[Download] File '%s' assembled successfully (%d bytes)", metadata.Name, totalWritten)
-	return nil
+// chunkOffsets returns the byte offset of each chunk in the file. Chunks are
+// contiguous, so offsets are derived from the sizes; this also covers chunks
+// stored before offsets were recorded.
+func chunkOffsets(chunks []models.FileChunk) []int64 {
+	offsets := make([]int64, len(chunks))
+	var offset int64
+	for i, c := range chunks {
+		offsets[i] = offset
+		offset += c.Size
+	}
+	return offsets
 }
 
-func (s *FileService) ListFiles() ([]models.FileMetadata, error) {
+func (s *FileService) ListFiles(ctx context.Context) ([]models.FileMetadata, error) {
 	collection := s.db.Collection("files")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	// Optimized query: only select necessary fields and use index
 	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
 	cursor, err := collection.Find(ctx, bson.M{"status": "completed"}, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list files: %v", err)
+		return nil, fmt.Errorf("failed to list files: %w", err)
 	}
 	defer cursor.Close(ctx)
 
 	var files []models.FileMetadata
 	if err = cursor.All(ctx, &files); err != nil {
-		return nil, fmt.Errorf("failed to decode files: %v", err)
+		return nil, fmt.Errorf("failed to decode files: %w", err)
 	}
 
 	return files, nil
 }
+
+// MaxListLimit caps the page size of ListFilesPage.
+const MaxListLimit = 1000
+
+// ListFilesPage returns up to limit completed files, newest first, starting
+// after the position encoded in cursor ("" for the first page). next is the
+// cursor of the following page, or "" when there is none.
+func (s *FileService) ListFilesPage(ctx context.Context, limit int, cursor string) (files []models.FileMetadata, next string, err error) {
+	if limit <= 0 || limit > MaxListLimit {
+		return nil, "", errorf(ErrInvalidArgument, "limit must be between 1 and %d", MaxListLimit)
+	}
+	filter := bson.M{"status": "completed"}
+	if cursor != "" {
+		createdAt, id, err := decodeListCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		// Files created in the same millisecond are ordered by ID
+		filter["$or"] = bson.A{
+			bson.M{"created_at": bson.M{"$lt": createdAt}},
+			bson.M{"created_at": createdAt, "_id": bson.M{"$lt": id}},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(limit) + 1)
+	found, err := s.db.Collection("files").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list files: %w", err)
+	}
+	defer found.Close(ctx)
+	if err = found.All(ctx, &files); err != nil {
+		return nil, "", fmt.Errorf("failed to decode files: %w", err)
+	}
+
+	if len(files) > limit {
+		files = files[:limit]
+		last := files[limit-1]
+		next = encodeListCursor(last.CreatedAt, last.ID)
+	}
+	return files, next, nil
+}
+
+// List cursors are opaque to clients: the creation time in milliseconds,
+// which is what MongoDB stores, and the ID of the last file of a page.
+func encodeListCursor(createdAt time.Time, id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%s", createdAt.UnixMilli(), id.Hex())))
+}
+
+func decodeListCursor(cursor string) (time.Time, primitive.ObjectID, error) {
+	invalid := errorf(ErrInvalidArgument, "invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, invalid
+	}
+	ms, hexID, ok := strings.Cut(string(raw), ".")
+	if !ok {
+		return time.Time{}, primitive.NilObjectID, invalid
+	}
+	millis, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, invalid
+	}
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, invalid
+	}
+	return time.UnixMilli(millis).UTC(), id, nil
+}
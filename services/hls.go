@@ -0,0 +1,444 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"telegram-storage/models"
+	"telegram-storage/tracing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Videos are transcoded to HLS in the background with a locally installed
+// ffmpeg. CompleteUpload queues every video file by setting its stream status;
+// workers claim queued files oldest first, assemble the original into the
+// spool and produce one rendition per configured height that is not taller
+// than the source. Each segment is stored as a chunk through the normal
+// pipeline, so segments are deduplicated, cached and reference counted like
+// file chunks. Playlists are rendered from the stored segment list.
+
+// HLSConfig controls HLS processing.
+type HLSConfig struct {
+	Enabled        bool   `yaml:"enabled" env:"HLS_ENABLED"`
+	FFmpeg         string `yaml:"-"` // resolved from Config.FFmpeg; empty disables processing
+	FFprobe        string `yaml:"-"`
+	Heights        []int  `yaml:"renditions" env:"HLS_RENDITIONS"` // rendition heights, tallest first
+	SegmentSeconds int    `yaml:"segment_seconds" env:"HLS_SEGMENT_SECONDS"`
+	Workers        int    `yaml:"workers" env:"HLS_WORKERS"` // default concurrency of HLS jobs
+}
+
+func defaultHLSConfig() HLSConfig {
+	return HLSConfig{Enabled: true, Heights: []int{1080, 720, 480, 360}, SegmentSeconds: 6, Workers: 1}
+}
+
+type hlsState struct {
+	cfg HLSConfig
+}
+
+func isVideoMimeType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "video/")
+}
+
+// hlsBitrate is the video bitrate in kbit/s used for a rendition height.
+func hlsBitrate(height int) int {
+	switch {
+	case height >= 2160:
+		return 14000
+	case height >= 1440:
+		return 9000
+	case height >= 1080:
+		return 5000
+	case height >= 720:
+		return 2800
+	case height >= 480:
+		return 1400
+	case height >= 360:
+		return 800
+	default:
+		return 400
+	}
+}
+
+const hlsAudioBitrate = 128 // kbit/s
+
+// queueHLS queues HLS processing of a completed video file.
+func (s *FileService) queueHLS(ctx context.Context, metadata *models.FileMetadata, groupID int64) error {
+	if s.hls.cfg.FFmpeg == "" || !isVideoMimeType(metadata.MimeType) {
+		return nil
+	}
+	now := time.Now()
+	_, err := s.db.Collection("files").UpdateOne(ctx,
+		bson.M{"_id": metadata.ID, "stream.status": bson.M{"$ne": models.StreamProcessing}},
+		bson.M{"$set": bson.M{
+			"stream.status":     models.StreamQueued,
+			"stream.group_id":   groupID,
+			"stream.queued_at":  now,
+			"stream.updated_at": now,
+		}, "$unset": bson.M{"stream.error": ""}})
+	if err != nil {
+		return fmt.Errorf("failed to queue video processing: %w", err)
+	}
+	job, created, err := s.enqueueFileJob(ctx, JobTypeHLS, metadata.ID.Hex(), groupID)
+	if err != nil {
+		return fmt.Errorf("failed to queue video processing: %w", err)
+	}
+	if created {
+		slog.InfoContext(ctx, "Video processing queued", "file_id", metadata.ID.Hex(), "job_id", job.ID.Hex())
+	}
+	return nil
+}
+
+// QueueHLS (re)queues HLS processing of a completed video file. Existing
+// renditions keep being served until the new ones are ready.
+func (s *FileService) QueueHLS(ctx context.Context, fileID string, groupID int64) error {
+	if s.hls.cfg.FFmpeg == "" {
+		return errorf(ErrConflict, "video processing is disabled")
+	}
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	if metadata.Status != "completed" {
+		return errorf(ErrConflict, "file upload not completed")
+	}
+	if !isVideoMimeType(metadata.MimeType) {
+		return errorf(ErrInvalidArgument, "file is not a video")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return s.queueHLS(ctx, metadata, groupID)
+}
+
+// runHLS is the HLS job handler.
+func (s *FileService) runHLS(ctx context.Context, job *models.Job) error {
+	metadata, err := s.jobFile(ctx, job)
+	if err != nil || metadata == nil || metadata.Status != "completed" || metadata.Stream == nil {
+		return err
+	}
+
+	startTime := time.Now()
+	fileID := metadata.ID.Hex()
+	filter := bson.M{"_id": metadata.ID}
+	if _, err := s.db.Collection("files").UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+		"stream.status":     models.StreamProcessing,
+		"stream.updated_at": startTime,
+	}}); err != nil {
+		return fmt.Errorf("failed to mark %s as processing: %w", fileID, err)
+	}
+	slog.InfoContext(ctx, "Processing video", "file_id", fileID, "name", metadata.Name, "attempt", job.Attempts, "max_attempts", job.MaxAttempts)
+
+	renditions, err := s.processHLS(ctx, metadata)
+
+	dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	filter["stream.status"] = models.StreamProcessing
+	if err != nil {
+		s.releaseRenditions(ctx, renditions, metadata.Stream.GroupID)
+
+		// Only a failure that will not be retried is shown as failed
+		status := models.StreamQueued
+		var perm permanentError
+		if ctx.Err() == nil && (errors.As(err, &perm) || job.Attempts >= job.MaxAttempts) {
+			status = models.StreamFailed
+		}
+		_, updateErr := s.db.Collection("files").UpdateOne(dbCtx, filter, bson.M{"$set": bson.M{
+			"stream.status":     status,
+			"stream.error":      err.Error(),
+			"stream.updated_at": time.Now(),
+		}})
+		if updateErr != nil {
+			slog.ErrorContext(ctx, "Failed to record video processing failure", "file_id", fileID, "error", updateErr)
+		}
+		return err
+	}
+
+	res, err := s.db.Collection("files").UpdateOne(dbCtx, filter, bson.M{
+		"$set": bson.M{
+			"stream.status":     models.StreamReady,
+			"stream.renditions": renditions,
+			"stream.updated_at": time.Now(),
+		},
+		"$unset": bson.M{"stream.error": ""},
+	})
+	if err != nil || res.MatchedCount == 0 {
+		// Deleted while processing
+		s.releaseRenditions(ctx, renditions, metadata.Stream.GroupID)
+		if err != nil {
+			return fmt.Errorf("failed to save renditions of %s: %w", fileID, err)
+		}
+		return nil
+	}
+	s.releaseRenditions(ctx, metadata.Stream.Renditions, metadata.Stream.GroupID)
+	slog.InfoContext(ctx, "Video ready", "file_id", fileID, "renditions", len(renditions), "duration", time.Since(startTime))
+	return nil
+}
+
+// processHLS transcodes a video and uploads its segments. On error the
+// renditions completed so far are returned so their chunks can be released.
+func (s *FileService) processHLS(ctx context.Context, metadata *models.FileMetadata) ([]models.HLSRendition, error) {
+	dir := filepath.Join(s.spoolDir, "hls", metadata.ID.Hex())
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create work dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	f, err := os.Create(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create source file: %w", err)
+	}
+	err = s.assembleRange(ctx, metadata, 0, metadata.Size, f, nil)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to assemble source: %w", err)
+	}
+
+	width, height, err := s.probeVideo(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	var heights []int
+	for _, h := range s.hls.cfg.Heights {
+		if h <= height {
+			heights = append(heights, h)
+		}
+	}
+	if len(heights) == 0 {
+		// Smaller than every configured rendition: keep the source size
+		heights = []int{height &^ 1}
+	}
+
+	var renditions []models.HLSRendition
+	for _, h := range heights {
+		r, err := s.transcodeRendition(ctx, metadata, source, dir, width, height, h)
+		if err != nil {
+			return renditions, fmt.Errorf("%dp: %w", h, err)
+		}
+		renditions = append(renditions, *r)
+	}
+	return renditions, nil
+}
+
+func (s *FileService) probeVideo(ctx context.Context, path string) (width, height int, err error) {
+	out, err := exec.CommandContext(ctx, s.hls.cfg.FFprobe, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height", "-of", "csv=p=0:s=x", path).Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, 0, ctx.Err()
+		}
+		return 0, 0, permanent(fmt.Errorf("ffprobe failed: %w", err))
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(out)), "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, permanent(fmt.Errorf("no video stream found"))
+	}
+	return width, height, nil
+}
+
+// transcodeRendition encodes one rendition with ffmpeg and uploads its segments.
+func (s *FileService) transcodeRendition(ctx context.Context, metadata *models.FileMetadata, source, dir string, srcWidth, srcHeight, height int) (*models.HLSRendition, error) {
+	cfg := s.hls.cfg
+	name := fmt.Sprintf("%dp", height)
+	outDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output dir: %w", err)
+	}
+
+	bitrate := hlsBitrate(height)
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-y", "-i", source,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=-2:%d", height),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-b:v", fmt.Sprintf("%dk", bitrate),
+		"-maxrate", fmt.Sprintf("%dk", bitrate*107/100),
+		"-bufsize", fmt.Sprintf("%dk", bitrate*3/2),
+		// Keyframes on segment boundaries so every segment is the same length
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", cfg.SegmentSeconds), "-sc_threshold", "0",
+		"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", hlsAudioBitrate), "-ac", "2",
+		"-f", "hls", "-hls_time", strconv.Itoa(cfg.SegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, "%05d.ts"),
+		filepath.Join(outDir, "index.m3u8"),
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.FFmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Retrying the same input gives the same result
+		return nil, permanent(fmt.Errorf("ffmpeg failed: %v: %s", err, msg))
+	}
+
+	r := &models.HLSRendition{
+		Name:           name,
+		Width:          (srcWidth*height/srcHeight + 1) &^ 1,
+		Height:         height,
+		Bandwidth:      (bitrate*107/100 + hlsAudioBitrate) * 1000,
+		TargetDuration: cfg.SegmentSeconds,
+	}
+	if err := s.uploadSegments(ctx, metadata, outDir, r); err != nil {
+		s.releaseRenditions(ctx, []models.HLSRendition{*r}, metadata.Stream.GroupID)
+		return nil, err
+	}
+	return r, nil
+}
+
+// uploadSegments stores the segments listed in the rendition's playlist.
+func (s *FileService) uploadSegments(ctx context.Context, metadata *models.FileMetadata, outDir string, r *models.HLSRendition) error {
+	playlist, err := os.Open(filepath.Join(outDir, "index.m3u8"))
+	if err != nil {
+		return fmt.Errorf("failed to open playlist: %w", err)
+	}
+	defer playlist.Close()
+
+	fileID := metadata.ID.Hex()
+	groupID := metadata.Stream.GroupID
+	var duration float64
+	scanner := bufio.NewScanner(playlist)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if duration, err = strconv.ParseFloat(value, 64); err != nil {
+				return fmt.Errorf("invalid playlist line %q", line)
+			}
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if n, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")); err == nil {
+				r.TargetDuration = n
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			segment, err := s.uploadSegment(ctx, fileID, groupID, r.Name, len(r.Segments), filepath.Join(outDir, filepath.Base(line)))
+			if err != nil {
+				return err
+			}
+			r.Segments = append(r.Segments, models.HLSSegment{Duration: duration, Chunk: *segment})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read playlist: %w", err)
+	}
+	if len(r.Segments) == 0 {
+		return fmt.Errorf("ffmpeg produced no segments")
+	}
+	return nil
+}
+
+func (s *FileService) uploadSegment(ctx context.Context, fileID string, groupID int64, rendition string, index int, path string) (*models.FileChunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %d: %w", index, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat segment %d: %w", index, err)
+	}
+	if info.Size() > MaxChunkSize {
+		return nil, permanent(fmt.Errorf("segment %d is %d bytes, over the chunk limit of %d", index, info.Size(), MaxChunkSize))
+	}
+
+	var chunk models.FileChunk
+	err = s.withRetry(ctx, fmt.Sprintf("Segment %s/%d", rendition, index), f, func(attempt int) error {
+		ctx, span := tracing.Start(ctx, "FileService.uploadSegment",
+			tracing.AttrFileID.String(fileID),
+			tracing.AttrChunkSequence.Int(index),
+			tracing.AttrChunkSize.Int64(info.Size()),
+			tracing.AttrAttempt.Int(attempt))
+		var err error
+		chunk, _, err = s.storeChunk(ctx, fmt.Sprintf("hls_%s_%s_%d", fileID, rendition, index),
+			fmt.Sprintf("HLS: %s\nRendition: %s\nSegment: %d", fileID, rendition, index),
+			f, info.Size(), groupID, CompressionNone)
+		tracing.End(span, err)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	chunk.Sequence = index
+	return &chunk, nil
+}
+
+// streamChunks returns the segment chunks of every rendition of a file.
+func streamChunks(metadata *models.FileMetadata) []models.FileChunk {
+	if metadata.Stream == nil {
+		return nil
+	}
+	var chunks []models.FileChunk
+	for _, r := range metadata.Stream.Renditions {
+		for _, seg := range r.Segments {
+			chunks = append(chunks, seg.Chunk)
+		}
+	}
+	return chunks
+}
+
+func (s *FileService) releaseRenditions(ctx context.Context, renditions []models.HLSRendition, groupID int64) {
+	// Runs after failures and cancellation too, so only the trace is inherited
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Minute)
+	defer cancel()
+	for _, r := range renditions {
+		for _, seg := range r.Segments {
+			if err := s.releaseChunk(ctx, seg.Chunk, groupID); err != nil {
+				slog.WarnContext(ctx, "Failed to release segment", "rendition", r.Name, "sequence", seg.Chunk.Sequence, "error", err)
+			}
+		}
+	}
+}
+
+// FindRendition returns the named rendition of a file's stream.
+func FindRendition(metadata *models.FileMetadata, name string) *models.HLSRendition {
+	if metadata.Stream == nil {
+		return nil
+	}
+	for i := range metadata.Stream.Renditions {
+		if metadata.Stream.Renditions[i].Name == name {
+			return &metadata.Stream.Renditions[i]
+		}
+	}
+	return nil
+}
+
+// HLSMasterPlaylist renders the master playlist of a file's stream, with
+// rendition playlists at "<name>/index.m3u8".
+func HLSMasterPlaylist(metadata *models.FileMetadata) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range metadata.Stream.Renditions {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s/index.m3u8\n",
+			r.Bandwidth, r.Width, r.Height, r.Name)
+	}
+	return b.String()
+}
+
+// HLSMediaPlaylist renders the playlist of a rendition, with segments at
+// "<index>.ts" next to it.
+func HLSMediaPlaylist(r *models.HLSRendition) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", r.TargetDuration)
+	for i, seg := range r.Segments {
+		fmt.Fprintf(&b, "#EXTINF:%.6f,\n%05d.ts\n", seg.Duration, i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
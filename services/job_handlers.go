@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"telegram-storage/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// registerJobHandlers wires the job types to the service.
+func (s *FileService) registerJobHandlers() {
+	s.jobs.register(JobTypeDeleteFile, 2, func(ctx context.Context, job *models.Job) error {
+		fileID, err := payloadString(job, "file_id")
+		if err != nil {
+			return err
+		}
+		err = s.deleteFileNow(ctx, fileID, payloadInt64(job, "group_id"))
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+	s.jobs.register(JobTypeVerifyHash, 2, func(ctx context.Context, job *models.Job) error {
+		metadata, err := s.jobFile(ctx, job)
+		if err != nil || metadata == nil {
+			return err
+		}
+		return s.verifyFileHash(ctx, metadata.ID.Hex())
+	})
+	s.jobs.register(JobTypeThumbnail, s.thumbs.cfg.Workers, s.runThumbnail)
+	s.jobs.register(JobTypeHLS, s.hls.cfg.Workers, s.runHLS)
+	s.jobs.register(JobTypeChunkUpload, 2, s.runChunkUpload)
+	s.jobs.register(JobTypeScrub, 1, func(ctx context.Context, job *models.Job) error {
+		return s.RunScrub(ctx, s.scrubConfig())
+	})
+	s.jobs.register(JobTypeCompactPacks, 1, func(ctx context.Context, job *models.Job) error {
+		_, err := s.CompactPacks(ctx)
+		return err
+	})
+	s.jobs.register(JobTypeExpireUploads, 1, func(ctx context.Context, job *models.Job) error {
+		_, err := s.PurgeUploads(ctx, s.cfg.Upload.PendingTTL, payloadInt64(job, "group_id"))
+		return err
+	})
+}
+
+// enqueueFileJob queues a job about one file, at most one per type and file.
+func (s *FileService) enqueueFileJob(ctx context.Context, jobType, fileID string, groupID int64) (*models.Job, bool, error) {
+	payload := bson.M{"file_id": fileID}
+	if groupID != 0 {
+		payload["group_id"] = groupID
+	}
+	return s.jobs.Enqueue(ctx, jobType, payload, JobOptions{UniqueKey: fmt.Sprintf("%s:%s", jobType, fileID)})
+}
+
+// jobFile loads the file a job is about. It returns nil without an error
+// when the file no longer exists, so the job can finish quietly.
+func (s *FileService) jobFile(ctx context.Context, job *models.Job) (*models.FileMetadata, error) {
+	fileID, err := payloadString(job, "file_id")
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if metadata.Status == "deleting" {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+// Jobs returns the job queue.
+func (s *FileService) Jobs() *JobQueue {
+	return s.jobs
+}
+
+// StartJobs runs the job workers until ctx is cancelled.
+func (s *FileService) StartJobs(ctx context.Context) {
+	s.jobs.Start(ctx)
+}
+
+// WaitJobs waits for running jobs to stop after shutdown.
+func (s *FileService) WaitJobs(ctx context.Context) error {
+	return s.jobs.Wait(ctx)
+}
@@ -0,0 +1,637 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"telegram-storage/models"
+	"telegram-storage/tracing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Background work goes through a job queue kept in the jobs collection, so it
+// survives restarts and can be shared by several instances. A worker claims a
+// job by taking a lease on it and keeps extending the lease while the job
+// runs; when a worker dies its lease runs out and the job is claimed again.
+// Failures are retried with exponential backoff until the job runs out of
+// attempts, after which it is kept as dead until an operator retries it. Each
+// job type has its own pool of workers. Jobs that work on this host's spool
+// are pinned to it and only claimed by workers on the same host.
+
+// Job types
+const (
+	JobTypeDeleteFile    = "delete_file"
+	JobTypeVerifyHash    = "verify_hash"
+	JobTypeThumbnail     = "thumbnail"
+	JobTypeHLS           = "hls"
+	JobTypeScrub         = "scrub"
+	JobTypeCompactPacks  = "compact_packs"
+	JobTypeChunkUpload   = "chunk_upload"
+	JobTypeExpireUploads = "expire_uploads"
+)
+
+var jobTypes = []string{JobTypeDeleteFile, JobTypeVerifyHash, JobTypeThumbnail, JobTypeHLS, JobTypeScrub, JobTypeCompactPacks, JobTypeChunkUpload, JobTypeExpireUploads}
+
+// JobConfig controls the job queue.
+type JobConfig struct {
+	Lease        time.Duration  `yaml:"lease" env:"JOB_LEASE"`                 // how long a claimed job is reserved without a heartbeat
+	PollInterval time.Duration  `yaml:"poll_interval" env:"JOB_POLL_INTERVAL"` // how often idle workers look for new jobs
+	MaxAttempts  int            `yaml:"max_attempts" env:"JOB_MAX_ATTEMPTS"`   // default attempts before a job is dead-lettered
+	Backoff      time.Duration  `yaml:"backoff" env:"JOB_BACKOFF"`             // delay before the first retry, doubled on each attempt
+	MaxBackoff   time.Duration  `yaml:"max_backoff" env:"JOB_MAX_BACKOFF"`     // upper bound of the retry delay
+	Concurrency  map[string]int `yaml:"concurrency" env:"JOB_CONCURRENCY"`     // workers per job type, overriding the defaults
+}
+
+func defaultJobConfig() JobConfig {
+	return JobConfig{
+		Lease:        2 * time.Minute,
+		PollInterval: 5 * time.Second,
+		MaxAttempts:  5,
+		Backoff:      30 * time.Second,
+		MaxBackoff:   time.Hour,
+	}
+}
+
+// JobOptions are the optional settings of an enqueued job.
+type JobOptions struct {
+	UniqueKey   string        // skip enqueueing while a job with this key is queued or running
+	Delay       time.Duration // run no earlier than this from now
+	MaxAttempts int           // 0 uses JobConfig.MaxAttempts
+	Local       bool          // only workers on this host may run the job
+}
+
+// JobFilter selects jobs to list.
+type JobFilter struct {
+	Type   string
+	Status string
+	Limit  int64
+}
+
+type jobHandler func(ctx context.Context, job *models.Job) error
+
+type jobWorkers struct {
+	workers int
+	handler jobHandler
+	wake    chan struct{}
+}
+
+// permanentError is a job failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func permanent(err error) error { return permanentError{err} }
+
+// JobQueue runs jobs from the jobs collection.
+type JobQueue struct {
+	db    *mongo.Database
+	cfg   JobConfig
+	owner string // identifies this process in leases
+	host  string // identifies this host for local jobs
+	types map[string]*jobWorkers
+	wg    sync.WaitGroup
+}
+
+func newJobQueue(db *mongo.Database, cfg JobConfig) *JobQueue {
+	host, _ := os.Hostname()
+	return &JobQueue{
+		db:    db,
+		cfg:   cfg,
+		owner: fmt.Sprintf("%s-%d-%s", host, os.Getpid(), primitive.NewObjectID().Hex()[18:]),
+		host:  host,
+		types: make(map[string]*jobWorkers),
+	}
+}
+
+// register sets the handler of a job type. workers is the default
+// concurrency, overridden by JobConfig.Concurrency.
+func (q *JobQueue) register(jobType string, workers int, handler jobHandler) {
+	if n, ok := q.cfg.Concurrency[jobType]; ok {
+		workers = n
+	}
+	q.types[jobType] = &jobWorkers{workers: workers, handler: handler, wake: make(chan struct{}, 1)}
+}
+
+func (q *JobQueue) collection() *mongo.Collection {
+	return q.db.Collection("jobs")
+}
+
+// Enqueue adds a job. With a unique key, an existing queued or running job
+// with the same key is returned instead and created is false.
+func (q *JobQueue) Enqueue(ctx context.Context, jobType string, payload bson.M, opts JobOptions) (job *models.Job, created bool, err error) {
+	if _, ok := q.types[jobType]; !ok {
+		return nil, false, errorf(ErrInvalidArgument, "unknown job type %q", jobType)
+	}
+	now := time.Now()
+	job = &models.Job{
+		ID:          primitive.NewObjectID(),
+		Type:        jobType,
+		Status:      models.JobQueued,
+		Payload:     payload,
+		UniqueKey:   opts.UniqueKey,
+		MaxAttempts: opts.MaxAttempts,
+		RunAt:       now.Add(opts.Delay),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = q.cfg.MaxAttempts
+	}
+	if opts.Local {
+		job.Host = q.host
+	}
+
+	if opts.UniqueKey == "" {
+		if _, err := q.collection().InsertOne(ctx, job); err != nil {
+			return nil, false, fmt.Errorf("failed to enqueue job: %w", err)
+		}
+	} else {
+		doc, err := toBsonM(job)
+		if err != nil {
+			return nil, false, err
+		}
+		delete(doc, "unique_key") // set from the filter on insert
+		filter := bson.M{"unique_key": opts.UniqueKey, "status": bson.M{"$in": bson.A{models.JobQueued, models.JobRunning}}}
+		existing, err := q.upsertUnique(ctx, filter, doc)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to enqueue job: %w", err)
+		}
+		if existing.ID != job.ID {
+			return existing, false, nil
+		}
+	}
+
+	select {
+	case q.types[jobType].wake <- struct{}{}:
+	default:
+	}
+	return job, true, nil
+}
+
+// upsertUnique inserts doc unless a job matches filter, and returns the job
+// that is queued under the key. The unique index on active keys makes the
+// upsert safe: when a concurrent Enqueue inserts first, the duplicate key
+// error is answered with that job.
+func (q *JobQueue) upsertUnique(ctx context.Context, filter, doc bson.M) (*models.Job, error) {
+	for {
+		var job models.Job
+		err := q.collection().FindOneAndUpdate(ctx, filter, bson.M{"$setOnInsert": doc},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&job)
+		if !mongo.IsDuplicateKeyError(err) {
+			return &job, err
+		}
+		err = q.collection().FindOne(ctx, filter).Decode(&job)
+		if err != mongo.ErrNoDocuments {
+			return &job, err
+		}
+		// The other job finished in between; try inserting again
+	}
+}
+
+func toBsonM(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode document: %w", err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to encode document: %w", err)
+	}
+	return doc, nil
+}
+
+// Start runs the workers of every registered job type until ctx is cancelled.
+func (q *JobQueue) Start(ctx context.Context) {
+	var summary []string
+	for name, t := range q.types {
+		for i := 0; i < t.workers; i++ {
+			q.wg.Add(1)
+			go q.worker(ctx, name, t)
+		}
+		summary = append(summary, fmt.Sprintf("%s=%d", name, t.workers))
+	}
+	q.wg.Add(1)
+	go q.reaper(ctx)
+	slog.Info("Job workers started", "owner", q.owner, "workers", strings.Join(summary, ", "))
+}
+
+// Wait blocks until every worker has stopped after the context given to
+// Start was cancelled, or until ctx is done.
+func (q *JobQueue) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("job workers still running: %v", ctx.Err())
+	}
+}
+
+func (q *JobQueue) worker(ctx context.Context, name string, t *jobWorkers) {
+	defer q.wg.Done()
+	for {
+		job, err := q.claim(ctx, name)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to claim job", "job_type", name, "error", err)
+		}
+		if job != nil {
+			q.run(ctx, t, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.wake:
+		case <-time.After(q.cfg.PollInterval):
+		}
+	}
+}
+
+// claim leases the next due job of a type: a queued job whose time has come,
+// or a running job whose worker stopped renewing its lease.
+func (q *JobQueue) claim(ctx context.Context, jobType string) (*models.Job, error) {
+	now := time.Now()
+	filter := bson.M{
+		"type": jobType,
+		"host": bson.M{"$in": bson.A{nil, q.host}},
+		"$or": bson.A{
+			bson.M{"status": models.JobQueued, "run_at": bson.M{"$lte": now}},
+			bson.M{
+				"status":      models.JobRunning,
+				"lease_until": bson.M{"$lt": now},
+				"$expr":       bson.M{"$lt": bson.A{"$attempts", "$max_attempts"}},
+			},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":      models.JobRunning,
+			"lease_owner": q.owner,
+			"lease_until": now.Add(q.cfg.Lease),
+			"started_at":  now,
+			"updated_at":  now,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "run_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job models.Job
+	err := q.collection().FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *JobQueue) run(ctx context.Context, t *jobWorkers, job *models.Job) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go q.heartbeat(jobCtx, cancel, job, done)
+
+	jobCtx, span := tracing.Start(jobCtx, "job "+job.Type,
+		tracing.AttrJobType.String(job.Type),
+		attribute.String("job.id", job.ID.Hex()),
+		tracing.AttrAttempt.Int(job.Attempts))
+	startTime := time.Now()
+	err := runHandler(jobCtx, t.handler, job)
+	tracing.End(span, err)
+	close(done)
+	q.finish(ctx, job, err, time.Since(startTime))
+}
+
+func runHandler(ctx context.Context, handler jobHandler, job *models.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// heartbeat extends the lease of a running job until done is closed, and
+// cancels the job when the lease is lost (for example to an admin cancel).
+func (q *JobQueue) heartbeat(ctx context.Context, cancel context.CancelFunc, job *models.Job, done chan struct{}) {
+	ticker := time.NewTicker(q.cfg.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		dbCtx, dbCancel := context.WithTimeout(ctx, 10*time.Second)
+		res, err := q.collection().UpdateOne(dbCtx,
+			bson.M{"_id": job.ID, "status": models.JobRunning, "lease_owner": q.owner},
+			bson.M{"$set": bson.M{"lease_until": time.Now().Add(q.cfg.Lease), "updated_at": time.Now()}})
+		dbCancel()
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to renew job lease", "job_type", job.Type, "job_id", job.ID.Hex(), "error", err)
+			continue
+		}
+		if res.MatchedCount == 0 {
+			slog.WarnContext(ctx, "Lost job lease, stopping it", "job_type", job.Type, "job_id", job.ID.Hex())
+			cancel()
+			return
+		}
+	}
+}
+
+// finish records the outcome of a job this worker still holds the lease on.
+func (q *JobQueue) finish(ctx context.Context, job *models.Job, err error, elapsed time.Duration) {
+	dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"_id": job.ID, "status": models.JobRunning, "lease_owner": q.owner}
+	unsetLease := bson.M{"lease_owner": "", "lease_until": ""}
+	var update bson.M
+
+	var perm permanentError
+	switch {
+	case err == nil:
+		unsetLease["last_error"] = ""
+		update = bson.M{
+			"$set":   bson.M{"status": models.JobSucceeded, "finished_at": now, "updated_at": now},
+			"$unset": unsetLease,
+		}
+		slog.InfoContext(ctx, "Job succeeded", "job_type", job.Type, "job_id", job.ID.Hex(), "duration", elapsed)
+
+	case ctx.Err() != nil:
+		// Shutting down: hand the job back without counting the attempt
+		update = bson.M{
+			"$set":   bson.M{"status": models.JobQueued, "run_at": now, "updated_at": now},
+			"$unset": unsetLease,
+			"$inc":   bson.M{"attempts": -1},
+		}
+		slog.InfoContext(ctx, "Job interrupted by shutdown, requeued", "job_type", job.Type, "job_id", job.ID.Hex())
+
+	case errors.As(err, &perm) || job.Attempts >= job.MaxAttempts:
+		update = bson.M{
+			"$set":   bson.M{"status": models.JobDead, "last_error": err.Error(), "finished_at": now, "updated_at": now},
+			"$unset": unsetLease,
+		}
+		slog.ErrorContext(ctx, "Job failed permanently", "job_type", job.Type, "job_id", job.ID.Hex(), "attempts", job.Attempts, "error", err)
+
+	default:
+		delay := q.backoff(job.Attempts)
+		update = bson.M{
+			"$set":   bson.M{"status": models.JobQueued, "last_error": err.Error(), "run_at": now.Add(delay), "updated_at": now},
+			"$unset": unsetLease,
+		}
+		slog.WarnContext(ctx, "Job failed, retrying", "job_type", job.Type, "job_id", job.ID.Hex(),
+			"attempt", job.Attempts, "max_attempts", job.MaxAttempts, "backoff", delay, "error", err)
+	}
+
+	if _, err := q.collection().UpdateOne(dbCtx, filter, update); err != nil {
+		slog.ErrorContext(ctx, "Failed to record job outcome", "job_type", job.Type, "job_id", job.ID.Hex(), "error", err)
+	}
+}
+
+func (q *JobQueue) backoff(attempts int) time.Duration {
+	delay := time.Duration(float64(q.cfg.Backoff) * math.Pow(2, float64(attempts-1)))
+	if delay <= 0 || delay > q.cfg.MaxBackoff {
+		return q.cfg.MaxBackoff
+	}
+	return delay
+}
+
+// reaper dead-letters jobs whose lease ran out on their last attempt; they
+// would otherwise never be claimed again.
+func (q *JobQueue) reaper(ctx context.Context) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.cfg.Lease)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		res, err := q.collection().UpdateMany(ctx,
+			bson.M{
+				"status":      models.JobRunning,
+				"lease_until": bson.M{"$lt": now},
+				"$expr":       bson.M{"$gte": bson.A{"$attempts", "$max_attempts"}},
+			},
+			bson.M{
+				"$set":   bson.M{"status": models.JobDead, "last_error": "lease expired on the last attempt", "finished_at": now, "updated_at": now},
+				"$unset": bson.M{"lease_owner": "", "lease_until": ""},
+			})
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to reap expired jobs", "error", err)
+			}
+			continue
+		}
+		if res.ModifiedCount > 0 {
+			slog.WarnContext(ctx, "Dead-lettered jobs whose workers stopped", "jobs", res.ModifiedCount)
+		}
+	}
+}
+
+// ListJobs returns jobs matching filter, newest first.
+func (q *JobQueue) ListJobs(ctx context.Context, filter JobFilter) ([]models.Job, error) {
+	query := bson.M{}
+	if filter.Type != "" {
+		query["type"] = filter.Type
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	limit := filter.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	cursor, err := q.collection().Find(ctx, query, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []models.Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to decode jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// latestJob returns the newest job with a unique key, or nil if there is none.
+func (q *JobQueue) latestJob(ctx context.Context, uniqueKey string) (*models.Job, error) {
+	var job models.Job
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	err := q.collection().FindOne(ctx, bson.M{"unique_key": uniqueKey}, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	return &job, nil
+}
+
+// GetJob returns a job by ID.
+func (q *JobQueue) GetJob(ctx context.Context, jobID string) (*models.Job, error) {
+	oid, err := primitive.ObjectIDFromHex(jobID)
+	if err != nil {
+		return nil, errorf(ErrInvalidArgument, "invalid job id: %w", err)
+	}
+	var job models.Job
+	if err := q.collection().FindOne(ctx, bson.M{"_id": oid}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errorf(ErrNotFound, "job not found")
+		}
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	return &job, nil
+}
+
+// RetryJob requeues a dead or cancelled job with a fresh set of attempts.
+func (q *JobQueue) RetryJob(ctx context.Context, jobID string) (*models.Job, error) {
+	return q.transition(ctx, jobID, bson.A{models.JobDead, models.JobCancelled}, bson.M{
+		"$set":   bson.M{"status": models.JobQueued, "attempts": 0, "run_at": time.Now(), "updated_at": time.Now()},
+		"$unset": bson.M{"finished_at": ""},
+	})
+}
+
+// CancelJob cancels a queued or running job. A running job is stopped by
+// its worker at the next heartbeat.
+func (q *JobQueue) CancelJob(ctx context.Context, jobID string) (*models.Job, error) {
+	now := time.Now()
+	return q.transition(ctx, jobID, bson.A{models.JobQueued, models.JobRunning}, bson.M{
+		"$set":   bson.M{"status": models.JobCancelled, "finished_at": now, "updated_at": now},
+		"$unset": bson.M{"lease_owner": "", "lease_until": ""},
+	})
+}
+
+func (q *JobQueue) transition(ctx context.Context, jobID string, from bson.A, update bson.M) (*models.Job, error) {
+	oid, err := primitive.ObjectIDFromHex(jobID)
+	if err != nil {
+		return nil, errorf(ErrInvalidArgument, "invalid job id: %w", err)
+	}
+	var job models.Job
+	err = q.collection().FindOneAndUpdate(ctx, bson.M{"_id": oid, "status": bson.M{"$in": from}}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		if _, err := q.GetJob(ctx, jobID); err != nil {
+			return nil, err
+		}
+		return nil, errorf(ErrConflict, "job is not %s", strings.Join(stringsOf(from), " or "))
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errorf(ErrConflict, "another job with the same key is queued or running")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update job: %w", err)
+	}
+	if job.Status == models.JobQueued {
+		if t, ok := q.types[job.Type]; ok {
+			select {
+			case t.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return &job, nil
+}
+
+func stringsOf(values bson.A) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = fmt.Sprint(v)
+	}
+	return out
+}
+
+// JobStats counts jobs by type and status.
+func (q *JobQueue) JobStats(ctx context.Context) (map[string]map[string]int, error) {
+	cursor, err := q.collection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "type", Value: "$type"}, {Key: "status", Value: "$status"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count jobs: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	stats := make(map[string]map[string]int)
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				Type   string `bson:"type"`
+				Status string `bson:"status"`
+			} `bson:"_id"`
+			Count int `bson:"count"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, fmt.Errorf("failed to decode job counts: %w", err)
+		}
+		if stats[row.ID.Type] == nil {
+			stats[row.ID.Type] = make(map[string]int)
+		}
+		stats[row.ID.Type][row.ID.Status] = row.Count
+	}
+	return stats, cursor.Err()
+}
+
+// payloadString reads a string field of a job payload.
+func payloadString(job *models.Job, key string) (string, error) {
+	v, ok := job.Payload[key].(string)
+	if !ok || v == "" {
+		return "", permanent(fmt.Errorf("job payload has no %s", key))
+	}
+	return v, nil
+}
+
+// payloadInt64 reads an integer field of a job payload.
+func payloadInt64(job *models.Job, key string) int64 {
+	return toInt64(job.Payload[key])
+}
+
+// payloadInt64s reads an integer array field of a job payload.
+func payloadInt64s(job *models.Job, key string) []int64 {
+	values, _ := job.Payload[key].(bson.A)
+	ints := make([]int64, 0, len(values))
+	for _, v := range values {
+		ints = append(ints, toInt64(v))
+	}
+	return ints
+}
+
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
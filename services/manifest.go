@@ -0,0 +1,233 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"telegram-storage/models"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ManifestVersion       = 1
+	ManifestCaptionPrefix = "MANIFEST: "
+)
+
+// Every completed file gets a manifest document posted to its Telegram group,
+// so the group alone is enough to rebuild the files collection. Manifests form
+// a chain: each one references the previous manifest of the same group by
+// document file ID, and the newest is pinned, so recovery can start from the
+// pinned message and walk backwards without access to chat history.
+
+// ManifestRef points at a previously posted manifest document.
+type ManifestRef struct {
+	MessageID int    `json:"msg" bson:"message_id"`
+	FileID    string `json:"file_id" bson:"file_id"`
+	Bot       string `json:"bot" bson:"bot"`
+	Size      int64  `json:"size" bson:"size"`
+}
+
+// Manifest is the self-describing record of one file posted to Telegram.
+type Manifest struct {
+	Version      int                `json:"v"`
+	ID           string             `json:"id"`
+	Name         string             `json:"name"`
+	Size         int64              `json:"size"`
+	MimeType     string             `json:"mime"`
+	Hash         string             `json:"hash,omitempty"`
+	HashVerified bool               `json:"hash_verified,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+	StorageMode  string             `json:"mode,omitempty"`
+	DataShards   int                `json:"k,omitempty"`
+	ParityShards int                `json:"m,omitempty"`
+	Chunks       []models.FileChunk `json:"chunks"`
+	Parity       []models.FileChunk `json:"parity,omitempty"`
+	Pack         *models.PackRef    `json:"pack,omitempty"`
+	Prev         *ManifestRef       `json:"prev,omitempty"`
+
+	// Deleted marks a tombstone: the file was deleted after its manifest was posted
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func newManifest(metadata *models.FileMetadata) *Manifest {
+	return &Manifest{
+		Version:      ManifestVersion,
+		ID:           metadata.ID.Hex(),
+		Name:         metadata.Name,
+		Size:         metadata.Size,
+		MimeType:     metadata.MimeType,
+		Hash:         metadata.Hash,
+		HashVerified: metadata.HashVerified,
+		CreatedAt:    metadata.CreatedAt,
+		StorageMode:  metadata.StorageMode,
+		DataShards:   metadata.DataShards,
+		ParityShards: metadata.ParityShards,
+		Chunks:       uniqueChunks(metadata.Chunks),
+		Parity:       metadata.ParityChunks,
+		Pack:         metadata.Pack,
+	}
+}
+
+// toMetadata converts a manifest back into a completed file record.
+func (m *Manifest) toMetadata() (*models.FileMetadata, error) {
+	oid, err := primitive.ObjectIDFromHex(m.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file id in manifest: %w", err)
+	}
+	return &models.FileMetadata{
+		ID:           oid,
+		Name:         m.Name,
+		Size:         m.Size,
+		MimeType:     m.MimeType,
+		Hash:         m.Hash,
+		HashVerified: m.HashVerified,
+		Status:       "completed",
+		Chunks:       m.Chunks,
+		CreatedAt:    m.CreatedAt,
+		UpdatedAt:    time.Now(),
+		StorageMode:  m.StorageMode,
+		DataShards:   m.DataShards,
+		ParityShards: m.ParityShards,
+		ParityChunks: m.Parity,
+		Pack:         m.Pack,
+	}, nil
+}
+
+type manifestHead struct {
+	GroupID     int64 `bson:"_id"`
+	ManifestRef `bson:",inline"`
+}
+
+// postManifest publishes the manifest of a completed file.
+func (s *FileService) postManifest(ctx context.Context, metadata *models.FileMetadata, groupID int64) (*ManifestRef, error) {
+	ref, err := s.appendManifest(ctx, newManifest(metadata), groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = s.db.Collection("files").UpdateOne(ctx, bson.M{"_id": metadata.ID},
+		bson.M{"$set": bson.M{"manifest_message_id": ref.MessageID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record manifest: %w", err)
+	}
+	return ref, nil
+}
+
+// postTombstone records in the manifest chain that a file was deleted, so
+// recovery does not resurrect it from an older manifest.
+func (s *FileService) postTombstone(ctx context.Context, fileID string, groupID int64) error {
+	_, err := s.appendManifest(ctx, &Manifest{Version: ManifestVersion, ID: fileID, Deleted: true}, groupID)
+	return err
+}
+
+// appendManifest posts a manifest document and advances the group's manifest
+// chain. Manifests are posted one at a time so concurrent completions cannot
+// fork the chain.
+func (s *FileService) appendManifest(ctx context.Context, manifest *Manifest, groupID int64) (*ManifestRef, error) {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	heads := s.db.Collection("manifest_heads")
+
+	var head manifestHead
+	err := heads.FindOne(ctx, bson.M{"_id": groupID}).Decode(&head)
+	switch {
+	case err == nil:
+		manifest.Prev = &head.ManifestRef
+	case err == mongo.ErrNoDocuments:
+		// First manifest in this database; continue any chain already pinned in the group
+		if ref := s.pinnedManifest(groupID); ref != nil {
+			manifest.Prev = ref
+		}
+	default:
+		return nil, fmt.Errorf("failed to read manifest head: %w", err)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	targetBot := s.botPool.GetNextBot()
+	if targetBot == nil {
+		return nil, errorf(ErrUpstreamUnavailable, "no bots available")
+	}
+	name := fmt.Sprintf("manifest_%s.json", manifest.ID)
+	msg, err := s.sendDocumentWithRetry(ctx, targetBot, groupID, name, ManifestCaptionPrefix+manifest.ID, data)
+	if err != nil {
+		return nil, err
+	}
+	ref := manifestRefFromMessage(msg, targetBot.Self.UserName)
+
+	pin := tgbotapi.PinChatMessageConfig{ChatID: groupID, MessageID: msg.MessageID, DisableNotification: true}
+	if _, err := targetBot.Request(pin); err != nil {
+		slog.WarnContext(ctx, "Failed to pin manifest (bot needs pin rights for recovery)", "message_id", msg.MessageID, "error", err)
+	}
+
+	_, err = heads.UpdateOne(ctx, bson.M{"_id": groupID},
+		bson.M{"$set": bson.M{"message_id": ref.MessageID, "file_id": ref.FileID, "bot": ref.Bot, "size": ref.Size}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update manifest head: %w", err)
+	}
+
+	slog.DebugContext(ctx, "Manifest posted", "file_id", manifest.ID, "message_id", msg.MessageID, "size", len(data))
+	return ref, nil
+}
+
+// pinnedManifest returns the manifest currently pinned in the group, if any.
+func (s *FileService) pinnedManifest(groupID int64) *ManifestRef {
+	for _, b := range s.botPool.GetAllBots() {
+		chat, err := b.GetChat(tgbotapi.ChatInfoConfig{ChatConfig: tgbotapi.ChatConfig{ChatID: groupID}})
+		if err != nil {
+			continue
+		}
+		if ref := manifestRefFromMessage(chat.PinnedMessage, b.Self.UserName); ref != nil {
+			return ref
+		}
+		return nil
+	}
+	return nil
+}
+
+func manifestRefFromMessage(msg *tgbotapi.Message, botName string) *ManifestRef {
+	if msg == nil || msg.Document == nil || !strings.HasPrefix(msg.Caption, ManifestCaptionPrefix) {
+		return nil
+	}
+	return &ManifestRef{
+		MessageID: msg.MessageID,
+		FileID:    msg.Document.FileID,
+		Bot:       botName,
+		Size:      int64(msg.Document.FileSize),
+	}
+}
+
+// fetchManifest downloads and decodes a manifest document.
+func (s *FileService) fetchManifest(ctx context.Context, ref ManifestRef) (*Manifest, error) {
+	var buf bytes.Buffer
+	if err := s.DownloadChunk(ctx, models.FileChunk{FileID: ref.FileID, BotToken: ref.Bot, Size: ref.Size}, &buf); err != nil {
+		return nil, fmt.Errorf("failed to download manifest %d: %w", ref.MessageID, err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %d: %w", ref.MessageID, err)
+	}
+	if manifest.Version > ManifestVersion {
+		return nil, fmt.Errorf("manifest %d has unsupported version %d", ref.MessageID, manifest.Version)
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,727 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"telegram-storage/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Small files are appended to a shared pack instead of getting a Telegram
+// message each. The open pack lives in the spool until it reaches
+// TargetSize or MaxAge, then it is sealed: uploaded as one document with a
+// JSON index of its files appended, followed by a fixed trailer
+// (8-byte big-endian index length + packTrailerMagic). Files are read back
+// with ranged downloads of the pack, and packs that are mostly deleted are
+// compacted by rewriting their live files into a new, smaller pack.
+//
+// Until its pack is sealed a packed file exists only in this host's spool:
+// other instances cannot read it and losing the spool loses it. Packing is
+// therefore off unless a threshold is configured, and the open pack is
+// sealed on shutdown.
+
+const packTrailerMagic = "TGPACKv1"
+
+// PackConfig controls small-file packing.
+type PackConfig struct {
+	Threshold       int64         `yaml:"threshold" env:"PACK_THRESHOLD"`     // files up to this size are packed; 0 (the default) disables packing
+	TargetSize      int64         `yaml:"target_size" env:"PACK_TARGET_SIZE"` // seal the open pack once it holds this many bytes
+	MaxAge          time.Duration `yaml:"max_age" env:"PACK_MAX_AGE"`
+	CompactRatio    float64       `yaml:"compact_ratio" env:"PACK_COMPACT_RATIO"` // compact sealed packs whose live fraction drops below this
+	CompactInterval time.Duration `yaml:"compact_interval" env:"PACK_COMPACT_INTERVAL"`
+}
+
+func defaultPackConfig() PackConfig {
+	return PackConfig{
+		TargetSize:      16 << 20,
+		MaxAge:          30 * time.Second,
+		CompactRatio:    0.5,
+		CompactInterval: time.Hour,
+	}
+}
+
+type packState struct {
+	cfg     PackConfig
+	mu      sync.Mutex
+	open    *models.Pack // pack currently accepting files on this host
+	sealing map[primitive.ObjectID]bool
+}
+
+type packIndexEntry struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	MimeType string `json:"mime"`
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+}
+
+func (s *FileService) packPath(packID primitive.ObjectID) string {
+	return filepath.Join(s.spoolDir, "packs", packID.Hex())
+}
+
+// shouldPack reports whether a new upload qualifies for packing.
+func (s *FileService) shouldPack(size int64) bool {
+	return s.packs.cfg.Threshold > 0 && size <= s.packs.cfg.Threshold
+}
+
+// writeToPack appends size bytes to the open pack for groupID, creating one if
+// needed, and points the file at them. attached is false when a concurrent
+// retry of the upload got there first. A pack that became full is returned
+// for the caller to seal.
+//
+// The file is updated before the pack lock is released: a pack can only be
+// detached for sealing under the lock, so every file whose bytes are in a
+// pack is in its index.
+func (s *FileService) writeToPack(ctx context.Context, fileID primitive.ObjectID, r io.Reader, size int64, groupID int64) (ref *models.PackRef, attached bool, full *models.Pack, err error) {
+	s.packs.mu.Lock()
+	defer s.packs.mu.Unlock()
+
+	if s.packs.open != nil && (s.packs.open.GroupID != groupID || s.packs.open.Size+size > s.packs.cfg.TargetSize) {
+		full = s.detachOpenPack()
+	}
+	if s.packs.open == nil {
+		pack, err := s.createPack(ctx, groupID)
+		if err != nil {
+			return nil, false, full, err
+		}
+		s.packs.open = pack
+	}
+	pack := s.packs.open
+
+	f, err := os.OpenFile(s.packPath(pack.ID), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, full, fmt.Errorf("failed to open pack: %w", err)
+	}
+	defer f.Close()
+
+	offset := pack.Size
+	written, err := io.Copy(io.NewOffsetWriter(f, offset), io.LimitReader(r, size+1))
+	if err == nil && written != size {
+		err = fmt.Errorf("expected %d bytes, got %d", size, written)
+	}
+	if err != nil {
+		// Bytes past pack.Size are overwritten by the next append
+		return nil, false, full, fmt.Errorf("failed to write to pack: %w", err)
+	}
+
+	_, err = s.db.Collection("packs").UpdateOne(ctx, bson.M{"_id": pack.ID},
+		bson.M{"$set": bson.M{"size": offset + size}, "$inc": bson.M{"live_bytes": size}})
+	if err != nil {
+		return nil, false, full, fmt.Errorf("failed to update pack: %w", err)
+	}
+	pack.Size = offset + size
+	pack.LiveBytes += size
+	if pack.Size >= s.packs.cfg.TargetSize {
+		full = s.detachOpenPack()
+	}
+
+	ref = &models.PackRef{PackID: pack.ID, Offset: offset, Length: size}
+	res, err := s.db.Collection("files").UpdateOne(ctx,
+		bson.M{"_id": fileID, "pack": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"pack": ref, "updated_at": time.Now()}})
+	if err != nil || res.MatchedCount == 0 {
+		// Our copy is dead space in the pack
+		s.adjustPackLiveBytes(ctx, pack.ID, -size)
+		pack.LiveBytes -= size
+	}
+	if err != nil {
+		return nil, false, full, fmt.Errorf("failed to update db: %w", err)
+	}
+	return ref, res.MatchedCount > 0, full, nil
+}
+
+// createPack records a new, empty open pack.
+func (s *FileService) createPack(ctx context.Context, groupID int64) (*models.Pack, error) {
+	pack := &models.Pack{
+		ID:        primitive.NewObjectID(),
+		Status:    models.PackOpen,
+		GroupID:   groupID,
+		CreatedAt: time.Now(),
+	}
+	if err := os.MkdirAll(filepath.Dir(s.packPath(pack.ID)), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create pack spool: %w", err)
+	}
+	if _, err := s.db.Collection("packs").InsertOne(ctx, pack); err != nil {
+		return nil, fmt.Errorf("failed to create pack: %w", err)
+	}
+	return pack, nil
+}
+
+// detachOpenPack stops appending to the open pack and marks it as being
+// sealed. Callers hold s.packs.mu.
+func (s *FileService) detachOpenPack() *models.Pack {
+	pack := s.packs.open
+	s.packs.open = nil
+	if pack == nil || s.packs.sealing[pack.ID] {
+		return nil
+	}
+	if s.packs.sealing == nil {
+		s.packs.sealing = make(map[primitive.ObjectID]bool)
+	}
+	s.packs.sealing[pack.ID] = true
+	return pack
+}
+
+// uploadPacked stores the single part of a packed upload.
+func (s *FileService) uploadPacked(ctx context.Context, metadata *models.FileMetadata, sequence int, data io.Reader, size int64, groupID int64) (*models.FileChunk, error) {
+	if sequence != 0 || size != metadata.Size {
+		return nil, errorf(ErrInvalidArgument, "packed files must be uploaded as a single part of %d bytes", metadata.Size)
+	}
+	if metadata.Pack != nil {
+		slog.DebugContext(ctx, "Packed file already uploaded", "upload_id", metadata.ID.Hex())
+		return &models.FileChunk{Sequence: 0, Size: size}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	ref, attached, full, err := s.writeToPack(ctx, metadata.ID, data, size, groupID)
+	if full != nil {
+		go s.sealPack(full)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !attached {
+		slog.DebugContext(ctx, "Packed file already uploaded by a concurrent retry", "upload_id", metadata.ID.Hex())
+		return &models.FileChunk{Sequence: 0, Size: size}, nil
+	}
+
+	slog.DebugContext(ctx, "File packed", "upload_id", metadata.ID.Hex(), "pack_id", ref.PackID.Hex(), "offset", ref.Offset, "size", size)
+	return &models.FileChunk{Sequence: 0, Size: size}, nil
+}
+
+func (s *FileService) adjustPackLiveBytes(ctx context.Context, packID primitive.ObjectID, delta int64) {
+	_, err := s.db.Collection("packs").UpdateOne(ctx, bson.M{"_id": packID}, bson.M{"$inc": bson.M{"live_bytes": delta}})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to update pack live bytes", "pack_id", packID.Hex(), "error", err)
+	}
+}
+
+// sealPack uploads a detached pack to Telegram and points its files at it.
+func (s *FileService) sealPack(pack *models.Pack) error {
+	defer func() {
+		s.packs.mu.Lock()
+		delete(s.packs.sealing, pack.ID)
+		s.packs.mu.Unlock()
+	}()
+
+	err := s.sealPackOnce(pack)
+	if err != nil {
+		slog.Warn("Failed to seal pack, will retry", "pack_id", pack.ID.Hex(), "error", err)
+	}
+	return err
+}
+
+func (s *FileService) sealPackOnce(pack *models.Pack) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	files, err := s.packFiles(ctx, pack.ID)
+	if err != nil {
+		return err
+	}
+	location, err := s.uploadPack(ctx, pack, files)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Collection("files").UpdateMany(ctx, bson.M{"pack.pack_id": pack.ID},
+		bson.M{"$set": bson.M{"pack.location": location}})
+	if err != nil {
+		return fmt.Errorf("failed to point files at pack: %w", err)
+	}
+	if err := os.Remove(s.packPath(pack.ID)); err != nil {
+		slog.WarnContext(ctx, "Failed to remove spooled pack", "pack_id", pack.ID.Hex(), "error", err)
+	}
+	slog.InfoContext(ctx, "Pack sealed", "pack_id", pack.ID.Hex(), "files", len(files), "size", location.Size, "message_id", location.MessageID)
+
+	// Packed files get their manifest once their bytes are in Telegram
+	files, err = s.packFiles(ctx, pack.ID)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		f := &files[i]
+		if f.Status != "completed" || f.ManifestMessageID != 0 {
+			continue
+		}
+		if _, err := s.postManifest(ctx, f, pack.GroupID); err != nil {
+			slog.WarnContext(ctx, "Failed to post manifest", "file_id", f.ID.Hex(), "error", err)
+		}
+	}
+	return nil
+}
+
+// uploadPack sends the spooled bytes of a pack to Telegram, followed by the
+// index of files, and records the pack as sealed at the returned location.
+func (s *FileService) uploadPack(ctx context.Context, pack *models.Pack, files []models.FileMetadata) (*models.FileChunk, error) {
+	data, err := os.ReadFile(s.packPath(pack.ID))
+	if err != nil {
+		return nil, fmt.Errorf("pack missing from spool: %w", err)
+	}
+	if int64(len(data)) < pack.Size {
+		return nil, fmt.Errorf("pack spool holds %d bytes, expected %d", len(data), pack.Size)
+	}
+	data = data[:pack.Size]
+
+	index := make([]packIndexEntry, 0, len(files))
+	for _, f := range files {
+		index = append(index, packIndexEntry{
+			ID:       f.ID.Hex(),
+			Name:     f.Name,
+			MimeType: f.MimeType,
+			Offset:   f.Pack.Offset,
+			Length:   f.Pack.Length,
+		})
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pack index: %w", err)
+	}
+	var trailer [8]byte
+	binary.BigEndian.PutUint64(trailer[:], uint64(len(indexJSON)))
+	doc := make([]byte, 0, len(data)+len(indexJSON)+len(trailer)+len(packTrailerMagic))
+	doc = append(append(append(append(doc, data...), indexJSON...), trailer[:]...), packTrailerMagic...)
+
+	b := s.botPool.GetNextBot()
+	if b == nil {
+		return nil, errorf(ErrUpstreamUnavailable, "no bots available")
+	}
+	name := fmt.Sprintf("pack_%s", pack.ID.Hex())
+	caption := fmt.Sprintf("PACK: %s\nFiles: %d", pack.ID.Hex(), len(files))
+	msg, err := s.sendDocumentWithRetry(ctx, b, pack.GroupID, name, caption, doc)
+	if err != nil {
+		return nil, err
+	}
+	location := &models.FileChunk{
+		MessageID: msg.MessageID,
+		FileID:    msg.Document.FileID,
+		BotToken:  b.Self.UserName,
+		GroupID:   pack.GroupID,
+		Size:      int64(len(doc)),
+		Hash:      hashBytes(doc),
+	}
+
+	now := time.Now()
+	_, err = s.db.Collection("packs").UpdateOne(ctx, bson.M{"_id": pack.ID},
+		bson.M{"$set": bson.M{"status": models.PackSealed, "location": location, "sealed_at": now}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record sealed pack: %w", err)
+	}
+	pack.Status, pack.Location, pack.SealedAt = models.PackSealed, location, &now
+	return location, nil
+}
+
+// packFiles returns the files stored in a pack, in pack order.
+func (s *FileService) packFiles(ctx context.Context, packID primitive.ObjectID) ([]models.FileMetadata, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "pack.offset", Value: 1}})
+	cursor, err := s.db.Collection("files").Find(ctx, bson.M{"pack.pack_id": packID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pack files: %w", err)
+	}
+	var files []models.FileMetadata
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, fmt.Errorf("failed to decode pack files: %w", err)
+	}
+	return files, nil
+}
+
+// readPacked writes length bytes of a packed file starting at offset.
+func (s *FileService) readPacked(ctx context.Context, metadata *models.FileMetadata, offset, length int64, writer io.Writer) error {
+	ref := metadata.Pack
+	if ref == nil {
+		return errorf(ErrConflict, "upload incomplete: file has not been uploaded")
+	}
+
+	if ref.Location == nil {
+		f, err := os.Open(s.packPath(ref.PackID))
+		if err == nil {
+			defer f.Close()
+			_, err = io.Copy(writer, io.NewSectionReader(f, ref.Offset+offset, length))
+			return err
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to open pack: %w", err)
+		}
+
+		// Sealed since the metadata was loaded
+		fresh, err := s.GetFileMetadata(ctx, metadata.ID.Hex())
+		if err != nil {
+			return err
+		}
+		if fresh.Pack == nil || fresh.Pack.Location == nil {
+			return fmt.Errorf("pack %s is not available on this host", ref.PackID.Hex())
+		}
+		ref = fresh.Pack
+	}
+
+	return s.downloadRange(ctx, *ref.Location, ref.Offset+offset, length, writer)
+}
+
+// downloadRange writes length bytes of a stored document starting at offset,
+// using a Range request when the file server honours it.
+func (s *FileService) downloadRange(ctx context.Context, chunk models.FileChunk, offset, length int64, writer io.Writer) error {
+	if length == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stall := newStallTimer(cancel)
+	defer stall.stop()
+
+	resp, err := s.openChunk(ctx, chunk, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if err != nil {
+		return stall.wrap(err)
+	}
+	defer resp.Body.Close()
+	stall.stop()
+
+	body := stall.reader(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			return fmt.Errorf("failed to seek in pack: %w", stall.wrap(err))
+		}
+	}
+	if _, err := io.CopyN(writer, body, length); err != nil {
+		return fmt.Errorf("failed to read from pack: %w", stall.wrap(err))
+	}
+	return nil
+}
+
+// releasePacked drops a deleted file's bytes from its pack. A sealed pack with
+// nothing left in it is deleted right away; partly used packs are left to
+// compaction.
+func (s *FileService) releasePacked(ctx context.Context, ref *models.PackRef) error {
+	var pack models.Pack
+	err := s.db.Collection("packs").FindOneAndUpdate(ctx, bson.M{"_id": ref.PackID},
+		bson.M{"$inc": bson.M{"live_bytes": -ref.Length}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&pack)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release pack bytes: %w", err)
+	}
+	if pack.Status == models.PackSealed && pack.LiveBytes <= 0 {
+		return s.deletePack(ctx, &pack)
+	}
+	return nil
+}
+
+// deletePack removes a sealed pack that no file refers to any more.
+func (s *FileService) deletePack(ctx context.Context, pack *models.Pack) error {
+	count, err := s.db.Collection("files").CountDocuments(ctx, bson.M{"pack.pack_id": pack.ID})
+	if err != nil {
+		return fmt.Errorf("failed to check pack references: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("pack %s still holds %d files", pack.ID.Hex(), count)
+	}
+	if pack.Location != nil {
+		if err := s.deleteChunkMessage(*pack.Location, pack.GroupID); err != nil {
+			slog.WarnContext(ctx, "Failed to delete pack message", "pack_id", pack.ID.Hex(), "error", err)
+		}
+	}
+	if _, err := s.db.Collection("packs").DeleteOne(ctx, bson.M{"_id": pack.ID}); err != nil {
+		return fmt.Errorf("failed to delete pack: %w", err)
+	}
+	slog.InfoContext(ctx, "Empty pack deleted", "pack_id", pack.ID.Hex())
+	return nil
+}
+
+// PackCompaction summarises a compaction run.
+type PackCompaction struct {
+	PacksCompacted int   `json:"packs_compacted"`
+	FilesMoved     int   `json:"files_moved"`
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+}
+
+// CompactPacks rewrites sealed packs whose live fraction is below
+// CompactRatio: their live files are copied into a new pack and the old pack
+// document is deleted.
+func (s *FileService) CompactPacks(ctx context.Context) (*PackCompaction, error) {
+	cursor, err := s.db.Collection("packs").Find(ctx, bson.M{"status": models.PackSealed})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+	var packs []models.Pack
+	if err := cursor.All(ctx, &packs); err != nil {
+		return nil, fmt.Errorf("failed to decode packs: %w", err)
+	}
+
+	result := &PackCompaction{}
+	for i := range packs {
+		pack := &packs[i]
+		if pack.Size > 0 && float64(pack.LiveBytes)/float64(pack.Size) >= s.packs.cfg.CompactRatio {
+			continue
+		}
+		moved, err := s.compactPack(ctx, pack)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to compact pack", "pack_id", pack.ID.Hex(), "error", err)
+			continue
+		}
+		result.PacksCompacted++
+		result.FilesMoved += moved
+		result.BytesReclaimed += pack.Size - pack.LiveBytes
+	}
+
+	if result.PacksCompacted > 0 {
+		slog.InfoContext(ctx, "Packs compacted", "packs", result.PacksCompacted, "files_moved", result.FilesMoved,
+			"bytes_reclaimed", result.BytesReclaimed)
+	}
+	return result, nil
+}
+
+// compactPack moves the live files of a sparse pack into a new pack and
+// deletes the old one. The new pack is sealed before any file is pointed at
+// it, and the old pack is only deleted once nothing refers to it, so the
+// files stay in Telegram throughout.
+func (s *FileService) compactPack(ctx context.Context, pack *models.Pack) (int, error) {
+	files, err := s.packFiles(ctx, pack.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, s.deletePack(ctx, pack)
+	}
+	if pack.Location == nil {
+		return 0, fmt.Errorf("sealed pack has no location")
+	}
+	var buf bytes.Buffer
+	if err := s.DownloadChunk(ctx, *pack.Location, &buf); err != nil {
+		return 0, err
+	}
+	data := buf.Bytes()
+
+	dest, err := s.createPack(ctx, pack.GroupID)
+	if err != nil {
+		return 0, err
+	}
+	// Keep the packer from sealing the new pack on its own while it is filled
+	s.packs.mu.Lock()
+	if s.packs.sealing == nil {
+		s.packs.sealing = make(map[primitive.ObjectID]bool)
+	}
+	s.packs.sealing[dest.ID] = true
+	s.packs.mu.Unlock()
+	defer func() {
+		s.packs.mu.Lock()
+		delete(s.packs.sealing, dest.ID)
+		s.packs.mu.Unlock()
+		os.Remove(s.packPath(dest.ID))
+		if dest.Status != models.PackSealed {
+			if _, err := s.db.Collection("packs").DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": dest.ID}); err != nil {
+				slog.WarnContext(ctx, "Failed to remove unsealed pack", "pack_id", dest.ID.Hex(), "error", err)
+			}
+		}
+	}()
+
+	var packed bytes.Buffer
+	for i := range files {
+		f := &files[i]
+		end := f.Pack.Offset + f.Pack.Length
+		if end > int64(len(data)) {
+			return 0, fmt.Errorf("file %s lies outside the pack", f.ID.Hex())
+		}
+		f.Pack = &models.PackRef{PackID: dest.ID, Offset: int64(packed.Len()), Length: f.Pack.Length}
+		packed.Write(data[end-f.Pack.Length : end])
+	}
+	if err := os.WriteFile(s.packPath(dest.ID), packed.Bytes(), 0o644); err != nil {
+		return 0, fmt.Errorf("failed to write pack: %w", err)
+	}
+	// Live bytes are counted as files move, so a pack left behind by a
+	// failed compaction is empty and gets deleted by the next one
+	dest.Size = int64(packed.Len())
+	if _, err := s.db.Collection("packs").UpdateOne(ctx, bson.M{"_id": dest.ID}, bson.M{"$set": bson.M{"size": dest.Size}}); err != nil {
+		return 0, fmt.Errorf("failed to update pack: %w", err)
+	}
+
+	location, err := s.uploadPack(ctx, dest, files)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seal compacted pack: %w", err)
+	}
+
+	moved := 0
+	for i := range files {
+		f := &files[i]
+		f.Pack.Location = location
+		res, err := s.db.Collection("files").UpdateOne(ctx,
+			bson.M{"_id": f.ID, "pack.pack_id": pack.ID},
+			bson.M{"$set": bson.M{"pack": f.Pack}, "$unset": bson.M{"manifest_message_id": ""}})
+		if err != nil {
+			return moved, fmt.Errorf("failed to move file %s: %w", f.ID.Hex(), err)
+		}
+		if res.MatchedCount == 0 {
+			// Deleted while compacting
+			continue
+		}
+		s.adjustPackLiveBytes(ctx, dest.ID, f.Pack.Length)
+		moved++
+
+		// The manifest has to point at the new pack for recovery
+		f.ManifestMessageID = 0
+		if f.Status == "completed" {
+			if _, err := s.postManifest(ctx, f, dest.GroupID); err != nil {
+				slog.WarnContext(ctx, "Failed to post manifest", "file_id", f.ID.Hex(), "error", err)
+			}
+		}
+	}
+
+	return moved, s.deletePack(ctx, pack)
+}
+
+// StartPacker seals open packs once they reach MaxAge (including packs left
+// open by a previous run) and periodically compacts sparse packs. It blocks
+// until ctx is cancelled.
+func (s *FileService) StartPacker(ctx context.Context) {
+	cfg := s.packs.cfg
+	if cfg.Threshold == 0 {
+		slog.Info("Small-file packing disabled")
+		return
+	}
+	slog.Info("Small-file packing enabled", "threshold", cfg.Threshold, "target_size", cfg.TargetSize, "max_age", cfg.MaxAge)
+
+	ticker := time.NewTicker(max(cfg.MaxAge/2, time.Second))
+	defer ticker.Stop()
+	lastCompaction := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.sealStalePacks(ctx)
+
+		if time.Since(lastCompaction) >= cfg.CompactInterval {
+			lastCompaction = time.Now()
+			if _, _, err := s.jobs.Enqueue(ctx, JobTypeCompactPacks, nil, JobOptions{UniqueKey: JobTypeCompactPacks}); err != nil {
+				slog.ErrorContext(ctx, "Failed to queue pack compaction", "error", err)
+			}
+		}
+	}
+}
+
+// SealOpenPack seals the open pack and waits for seals already in progress,
+// so packed files are in Telegram before the process exits. It is called on
+// shutdown once no more uploads arrive.
+func (s *FileService) SealOpenPack(ctx context.Context) error {
+	s.packs.mu.Lock()
+	pack := s.detachOpenPack()
+	s.packs.mu.Unlock()
+	if pack != nil {
+		if err := s.sealPack(pack); err != nil {
+			return fmt.Errorf("failed to seal pack %s: %w", pack.ID.Hex(), err)
+		}
+	}
+
+	for {
+		s.packs.mu.Lock()
+		sealing := len(s.packs.sealing)
+		s.packs.mu.Unlock()
+		if sealing == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d packs still sealing: %w", sealing, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (s *FileService) sealStalePacks(ctx context.Context) {
+	cutoff := time.Now().Add(-s.packs.cfg.MaxAge)
+
+	s.packs.mu.Lock()
+	var stale []*models.Pack
+	if s.packs.open != nil && s.packs.open.CreatedAt.Before(cutoff) {
+		if p := s.detachOpenPack(); p != nil {
+			stale = append(stale, p)
+		}
+	}
+	s.packs.mu.Unlock()
+
+	// Packs a previous run left open (or failed to seal) whose spool is here
+	cursor, err := s.db.Collection("packs").Find(ctx, bson.M{"status": models.PackOpen, "created_at": bson.M{"$lt": cutoff}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list open packs", "error", err)
+	} else {
+		var packs []models.Pack
+		if err := cursor.All(ctx, &packs); err != nil {
+			slog.ErrorContext(ctx, "Failed to decode open packs", "error", err)
+		}
+		s.packs.mu.Lock()
+		for i := range packs {
+			p := &packs[i]
+			if s.packs.sealing[p.ID] || (s.packs.open != nil && s.packs.open.ID == p.ID) {
+				continue
+			}
+			if _, err := os.Stat(s.packPath(p.ID)); err != nil {
+				continue
+			}
+			if s.packs.sealing == nil {
+				s.packs.sealing = make(map[primitive.ObjectID]bool)
+			}
+			s.packs.sealing[p.ID] = true
+			stale = append(stale, p)
+		}
+		s.packs.mu.Unlock()
+	}
+
+	for _, p := range stale {
+		s.sealPack(p)
+	}
+}
+
+// rebuildPacks recreates sealed pack records from the pack references of
+// restored files.
+func (s *FileService) rebuildPacks(ctx context.Context, files map[string]*models.FileMetadata) error {
+	packs := make(map[primitive.ObjectID]*models.Pack)
+	for _, f := range files {
+		if f == nil || f.Pack == nil || f.Pack.Location == nil {
+			continue
+		}
+		pack, ok := packs[f.Pack.PackID]
+		if !ok {
+			pack = &models.Pack{
+				ID:        f.Pack.PackID,
+				Status:    models.PackSealed,
+				GroupID:   f.Pack.Location.GroupID,
+				Location:  f.Pack.Location,
+				CreatedAt: f.Pack.PackID.Timestamp(),
+			}
+			packs[pack.ID] = pack
+		}
+		pack.Size = max(pack.Size, f.Pack.Offset+f.Pack.Length)
+		pack.LiveBytes += f.Pack.Length
+	}
+
+	collection := s.db.Collection("packs")
+	for id, pack := range packs {
+		_, err := collection.ReplaceOne(ctx, bson.M{"_id": id}, pack, options.Replace().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("failed to write pack %s: %w", id.Hex(), err)
+		}
+	}
+	if len(packs) > 0 {
+		slog.InfoContext(ctx, "Pack records rebuilt", "packs", len(packs))
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"telegram-storage/models"
+	"time"
+)
+
+// Media players read a file as a series of range requests, each of which
+// would otherwise wait on Telegram for its first chunk. Read-ahead remembers,
+// per client and file, where the last request stopped. When the next request
+// continues from there the chunks after it are fetched into memory in the
+// background, so the request after that finds them ready. A request anywhere
+// else is a seek and drops what was buffered for the client.
+
+// ReadAheadConfig controls read-ahead for sequential range requests.
+type ReadAheadConfig struct {
+	Chunks       int           `yaml:"chunks" env:"READAHEAD_CHUNKS"`               // chunks buffered ahead of a sequential reader; 0 disables read-ahead
+	MemoryBudget int64         `yaml:"memory_budget" env:"READAHEAD_MEMORY_BUDGET"` // bytes buffered across all readers
+	Idle         time.Duration `yaml:"idle" env:"READAHEAD_IDLE"`                   // buffers of a reader that stops are released after this long
+}
+
+func defaultReadAheadConfig() ReadAheadConfig {
+	return ReadAheadConfig{Chunks: 4, MemoryBudget: 128 << 20, Idle: 30 * time.Second}
+}
+
+type readAheadKey struct {
+	client string
+	fileID string
+}
+
+// readAheadSession is the read-ahead state of one client reading one file.
+// All fields are guarded by readAhead.mu.
+type readAheadSession struct {
+	key        readAheadKey
+	ctx        context.Context // cancelled on seek or expiry
+	cancel     context.CancelFunc
+	timer      *time.Timer
+	lastSeen   time.Time
+	lastOffset int64 // start of the last request
+	nextOffset int64 // where the last request stopped
+	sequential bool  // the last request continued the one before it
+	buffered   map[int]*prefetched
+}
+
+type readAhead struct {
+	cfg    ReadAheadConfig
+	budget *memoryBudget
+
+	mu       sync.Mutex
+	sessions map[readAheadKey]*readAheadSession
+}
+
+func newReadAhead(cfg ReadAheadConfig) *readAhead {
+	return &readAhead{
+		cfg:      cfg,
+		budget:   &memoryBudget{name: "readahead", limit: cfg.MemoryBudget},
+		sessions: make(map[readAheadKey]*readAheadSession),
+	}
+}
+
+// discardPrefetched releases a buffered chunk once its fetch has finished.
+func (s *FileService) discardPrefetched(p *prefetched) {
+	go func() {
+		<-p.done
+		s.releasePrefetched(p)
+	}()
+}
+
+// dropBufferedLocked discards buffered chunks outside [from, to).
+func (s *FileService) dropBufferedLocked(sess *readAheadSession, from, to int) {
+	for i, p := range sess.buffered {
+		if i < from || i >= to {
+			delete(sess.buffered, i)
+			s.discardPrefetched(p)
+		}
+	}
+}
+
+// beginReadAhead records a range request from client and returns its
+// session, or nil when read-ahead does not apply.
+func (s *FileService) beginReadAhead(client string, metadata *models.FileMetadata, offset int64) *readAheadSession {
+	ra := s.readAhead
+	if client == "" || ra.cfg.Chunks <= 0 || metadata.StorageMode == models.StorageModePacked {
+		return nil
+	}
+	key := readAheadKey{client: client, fileID: metadata.ID.Hex()}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	sess, ok := ra.sessions[key]
+	if !ok {
+		sess = &readAheadSession{key: key, buffered: make(map[int]*prefetched)}
+		sess.ctx, sess.cancel = context.WithCancel(context.Background())
+		sess.timer = time.AfterFunc(ra.cfg.Idle, func() { s.expireReadAhead(sess) })
+		ra.sessions[key] = sess
+		// Players start at the beginning, anything else waits for a second request
+		sess.sequential = offset == 0
+	} else {
+		// Players re-request a little behind where they stopped, so allow up
+		// to one chunk of slack past the end of the last request
+		sess.sequential = offset >= sess.lastOffset && offset <= sess.nextOffset+MaxChunkSize
+		if !sess.sequential && len(sess.buffered) > 0 {
+			sess.cancel()
+			s.dropBufferedLocked(sess, 0, 0)
+			sess.ctx, sess.cancel = context.WithCancel(context.Background())
+		}
+		sess.timer.Reset(ra.cfg.Idle)
+	}
+	sess.lastSeen = time.Now()
+	sess.lastOffset = offset
+	sess.nextOffset = offset
+	return sess
+}
+
+// fillReadAhead keeps the buffered chunks from index keep on and starts
+// fetching any of the Chunks chunks from index from that are missing.
+func (s *FileService) fillReadAhead(sess *readAheadSession, metadata *models.FileMetadata, chunks []models.FileChunk, keep, from int) {
+	ra := s.readAhead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if !sess.sequential || ra.sessions[sess.key] != sess {
+		return
+	}
+	to := min(len(chunks), from+ra.cfg.Chunks)
+	s.dropBufferedLocked(sess, keep, to)
+	for i := from; i < to; i++ {
+		if sess.buffered[i] != nil {
+			continue
+		}
+		c := chunks[i]
+		if !ra.budget.tryAcquire(c.Size) {
+			return
+		}
+		p := &prefetched{done: make(chan struct{}), held: c.Size, budget: ra.budget}
+		sess.buffered[i] = p
+		go func(ctx context.Context) {
+			defer close(p.done)
+			buf := bytes.NewBuffer(make([]byte, 0, c.Size))
+			if p.err = s.fetchChunk(ctx, metadata, chunks, c, buf); p.err == nil {
+				p.data = buf.Bytes()
+			}
+		}(sess.ctx)
+	}
+}
+
+// endReadAhead records where a request stopped and buffers the chunks that
+// follow it.
+func (s *FileService) endReadAhead(sess *readAheadSession, metadata *models.FileMetadata, chunks []models.FileChunk, offsets []int64, stopped int64) {
+	s.readAhead.mu.Lock()
+	sess.nextOffset = max(sess.nextOffset, stopped)
+	s.readAhead.mu.Unlock()
+
+	next := sort.Search(len(chunks), func(i int) bool { return offsets[i]+chunks[i].Size > stopped })
+	s.fillReadAhead(sess, metadata, chunks, next, next)
+}
+
+// has reports whether chunk i is buffered.
+func (sess *readAheadSession) has(ra *readAhead, i int) bool {
+	if sess == nil {
+		return false
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return sess.buffered[i] != nil
+}
+
+// take hands buffered chunk i over to the caller, who must release it.
+func (sess *readAheadSession) take(ra *readAhead, i int) *prefetched {
+	if sess == nil {
+		return nil
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	p := sess.buffered[i]
+	delete(sess.buffered, i)
+	return p
+}
+
+func (s *FileService) expireReadAhead(sess *readAheadSession) {
+	ra := s.readAhead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.sessions[sess.key] != sess {
+		return
+	}
+	if idle := time.Since(sess.lastSeen); idle < ra.cfg.Idle {
+		sess.timer.Reset(ra.cfg.Idle - idle)
+		return
+	}
+	delete(ra.sessions, sess.key)
+	sess.cancel()
+	s.dropBufferedLocked(sess, 0, 0)
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"telegram-storage/models"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/time/rate"
+)
+
+// RecoveryOptions controls RecoverFromTelegram.
+type RecoveryOptions struct {
+	GroupID int64
+
+	// Caption scan. The Bot API cannot read chat history, so scanned messages
+	// are forwarded one by one into ScratchChatID, inspected and deleted.
+	// A zero ScratchChatID or ScanTo disables the scan.
+	ScratchChatID int64
+	ScanFrom      int
+	ScanTo        int
+	ScanRate      float64 // forwards per second
+
+	Overwrite bool // replace existing file records instead of skipping them
+	DryRun    bool
+}
+
+// RecoveryResult summarises a recovery run.
+type RecoveryResult struct {
+	ManifestsRead     int `json:"manifests_read"`
+	FilesFromManifest int `json:"files_from_manifest"`
+	FilesFromCaptions int `json:"files_from_captions"`
+	Inserted          int `json:"inserted"`
+	Replaced          int `json:"replaced"`
+	Skipped           int `json:"skipped"`
+}
+
+// RecoverFromTelegram rebuilds the files collection from the manifest chain
+// pinned in the group and, optionally, from the captions of individual chunk
+// messages for files whose manifest is missing.
+func (s *FileService) RecoverFromTelegram(ctx context.Context, opts RecoveryOptions) (*RecoveryResult, error) {
+	result := &RecoveryResult{}
+	recovered := make(map[string]*models.FileMetadata)
+
+	if head := s.pinnedManifest(opts.GroupID); head != nil {
+		s.walkManifestChain(ctx, *head, recovered, result)
+	} else {
+		slog.WarnContext(ctx, "No pinned manifest in group", "group_id", opts.GroupID)
+	}
+	for _, metadata := range recovered {
+		if metadata != nil {
+			result.FilesFromManifest++
+		}
+	}
+
+	if opts.ScratchChatID != 0 && opts.ScanTo >= opts.ScanFrom && opts.ScanTo > 0 {
+		fromCaptions, err := s.scanGroup(ctx, opts, recovered, result)
+		if err != nil {
+			return result, err
+		}
+		for id, metadata := range fromCaptions {
+			if _, ok := recovered[id]; !ok {
+				recovered[id] = metadata
+				result.FilesFromCaptions++
+			}
+		}
+	}
+
+	// Tombstoned files stay in the map as nil so caption scanning skips them
+	for id, metadata := range recovered {
+		if metadata == nil {
+			delete(recovered, id)
+		}
+	}
+
+	if opts.DryRun {
+		slog.InfoContext(ctx, "Dry run finished", "files", len(recovered))
+		return result, nil
+	}
+
+	collection := s.db.Collection("files")
+	for _, metadata := range recovered {
+		dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if opts.Overwrite {
+			res, err := collection.ReplaceOne(dbCtx, bson.M{"_id": metadata.ID}, metadata, options.Replace().SetUpsert(true))
+			cancel()
+			if err != nil {
+				return result, fmt.Errorf("failed to restore %s: %w", metadata.ID.Hex(), err)
+			}
+			if res.UpsertedCount > 0 {
+				result.Inserted++
+			} else {
+				result.Replaced++
+			}
+			continue
+		}
+
+		_, err := collection.InsertOne(dbCtx, metadata)
+		cancel()
+		if mongo.IsDuplicateKeyError(err) {
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to restore %s: %w", metadata.ID.Hex(), err)
+		}
+		result.Inserted++
+	}
+
+	slog.InfoContext(ctx, "Files restored", "inserted", result.Inserted, "replaced", result.Replaced, "skipped", result.Skipped)
+
+	// Shared chunks must be reference counted again before anything is deleted
+	if _, err := s.RebuildChunkRefs(ctx); err != nil {
+		return result, err
+	}
+	if err := s.rebuildPacks(ctx, recovered); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// walkManifestChain follows prev links from head. The newest manifest of a
+// file wins, so files completed more than once keep their latest record.
+func (s *FileService) walkManifestChain(ctx context.Context, head ManifestRef, recovered map[string]*models.FileMetadata, result *RecoveryResult) {
+	seen := make(map[string]bool)
+	ref := &head
+	for ref != nil && !seen[ref.FileID] {
+		seen[ref.FileID] = true
+
+		manifest, err := s.fetchManifest(ctx, *ref)
+		if err != nil {
+			slog.WarnContext(ctx, "Manifest chain broken", "message_id", ref.MessageID, "error", err)
+			return
+		}
+		result.ManifestsRead++
+
+		if _, ok := recovered[manifest.ID]; !ok {
+			if manifest.Deleted {
+				// Newer than any manifest of the file still ahead in the chain
+				recovered[manifest.ID] = nil
+			} else if metadata, err := manifest.toMetadata(); err != nil {
+				slog.WarnContext(ctx, "Skipping manifest", "message_id", ref.MessageID, "error", err)
+			} else {
+				metadata.ManifestMessageID = ref.MessageID
+				recovered[manifest.ID] = metadata
+			}
+		}
+		ref = manifest.Prev
+	}
+}
+
+// scanGroup forwards messages ScanFrom..ScanTo into the scratch chat and
+// collects manifests and chunk captions. Manifests found this way are added
+// to recovered directly; files known only from captions are returned.
+func (s *FileService) scanGroup(ctx context.Context, opts RecoveryOptions, recovered map[string]*models.FileMetadata, result *RecoveryResult) (map[string]*models.FileMetadata, error) {
+	scanRate := opts.ScanRate
+	if scanRate <= 0 {
+		scanRate = 1
+	}
+	limiter := rate.NewLimiter(rate.Limit(scanRate), 1)
+	fromCaptions := make(map[string]*models.FileMetadata)
+
+	slog.InfoContext(ctx, "Scanning messages", "group_id", opts.GroupID, "from", opts.ScanFrom, "to", opts.ScanTo)
+
+	for messageID := opts.ScanFrom; messageID <= opts.ScanTo; messageID++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		b := s.botPool.GetNextBot()
+		if b == nil {
+			return nil, errorf(ErrUpstreamUnavailable, "no bots available")
+		}
+
+		msg, err := b.Send(tgbotapi.NewForward(opts.ScratchChatID, opts.GroupID, messageID))
+		if err != nil {
+			// Deleted and service messages cannot be forwarded
+			continue
+		}
+		if _, err := b.Request(tgbotapi.NewDeleteMessage(opts.ScratchChatID, msg.MessageID)); err != nil {
+			slog.WarnContext(ctx, "Failed to delete forwarded message", "message_id", msg.MessageID, "error", err)
+		}
+		if msg.Document == nil {
+			continue
+		}
+
+		if ref := manifestRefFromMessage(&msg, b.Self.UserName); ref != nil {
+			manifest, err := s.fetchManifest(ctx, *ref)
+			if err != nil {
+				slog.WarnContext(ctx, "Skipping manifest", "message_id", messageID, "error", err)
+				continue
+			}
+			result.ManifestsRead++
+			if _, ok := recovered[manifest.ID]; ok {
+				continue
+			}
+			if manifest.Deleted {
+				recovered[manifest.ID] = nil
+				continue
+			}
+			if metadata, err := manifest.toMetadata(); err == nil {
+				metadata.ManifestMessageID = messageID
+				recovered[manifest.ID] = metadata
+				result.FilesFromManifest++
+			}
+			continue
+		}
+
+		uploadID, chunk, parity, ok := parseChunkCaption(msg.Caption)
+		if !ok {
+			continue
+		}
+		chunk.MessageID = messageID
+		chunk.FileID = msg.Document.FileID
+		chunk.BotToken = b.Self.UserName
+		if chunk.Codec != "" {
+			chunk.StoredSize = int64(msg.Document.FileSize)
+		} else {
+			chunk.Size = int64(msg.Document.FileSize)
+		}
+		chunk.GroupID = opts.GroupID
+
+		metadata, ok := fromCaptions[uploadID]
+		if !ok {
+			oid, err := primitive.ObjectIDFromHex(uploadID)
+			if err != nil {
+				continue
+			}
+			metadata = &models.FileMetadata{
+				ID:        oid,
+				Name:      "recovered_" + uploadID,
+				MimeType:  "application/octet-stream",
+				Chunks:    []models.FileChunk{},
+				CreatedAt: oid.Timestamp(),
+				UpdatedAt: time.Now(),
+			}
+			fromCaptions[uploadID] = metadata
+		}
+		if parity {
+			metadata.ParityChunks = append(metadata.ParityChunks, chunk)
+		} else {
+			metadata.Chunks = append(metadata.Chunks, chunk)
+		}
+	}
+
+	for _, metadata := range fromCaptions {
+		finishCaptionMetadata(metadata)
+	}
+	return fromCaptions, nil
+}
+
+// parseChunkCaption understands the captions written by uploadChunkOnce
+// ("ID: x\nPart: n", followed by "Codec: c\nSize: n" for compressed chunks)
+// and encodeParity ("ID: x\nStripe: s\nShard: i").
+func parseChunkCaption(caption string) (uploadID string, chunk models.FileChunk, parity bool, ok bool) {
+	lines := strings.Split(caption, "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "ID: ") {
+		return "", chunk, false, false
+	}
+	uploadID = strings.TrimPrefix(lines[0], "ID: ")
+
+	if _, err := fmt.Sscanf(lines[1], "Part: %d", &chunk.Sequence); err == nil {
+		if len(lines) >= 4 {
+			_, err1 := fmt.Sscanf(lines[2], "Codec: %s", &chunk.Codec)
+			_, err2 := fmt.Sscanf(lines[3], "Size: %d", &chunk.Size)
+			if err1 != nil || err2 != nil {
+				return "", chunk, false, false
+			}
+		}
+		return uploadID, chunk, false, true
+	}
+	if len(lines) >= 3 {
+		_, err1 := fmt.Sscanf(lines[1], "Stripe: %d", &chunk.Stripe)
+		_, err2 := fmt.Sscanf(lines[2], "Shard: %d", &chunk.Shard)
+		if err1 == nil && err2 == nil {
+			return uploadID, chunk, true, true
+		}
+	}
+	return "", chunk, false, false
+}
+
+// finishCaptionMetadata fills in what can be inferred about a file known only
+// from its chunk captions. The name and mime type are lost; the size is the
+// sum of the data chunks, and erasure parameters are derived from the parity
+// shard indexes (parity shards are numbered DataShards..DataShards+ParityShards-1).
+func finishCaptionMetadata(metadata *models.FileMetadata) {
+	metadata.Chunks = uniqueChunks(metadata.Chunks)
+	for _, c := range metadata.Chunks {
+		metadata.Size += c.Size
+	}
+
+	metadata.StorageMode = models.StorageModeStandard
+	if len(metadata.ParityChunks) > 0 {
+		minShard, maxShard := metadata.ParityChunks[0].Shard, metadata.ParityChunks[0].Shard
+		for _, p := range metadata.ParityChunks {
+			minShard = min(minShard, p.Shard)
+			maxShard = max(maxShard, p.Shard)
+		}
+		metadata.StorageMode = models.StorageModeErasure
+		metadata.DataShards = minShard
+		metadata.ParityShards = maxShard - minShard + 1
+	}
+
+	metadata.Status = "completed"
+	for i, c := range metadata.Chunks {
+		if c.Sequence != i {
+			metadata.Status = "incomplete"
+			break
+		}
+	}
+}
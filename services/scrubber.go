@@ -0,0 +1,340 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"telegram-storage/metrics"
+	"telegram-storage/models"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/time/rate"
+)
+
+// ScrubConfig controls the background scrubber.
+type ScrubConfig struct {
+	Interval   time.Duration `yaml:"interval" env:"SCRUB_INTERVAL"`       // how often a full pass runs, 0 disables; files verified more recently are skipped
+	Rate       float64       `yaml:"rate" env:"SCRUB_RATE"`               // chunk checks per second
+	VerifyHash bool          `yaml:"verify_hash" env:"SCRUB_VERIFY_HASH"` // download and hash each chunk instead of only calling getFile
+}
+
+func defaultScrubConfig() ScrubConfig {
+	return ScrubConfig{Interval: 24 * time.Hour, Rate: 2}
+}
+
+// ScrubRun describes the most recent scrub pass.
+type ScrubRun struct {
+	Running       bool       `json:"running"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	FilesChecked  int        `json:"files_checked"`
+	ChunksChecked int        `json:"chunks_checked"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type scrubState struct {
+	mu  sync.Mutex
+	cfg ScrubConfig
+	run ScrubRun
+}
+
+func (s *FileService) scrubConfig() ScrubConfig {
+	s.scrub.mu.Lock()
+	defer s.scrub.mu.Unlock()
+	return s.scrub.cfg
+}
+
+// StartScrubber queues a scrub job immediately and then every
+// ScrubConfig.Interval until ctx is cancelled.
+func (s *FileService) StartScrubber(ctx context.Context) {
+	cfg := s.scrubConfig()
+	if cfg.Interval <= 0 {
+		slog.Info("Scrubber disabled")
+		return
+	}
+	slog.Info("Scrubber started", "interval", cfg.Interval, "rate", cfg.Rate, "verify_hash", cfg.VerifyHash)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, _, err := s.jobs.Enqueue(ctx, JobTypeScrub, nil, JobOptions{UniqueKey: JobTypeScrub, MaxAttempts: 1}); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to queue scrub pass", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunScrub verifies every completed file not checked within cfg.Interval,
+// oldest verification first.
+func (s *FileService) RunScrub(ctx context.Context, cfg ScrubConfig) error {
+	s.scrub.mu.Lock()
+	if s.scrub.run.Running {
+		s.scrub.mu.Unlock()
+		return errorf(ErrConflict, "scrub already running")
+	}
+	now := time.Now()
+	s.scrub.run = ScrubRun{Running: true, StartedAt: &now}
+	s.scrub.mu.Unlock()
+
+	err := s.runScrubPass(ctx, cfg)
+
+	s.scrub.mu.Lock()
+	finished := time.Now()
+	s.scrub.run.Running = false
+	s.scrub.run.FinishedAt = &finished
+	if err != nil {
+		s.scrub.run.Error = err.Error()
+	}
+	run := s.scrub.run
+	s.scrub.mu.Unlock()
+
+	slog.InfoContext(ctx, "Scrub pass finished", "files", run.FilesChecked, "chunks", run.ChunksChecked,
+		"duration", finished.Sub(now))
+	return err
+}
+
+func (s *FileService) runScrubPass(ctx context.Context, cfg ScrubConfig) error {
+	limiter := rate.NewLimiter(rate.Limit(cfg.Rate), 1)
+	cutoff := time.Now().Add(-cfg.Interval)
+
+	filter := bson.M{
+		"status": "completed",
+		"$or": bson.A{
+			bson.M{"last_verified_at": bson.M{"$exists": false}},
+			bson.M{"last_verified_at": bson.M{"$lt": cutoff}},
+		},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "last_verified_at", Value: 1}}).
+		SetProjection(bson.M{"_id": 1})
+
+	// The pass is throttled and can take hours, longer than the server keeps
+	// an idle cursor open, so only the IDs are read up front and each file is
+	// loaded when its turn comes.
+	collection := s.db.Collection("files")
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	var ids []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &ids); err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	for _, id := range ids {
+		var metadata models.FileMetadata
+		err := collection.FindOne(ctx, bson.M{"$and": bson.A{bson.M{"_id": id.ID}, filter}}).Decode(&metadata)
+		if err == mongo.ErrNoDocuments {
+			// Deleted or verified by someone else since the listing
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to load file %s: %w", id.ID.Hex(), err)
+		}
+		if err := s.ScrubFile(ctx, &metadata, limiter, cfg.VerifyHash); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.ErrorContext(ctx, "Failed to scrub file", "file_id", metadata.ID.Hex(), "error", err)
+		}
+	}
+	return nil
+}
+
+// ScrubFile checks every chunk of a file and records its health.
+func (s *FileService) ScrubFile(ctx context.Context, metadata *models.FileMetadata, limiter *rate.Limiter, verifyHash bool) error {
+	chunks := uniqueChunks(metadata.Chunks)
+	if metadata.Pack != nil && metadata.Pack.Location != nil {
+		// A packed file lives or dies with its pack document
+		chunks = []models.FileChunk{*metadata.Pack.Location}
+	}
+
+	badData := make(map[int]bool)
+	for _, c := range chunks {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err := s.verifyChunk(ctx, c, verifyHash); err != nil {
+			slog.WarnContext(ctx, "Chunk failed verification", "file_id", metadata.ID.Hex(), "sequence", c.Sequence, "error", err)
+			badData[c.Sequence] = true
+		}
+	}
+
+	badParity := make(map[[2]int]bool)
+	for _, p := range metadata.ParityChunks {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err := s.verifyChunk(ctx, p, verifyHash); err != nil {
+			slog.WarnContext(ctx, "Parity chunk failed verification", "file_id", metadata.ID.Hex(), "stripe", p.Stripe, "shard", p.Shard, "error", err)
+			badParity[[2]int{p.Stripe, p.Shard}] = true
+		}
+	}
+
+	health := fileHealth(metadata, chunks, badData, badParity)
+
+	badChunks := make([]int, 0, len(badData))
+	for _, c := range chunks {
+		if badData[c.Sequence] {
+			badChunks = append(badChunks, c.Sequence)
+		}
+	}
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{
+		"health":           health,
+		"last_verified_at": now,
+		"bad_chunks":       badChunks,
+	}}
+	dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("files").UpdateOne(dbCtx, bson.M{"_id": metadata.ID}, update); err != nil {
+		return fmt.Errorf("failed to record health: %w", err)
+	}
+
+	s.scrub.mu.Lock()
+	s.scrub.run.FilesChecked++
+	s.scrub.run.ChunksChecked += len(chunks) + len(metadata.ParityChunks)
+	s.scrub.mu.Unlock()
+
+	if health != models.HealthHealthy {
+		slog.WarnContext(ctx, "File health changed", "file_id", metadata.ID.Hex(), "name", metadata.Name,
+			"health", health, "bad_data_chunks", len(badData), "bad_parity_chunks", len(badParity))
+	}
+	return nil
+}
+
+// fileHealth classifies a file from the set of chunks that failed verification.
+// For erasure-coded files a stripe survives as long as no more than
+// ParityShards of its shards (including never-uploaded parity) are bad.
+func fileHealth(metadata *models.FileMetadata, chunks []models.FileChunk, badData map[int]bool, badParity map[[2]int]bool) string {
+	if !metadata.IsErasureCoded() {
+		if len(badData) > 0 {
+			return models.HealthLost
+		}
+		return models.HealthHealthy
+	}
+
+	k, m := metadata.DataShards, metadata.ParityShards
+	health := models.HealthHealthy
+	stripes := (len(chunks) + k - 1) / k
+	for stripe := 0; stripe < stripes; stripe++ {
+		bad := 0
+		for i := 0; i < k; i++ {
+			if badData[stripe*k+i] {
+				bad++
+			}
+		}
+		parity := parityByShard(metadata, stripe)
+		for j := 0; j < m; j++ {
+			if _, ok := parity[k+j]; !ok || badParity[[2]int{stripe, k + j}] {
+				bad++
+			}
+		}
+		if bad > m {
+			return models.HealthLost
+		}
+		if bad > 0 {
+			health = models.HealthDegraded
+		}
+	}
+	return health
+}
+
+// verifyChunk confirms Telegram still serves the chunk. With verifyHash the
+// chunk is downloaded and compared against its recorded SHA-256.
+func (s *FileService) verifyChunk(ctx context.Context, chunk models.FileChunk, verifyHash bool) error {
+	if verifyHash && chunk.Hash != "" {
+		hasher := sha256.New()
+		// Bypass the local cache: the point is to check the copy in Telegram
+		if err := s.downloadChunkUncached(ctx, chunk, hasher); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(hasher.Sum(nil)); got != chunk.Hash {
+			return fmt.Errorf("hash mismatch: expected %s, got %s", chunk.Hash, got)
+		}
+		return nil
+	}
+
+	targetBot, err := s.botForChunk(chunk)
+	if err != nil {
+		return err
+	}
+	file, err := targetBot.GetFile(tgbotapi.FileConfig{FileID: chunk.FileID})
+	metrics.ObserveTelegram(targetBot.Self.UserName, "getFile", metrics.Outcome(err))
+	if err != nil {
+		return fmt.Errorf("getFile failed: %w", telegramError(err))
+	}
+	if file.FileSize > 0 && int64(file.FileSize) != storedSize(chunk) {
+		return fmt.Errorf("size mismatch: expected %d, got %d", storedSize(chunk), file.FileSize)
+	}
+	return nil
+}
+
+// ScrubReport summarises file health across the store.
+type ScrubReport struct {
+	LastRun    ScrubRun              `json:"last_run"`
+	Counts     map[string]int64      `json:"counts"`
+	Unverified int64                 `json:"unverified"`
+	Unhealthy  []models.FileMetadata `json:"unhealthy"`
+}
+
+func (s *FileService) GetScrubReport(ctx context.Context) (*ScrubReport, error) {
+	collection := s.db.Collection("files")
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	report := &ScrubReport{Counts: make(map[string]int64)}
+
+	s.scrub.mu.Lock()
+	report.LastRun = s.scrub.run
+	s.scrub.mu.Unlock()
+
+	for _, health := range []string{models.HealthHealthy, models.HealthDegraded, models.HealthLost} {
+		count, err := collection.CountDocuments(ctx, bson.M{"status": "completed", "health": health})
+		if err != nil {
+			return nil, fmt.Errorf("failed to count %s files: %w", health, err)
+		}
+		report.Counts[health] = count
+	}
+
+	unverified, err := collection.CountDocuments(ctx, bson.M{"status": "completed", "last_verified_at": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count unverified files: %w", err)
+	}
+	report.Unverified = unverified
+
+	// Chunk lists are large and not useful in a report
+	opts := options.Find().
+		SetSort(bson.D{{Key: "last_verified_at", Value: -1}}).
+		SetProjection(bson.M{"chunks": 0, "parity_chunks": 0})
+	cursor, err := collection.Find(ctx, bson.M{"health": bson.M{"$in": bson.A{models.HealthDegraded, models.HealthLost}}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unhealthy files: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	report.Unhealthy = []models.FileMetadata{}
+	if err = cursor.All(ctx, &report.Unhealthy); err != nil {
+		return nil, fmt.Errorf("failed to decode files: %w", err)
+	}
+	return report, nil
+}
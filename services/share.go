@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"telegram-storage/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CreateShare creates a link token for a completed file. A ttl of zero makes
+// a share that does not expire.
+func (s *FileService) CreateShare(ctx context.Context, fileID string, ttl time.Duration) (*models.Share, error) {
+	if ttl < 0 {
+		return nil, errorf(ErrInvalidArgument, "ttl must not be negative")
+	}
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Status != "completed" {
+		return nil, errorf(ErrConflict, "file upload not completed")
+	}
+
+	// 128 bits, so tokens cannot be guessed
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to create share token: %w", err)
+	}
+	share := &models.Share{
+		Token:     base64.RawURLEncoding.EncodeToString(token),
+		FileID:    metadata.ID,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expiresAt := share.CreatedAt.Add(ttl)
+		share.ExpiresAt = &expiresAt
+	}
+	if _, err := s.db.Collection("shares").InsertOne(ctx, share); err != nil {
+		return nil, fmt.Errorf("failed to store share: %w", err)
+	}
+	slog.InfoContext(ctx, "Share created", "file_id", fileID, "expires_at", share.ExpiresAt)
+	return share, nil
+}
+
+// GetShare returns the share with the given token. Expired shares are not
+// found even before the TTL index removes them.
+func (s *FileService) GetShare(ctx context.Context, token string) (*models.Share, error) {
+	var share models.Share
+	err := s.db.Collection("shares").FindOne(ctx, bson.M{"_id": token}).Decode(&share)
+	if err == mongo.ErrNoDocuments || (err == nil && share.ExpiresAt != nil && time.Now().After(*share.ExpiresAt)) {
+		return nil, errorf(ErrNotFound, "share not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share: %w", err)
+	}
+	return &share, nil
+}
+
+// DeleteShare revokes a share.
+func (s *FileService) DeleteShare(ctx context.Context, token string) error {
+	res, err := s.db.Collection("shares").DeleteOne(ctx, bson.M{"_id": token})
+	if err != nil {
+		return fmt.Errorf("failed to delete share: %w", err)
+	}
+	if res.DeletedCount == 0 {
+		return errorf(ErrNotFound, "share not found")
+	}
+	return nil
+}
+
+func (s *FileService) deleteShares(ctx context.Context, metadata *models.FileMetadata) {
+	if _, err := s.db.Collection("shares").DeleteMany(ctx, bson.M{"file_id": metadata.ID}); err != nil {
+		slog.WarnContext(ctx, "Failed to delete shares", "file_id", metadata.ID.Hex(), "error", err)
+	}
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Spool directories of uploads are normally removed when the upload completes
+// or is deleted. Uploads deleted by another host, or while this one was down,
+// leave theirs behind; the sweeper removes those.
+const (
+	spoolSweepInterval = time.Hour
+	spoolSweepMinAge   = time.Hour // younger directories may belong to an upload whose record is not visible yet
+)
+
+// The spool is a local staging area for chunk bytes that the server needs to
+// read again after they have been sent to Telegram (e.g. to compute parity).
+
+func (s *FileService) spoolPath(uploadID string, sequence int) string {
+	return filepath.Join(s.spoolDir, uploadID, strconv.Itoa(sequence))
+}
+
+// spoolPartPath is where a client part of a content-defined upload is kept
+// until it is re-chunked at completion.
+func (s *FileService) spoolPartPath(uploadID string, sequence int) string {
+	return filepath.Join(s.spoolDir, uploadID, "part-"+strconv.Itoa(sequence))
+}
+
+// spoolChunk writes a chunk to the spool and returns its path. The write goes
+// through a temp file so a half-written part is never mistaken for a full one.
+func (s *FileService) spoolChunk(uploadID string, sequence int, r io.Reader) (string, error) {
+	return s.spoolFile(uploadID, s.spoolPath(uploadID, sequence), sequence, r)
+}
+
+func (s *FileService) spoolPart(uploadID string, sequence int, r io.Reader) (string, error) {
+	return s.spoolFile(uploadID, s.spoolPartPath(uploadID, sequence), sequence, r)
+}
+
+func (s *FileService) spoolFile(uploadID, path string, sequence int, r io.Reader) (string, error) {
+	dir := filepath.Join(s.spoolDir, uploadID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create spool dir: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create spool file: %w", err)
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to spool chunk %d: %w", sequence, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to spool chunk %d: %w", sequence, err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to spool chunk %d: %w", sequence, err)
+	}
+	return path, nil
+}
+
+// readSpooledChunk returns the spooled bytes of a chunk, or os.ErrNotExist if
+// the chunk was never spooled on this host.
+func (s *FileService) readSpooledChunk(uploadID string, sequence int) ([]byte, error) {
+	return os.ReadFile(s.spoolPath(uploadID, sequence))
+}
+
+func (s *FileService) removeSpool(uploadID string) {
+	if err := os.RemoveAll(filepath.Join(s.spoolDir, uploadID)); err != nil {
+		slog.Warn("Failed to remove spool", "upload_id", uploadID, "error", err)
+	}
+}
+
+// StartSpoolSweeper removes orphaned upload spools now and every
+// spoolSweepInterval until ctx is cancelled. Spools are local to each host,
+// so every instance sweeps its own.
+func (s *FileService) StartSpoolSweeper(ctx context.Context) {
+	ticker := time.NewTicker(spoolSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.sweepSpool(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to sweep spool", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepSpool removes the spool directory of every upload that no longer has
+// an unfinished file record.
+func (s *FileService) sweepSpool(ctx context.Context) error {
+	entries, err := os.ReadDir(s.spoolDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spool dir: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		// Other spool users (packs, cache, assemble, ...) have non-ID names
+		uploadID, err := primitive.ObjectIDFromHex(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < spoolSweepMinAge {
+			continue
+		}
+
+		dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		count, err := s.db.Collection("files").CountDocuments(dbCtx,
+			bson.M{"_id": uploadID, "status": bson.M{"$ne": "completed"}})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to look up upload %s: %w", uploadID.Hex(), err)
+		}
+		if count > 0 {
+			continue
+		}
+		s.removeSpool(uploadID.Hex())
+		removed++
+	}
+
+	if removed > 0 {
+		slog.InfoContext(ctx, "Removed orphaned upload spools", "count", removed)
+	}
+	return nil
+}
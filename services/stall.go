@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// chunkReadTimeout is how long Telegram may go without delivering any data
+// for a fetch, including the wait for the response headers.
+const chunkReadTimeout = 60 * time.Second
+
+// stallTimer cancels a fetch that makes no progress. Unlike a total deadline
+// it only runs while waiting on Telegram, so time spent blocked on a slow
+// destination writer is not counted against the fetch.
+type stallTimer struct {
+	timer *time.Timer
+	fired atomic.Bool
+}
+
+// newStallTimer starts the timer; it calls cancel if chunkReadTimeout passes
+// before stop is called or a read completes.
+func newStallTimer(cancel context.CancelFunc) *stallTimer {
+	t := &stallTimer{}
+	t.timer = time.AfterFunc(chunkReadTimeout, func() {
+		t.fired.Store(true)
+		cancel()
+	})
+	return t
+}
+
+func (t *stallTimer) stop() {
+	t.timer.Stop()
+}
+
+// reader wraps r so the timer runs only while a Read is in progress.
+func (t *stallTimer) reader(r io.Reader) io.Reader {
+	return &stallReader{r: r, t: t}
+}
+
+// wrap replaces the bare cancellation error with one naming the stall.
+func (t *stallTimer) wrap(err error) error {
+	if err != nil && t.fired.Load() {
+		return fmt.Errorf("no data from Telegram for %s: %w", chunkReadTimeout, err)
+	}
+	return err
+}
+
+type stallReader struct {
+	r io.Reader
+	t *stallTimer
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.t.timer.Reset(chunkReadTimeout)
+	n, err := r.r.Read(p)
+	r.t.timer.Stop()
+	return n, err
+}
@@ -0,0 +1,339 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"telegram-storage/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails are generated in the background after CompleteUpload and kept
+// in the thumbnails collection. Images are decoded in Go straight from the
+// chunk stream, and the download stops as soon as the decoder has what it
+// needs (the first frame of a GIF, for example). Videos have their first frame
+// extracted by ffmpeg from the leading chunks, falling back to the whole file
+// when the container keeps its index at the end.
+
+// ThumbnailConfig controls thumbnail generation.
+type ThumbnailConfig struct {
+	Sizes          []int  `yaml:"sizes" env:"THUMBNAIL_SIZES"`                       // longest edge in pixels, ascending
+	MaxSourceBytes int64  `yaml:"max_source_bytes" env:"THUMBNAIL_MAX_SOURCE_BYTES"` // larger images are not thumbnailed, nor videos that need a full download
+	MaxPixels      int64  `yaml:"max_pixels" env:"THUMBNAIL_MAX_PIXELS"`             // images with more pixels are not decoded; a small file can still expand hugely
+	VideoPrefix    int64  `yaml:"video_prefix" env:"THUMBNAIL_VIDEO_PREFIX"`         // bytes of a video tried before falling back to the whole file
+	FFmpeg         string `yaml:"-"`                                                 // resolved from Config.FFmpeg; empty disables video thumbnails
+	Workers        int    `yaml:"workers" env:"THUMBNAIL_WORKERS"`                   // default concurrency of thumbnail jobs
+}
+
+func defaultThumbnailConfig() ThumbnailConfig {
+	return ThumbnailConfig{Sizes: []int{128, 256, 512}, MaxSourceBytes: 64 << 20, MaxPixels: 50_000_000, VideoPrefix: 16 << 20, Workers: 2}
+}
+
+type thumbnailState struct {
+	cfg ThumbnailConfig
+}
+
+func isThumbnailImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// canThumbnail reports whether thumbnails can be generated for a file.
+func (s *FileService) canThumbnail(metadata *models.FileMetadata) bool {
+	if metadata.Status != "completed" || metadata.Size == 0 {
+		return false
+	}
+	if isThumbnailImage(metadata.MimeType) {
+		return metadata.Size <= s.thumbs.cfg.MaxSourceBytes
+	}
+	return isVideoMimeType(metadata.MimeType) && s.thumbs.cfg.FFmpeg != ""
+}
+
+// queueThumbnails queues thumbnail generation for a file unless it is
+// already queued or running.
+func (s *FileService) queueThumbnails(ctx context.Context, metadata *models.FileMetadata) error {
+	if !s.canThumbnail(metadata) {
+		return nil
+	}
+	if _, _, err := s.enqueueFileJob(ctx, JobTypeThumbnail, metadata.ID.Hex(), 0); err != nil {
+		return fmt.Errorf("failed to queue thumbnails: %w", err)
+	}
+	return nil
+}
+
+// runThumbnail is the thumbnail job handler.
+func (s *FileService) runThumbnail(ctx context.Context, job *models.Job) error {
+	metadata, err := s.jobFile(ctx, job)
+	if err != nil || metadata == nil || !s.canThumbnail(metadata) {
+		return err
+	}
+	err = s.generateThumbnails(ctx, metadata)
+
+	// Record a failure that will not be retried, so GetThumbnail stops
+	// queueing the file again
+	var perm permanentError
+	if err != nil && ctx.Err() == nil && (errors.As(err, &perm) || job.Attempts >= job.MaxAttempts) {
+		dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		_, updateErr := s.db.Collection("files").UpdateOne(dbCtx, bson.M{"_id": metadata.ID},
+			bson.M{"$set": bson.M{"thumbnail_error": err.Error()}})
+		if updateErr != nil {
+			slog.ErrorContext(ctx, "Failed to record thumbnail failure", "file_id", metadata.ID.Hex(), "error", updateErr)
+		}
+	}
+	return err
+}
+
+func (s *FileService) generateThumbnails(ctx context.Context, metadata *models.FileMetadata) error {
+	startTime := time.Now()
+
+	var src image.Image
+	var err error
+	if isThumbnailImage(metadata.MimeType) {
+		src, err = s.decodeImageHead(ctx, metadata)
+	} else {
+		src, err = s.videoFrame(ctx, metadata)
+	}
+	if err != nil {
+		return err
+	}
+
+	collection := s.db.Collection("thumbnails")
+	var sizes []int
+	for _, size := range s.thumbs.cfg.Sizes {
+		thumb, err := renderThumbnail(src, size)
+		if err != nil {
+			return err
+		}
+		thumb.ID = fmt.Sprintf("%s_%d", metadata.ID.Hex(), size)
+		thumb.FileID = metadata.ID
+		thumb.Size = size
+		thumb.CreatedAt = time.Now()
+		if _, err := collection.ReplaceOne(ctx, bson.M{"_id": thumb.ID}, thumb, options.Replace().SetUpsert(true)); err != nil {
+			return fmt.Errorf("failed to store thumbnail: %w", err)
+		}
+		sizes = append(sizes, size)
+
+		// Sizes beyond the source add nothing
+		if b := src.Bounds(); max(b.Dx(), b.Dy()) <= size {
+			break
+		}
+	}
+
+	res, err := s.db.Collection("files").UpdateOne(ctx, bson.M{"_id": metadata.ID}, bson.M{
+		"$set":   bson.M{"thumbnails": sizes},
+		"$unset": bson.M{"thumbnail_error": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update file: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		// Deleted meanwhile
+		s.deleteThumbnails(ctx, metadata)
+		return nil
+	}
+	slog.InfoContext(ctx, "Thumbnails generated", "file_id", metadata.ID.Hex(), "sizes", sizes, "duration", time.Since(startTime))
+	return nil
+}
+
+// decodeImageHead decodes an image from the start of the file, stopping the
+// download once the decoder returns. The header is read first so images over
+// the pixel limit are rejected before anything is allocated for them.
+func (s *FileService) decodeImageHead(ctx context.Context, metadata *models.FileMetadata) (image.Image, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		if err := s.assembleRange(ctx, metadata, 0, metadata.Size, pw, nil); err != nil {
+			pw.CloseWithError(fetchError{err})
+			return
+		}
+		pw.Close()
+	}()
+
+	decodeErr := func(err error) error {
+		var fetchErr fetchError
+		if ctx.Err() != nil || errors.As(err, &fetchErr) {
+			return fmt.Errorf("failed to read image: %w", err)
+		}
+		return permanent(fmt.Errorf("failed to decode image: %w", err))
+	}
+
+	br := bufio.NewReader(pr)
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(br, &head))
+	if err != nil {
+		return nil, decodeErr(err)
+	}
+	if pixels := int64(cfg.Width) * int64(cfg.Height); pixels > s.thumbs.cfg.MaxPixels {
+		return nil, permanent(fmt.Errorf("image is %dx%d, over the limit of %d pixels", cfg.Width, cfg.Height, s.thumbs.cfg.MaxPixels))
+	}
+
+	img, _, err := image.Decode(io.MultiReader(&head, br))
+	if err != nil {
+		return nil, decodeErr(err)
+	}
+	return img, nil
+}
+
+// fetchError marks a download failure seen by a decoder, as opposed to
+// content it cannot decode.
+type fetchError struct{ err error }
+
+func (e fetchError) Error() string { return e.err.Error() }
+
+// videoFrame extracts the first frame of a video with ffmpeg.
+func (s *FileService) videoFrame(ctx context.Context, metadata *models.FileMetadata) (image.Image, error) {
+	dir := filepath.Join(s.spoolDir, "thumbnails")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create work dir: %w", err)
+	}
+	f, err := os.CreateTemp(dir, "video-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Most containers can be decoded from their first chunks; MP4 files
+	// without faststart keep their index at the end and need the whole file
+	length := min(metadata.Size, s.thumbs.cfg.VideoPrefix)
+	if err := s.assembleRange(ctx, metadata, 0, length, f, nil); err != nil {
+		return nil, fmt.Errorf("failed to read video: %w", err)
+	}
+	img, err := s.extractFrame(ctx, f.Name())
+	if err == nil || length == metadata.Size {
+		return img, err
+	}
+	if metadata.Size > s.thumbs.cfg.MaxSourceBytes {
+		return nil, permanent(fmt.Errorf("%v (video too large to read in full)", err))
+	}
+
+	// Append the rest of the file after the prefix
+	if err := s.assembleRange(ctx, metadata, length, metadata.Size-length, f, nil); err != nil {
+		return nil, fmt.Errorf("failed to read video: %w", err)
+	}
+	return s.extractFrame(ctx, f.Name())
+}
+
+func (s *FileService) extractFrame(ctx context.Context, path string) (image.Image, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.thumbs.cfg.FFmpeg, "-hide_banner", "-loglevel", "error",
+		"-i", path, "-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if len(out) == 0 {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 300 {
+			msg = msg[len(msg)-300:]
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, permanent(fmt.Errorf("ffmpeg failed: %v: %s", err, msg))
+	}
+	img, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to decode frame: %w", err))
+	}
+	return img, nil
+}
+
+// renderThumbnail scales src to fit size x size, without enlarging it, and
+// encodes it as JPEG over a white background.
+func renderThumbnail(src image.Image, size int) (*models.Thumbnail, error) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+	if longest := max(w, h); longest > size {
+		w = max(1, w*size/longest)
+		h = max(1, h*size/longest)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return &models.Thumbnail{Width: w, Height: h, Data: buf.Bytes()}, nil
+}
+
+// GetThumbnail returns the smallest thumbnail of a file at least size pixels
+// on its longer edge, or the largest one there is. It queues generation and
+// returns nil when the file has none yet, unless generation already failed
+// for good.
+func (s *FileService) GetThumbnail(ctx context.Context, fileID string, size int) (*models.Thumbnail, error) {
+	metadata, err := s.GetFileMetadata(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata.Thumbnails) == 0 {
+		if metadata.ThumbnailError != "" {
+			return nil, errorf(ErrNotFound, "thumbnail generation failed: %s", metadata.ThumbnailError)
+		}
+		if !s.canThumbnail(metadata) {
+			return nil, errorf(ErrNotFound, "thumbnails are not available for this file")
+		}
+		if err := s.queueThumbnails(ctx, metadata); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	chosen := metadata.Thumbnails[len(metadata.Thumbnails)-1]
+	for _, n := range metadata.Thumbnails {
+		if n >= size {
+			chosen = n
+			break
+		}
+	}
+
+	var thumb models.Thumbnail
+	err = s.db.Collection("thumbnails").FindOne(ctx, bson.M{"_id": fmt.Sprintf("%s_%d", fileID, chosen)}).Decode(&thumb)
+	if err == mongo.ErrNoDocuments {
+		// Listed on the file but lost; make it again
+		if err := s.queueThumbnails(ctx, metadata); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thumbnail: %w", err)
+	}
+	return &thumb, nil
+}
+
+func (s *FileService) deleteThumbnails(ctx context.Context, metadata *models.FileMetadata) {
+	if _, err := s.db.Collection("thumbnails").DeleteMany(ctx, bson.M{"file_id": metadata.ID}); err != nil {
+		slog.WarnContext(ctx, "Failed to delete thumbnails", "file_id", metadata.ID.Hex(), "error", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Package tracing sets up OpenTelemetry tracing and exports spans over OTLP.
+//
+// Export is configured with the standard OTEL_* variables: spans are sent to
+// OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) over
+// OTLP/HTTP, OTEL_EXPORTER_OTLP_HEADERS adds headers, OTEL_SERVICE_NAME names
+// the service and OTEL_TRACES_SAMPLER / OTEL_TRACES_SAMPLER_ARG pick the
+// sampler. Without an endpoint, or with OTEL_TRACES_EXPORTER=none, spans are
+// not recorded but incoming trace context is still passed on.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is used when OTEL_SERVICE_NAME is not set.
+const ServiceName = "telegram-storage"
+
+// Span attributes shared across the upload and download paths.
+const (
+	AttrFileID        = attribute.Key("file.id")
+	AttrChunkSequence = attribute.Key("chunk.sequence")
+	AttrChunkSize     = attribute.Key("chunk.size")
+	AttrBot           = attribute.Key("telegram.bot") // username, never the token
+	AttrAttempt       = attribute.Key("retry.attempt")
+	AttrJobType       = attribute.Key("job.type")
+)
+
+var tracer = otel.Tracer(ServiceName)
+
+// Enabled reports whether the environment configures an OTLP endpoint.
+func Enabled() bool {
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup installs the global propagator and, when Enabled, a tracer provider
+// exporting over OTLP. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(ServiceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Exporting spans over OTLP")
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it failed when err is non-nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}